@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"time"
 )
 
 type login struct {
@@ -10,15 +11,115 @@ type login struct {
 }
 
 type account struct {
-	UserID string `json:"user_id"`
-	Admin  bool   `json:"admin"`
-	Email  string `json:"email"`
+	ID            int    `json:"id"`
+	UserID        string `json:"user_id"`
+	Admin         bool   `json:"admin"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Active        bool   `json:"active"`
+}
+
+// accountUpdate is the payload for creating and updating accounts, empty fields are left unchanged
+type accountUpdate struct {
+	UserID          string `json:"user_id"`
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password"`
+	Admin           *bool  `json:"admin"`
+	Active          *bool  `json:"active"`
 }
 
 func (p *login) authenticate(db *sql.DB) (account, error) {
 	var token account
-	err := db.QueryRow("SELECT user_id, admin, email FROM booking.account WHERE user_id=$1 AND password = crypt($2, password)",
-		p.UserID, p.Password).Scan(&token.UserID, &token.Admin, &token.Email)
+	err := db.QueryRow("SELECT id, user_id, admin, email, email_verified, active FROM booking.account WHERE user_id=$1 AND password = crypt($2, password) AND active",
+		p.UserID, p.Password).Scan(&token.ID, &token.UserID, &token.Admin, &token.Email, &token.EmailVerified, &token.Active)
 
 	return token, err
 }
+
+// canManageBooking reports whether p may create or change a booking owned by userID
+func (p *account) canManageBooking(userID string) bool {
+	return p.Admin || (len(p.UserID) > 0 && p.UserID == userID)
+}
+
+func (p *account) getAccount(db dbtx) error {
+	return db.QueryRow("SELECT user_id, admin, email, email_verified, active FROM booking.account WHERE id=$1",
+		p.ID).Scan(&p.UserID, &p.Admin, &p.Email, &p.EmailVerified, &p.Active)
+}
+
+func (p *account) checkPassword(db dbtx, password string) (bool, error) {
+	var ok bool
+	err := db.QueryRow("SELECT password = crypt($2, password) FROM booking.account WHERE id=$1",
+		p.ID, password).Scan(&ok)
+
+	return ok, err
+}
+
+func (p *account) createAccount(db dbtx, password string) error {
+	return db.QueryRow(
+		"INSERT INTO booking.account(user_id, admin, email, active, password) VALUES($1, $2, $3, $4, crypt($5, gen_salt('bf'))) RETURNING id",
+		p.UserID, p.Admin, p.Email, p.Active, password).Scan(&p.ID)
+}
+
+// updateAccount saves p, the password is only changed when one is given and changing
+// it or deactivating the account revokes every session except keepAccessToken's
+func (p *account) updateAccount(db *sql.DB, password, keepAccessToken string) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		err := tx.QueryRow(
+			"UPDATE booking.account SET admin=$1, email=$2, email_verified=(email_verified AND email=$2), active=$3, password=CASE WHEN $4::text = '' THEN password ELSE crypt($4::text, gen_salt('bf')) END WHERE id=$5 RETURNING email_verified",
+			p.Admin, p.Email, p.Active, password, p.ID).Scan(&p.EmailVerified)
+		if err != nil {
+			return err
+		}
+
+		if len(password) > 0 || !p.Active {
+			return p.revokeSessions(tx, keepAccessToken)
+		}
+
+		return nil
+	})
+}
+
+// revokeSessions revokes every session of p except the one holding keepAccessToken
+func (p *account) revokeSessions(db dbtx, keepAccessToken string) error {
+	_, err := db.Exec("UPDATE booking.session SET revoked_dt=$1 WHERE user_id=$2 AND revoked_dt IS NULL AND access_token_hash <> $3",
+		time.Now(), p.UserID, hashToken(keepAccessToken))
+
+	return err
+}
+
+func getAccounts(db *sql.DB, start, count int) ([]account, error) {
+	rows, err := db.Query(
+		"SELECT id, user_id, admin, email, email_verified, active FROM booking.account ORDER BY id LIMIT $1 OFFSET $2",
+		count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	accounts := []account{}
+
+	for rows.Next() {
+		var p account
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Admin, &p.Email, &p.EmailVerified, &p.Active); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, p)
+	}
+
+	return accounts, nil
+}
+
+func getAccountsCount(db *sql.DB) (int, error) {
+
+	var count int
+	err := db.QueryRow("SELECT COUNT (id) FROM booking.account").Scan(&count)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
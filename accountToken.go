@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+const passwordResetPurpose = "password_reset"
+const emailVerificationPurpose = "email_verification"
+
+const passwordResetTTL = time.Hour
+const emailVerificationTTL = 24 * time.Hour
+
+// tokenRedemption is the payload for redeeming a password reset or email verification token
+type tokenRedemption struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type passwordResetRequest struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// createAccountToken issues a single-use token for p, replacing any unused token with the same purpose
+func (p *account) createAccountToken(db *sql.DB, purpose string, ttl time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = withTx(db, func(tx *sql.Tx) error {
+		currentTime := time.Now()
+		if _, err := tx.Exec("UPDATE booking.account_token SET used_dt=$1 WHERE user_id=$2 AND purpose=$3 AND used_dt IS NULL",
+			currentTime, p.UserID, purpose); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(
+			"INSERT INTO booking.account_token(user_id, email, purpose, token_hash, expires_dt, transaction_dt) VALUES($1, $2, $3, $4, $5, $6)",
+			p.UserID, p.Email, purpose, hashToken(token), currentTime.Add(ttl), currentTime)
+
+		return err
+	})
+
+	return token, err
+}
+
+// redeemAccountToken marks token as used and returns the account it was issued for,
+// sql.ErrNoRows is returned for an unknown, used or expired token
+func redeemAccountToken(db dbtx, token, purpose string) (account, error) {
+	var p account
+	err := db.QueryRow(
+		"UPDATE booking.account_token SET used_dt=$1 WHERE token_hash=$2 AND purpose=$3 AND used_dt IS NULL AND expires_dt > now() RETURNING user_id, email",
+		time.Now(), hashToken(token), purpose).Scan(&p.UserID, &p.Email)
+
+	return p, err
+}
+
+// getAccountsForReset returns the active accounts matching a password reset request
+func getAccountsForReset(db *sql.DB, userID, email string) ([]account, error) {
+	rows, err := db.Query(
+		"SELECT id, user_id, email FROM booking.account WHERE active AND ((user_id=$1 AND $1 <> '') OR (email=$2 AND $2 <> ''))",
+		userID, email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	accounts := []account{}
+
+	for rows.Next() {
+		var p account
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Email); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, p)
+	}
+
+	return accounts, nil
+}
+
+func resetPassword(db *sql.DB, token, password string) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		p, err := redeemAccountToken(tx, token, passwordResetPurpose)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE booking.account SET password=crypt($1, gen_salt('bf')) WHERE user_id=$2",
+			password, p.UserID); err != nil {
+			return err
+		}
+
+		return p.revokeSessions(tx, "")
+	})
+}
+
+// verifyEmail marks the account's email as verified, provided it has not changed since the token was issued
+func verifyEmail(db *sql.DB, token string) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		p, err := redeemAccountToken(tx, token, emailVerificationPurpose)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("UPDATE booking.account SET email_verified=true WHERE user_id=$1 AND email=$2",
+			p.UserID, p.Email)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err == nil && n == 0 {
+			err = sql.ErrNoRows
+		}
+
+		return err
+	})
+}
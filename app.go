@@ -1,22 +1,53 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
 
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-// App struct exposes references to the router and the database
+// App struct exposes references to the router, the database, the outgoing mailer, the sinks
+// that receive outbox events and the client that delivers webhooks
 type App struct {
-	Router *mux.Router
-	DB     *sql.DB
+	Router        *mux.Router
+	DB            *sql.DB
+	Mailer        mailer
+	Sinks         []eventSink
+	WebhookClient *http.Client
+}
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// withTx runs fn inside a transaction, committing only if fn succeeds
+func withTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // Initialize the Postgresql DB connection
@@ -35,12 +66,16 @@ func (a *App) Initialize(user, password, host, port, dbname string) {
 	}
 
 	a.Router = mux.NewRouter()
+	a.Mailer = &logMailer{log.New(os.Stderr, "mail: ", log.LstdFlags)}
+	a.Sinks = []eventSink{&webhookSink{}, &confirmationSink{a}}
+	a.WebhookClient = &http.Client{Timeout: webhookTimeout}
 
 	a.initializeRoutes()
 }
 
-// Run to Listen to port 8010
+// Run to Listen to port 8010, background jobs run alongside the server
 func (a *App) Run(addr string) {
+	go a.runWorkers(workerInterval)
 	log.Fatal(http.ListenAndServe(addr, a.Router))
 }
 
@@ -64,13 +99,38 @@ func (a *App) getBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	caller, _ := accountFromContext(r.Context())
+	if !caller.canManageBooking(p.UserID) {
+		p.hideAttendees()
+	}
+
 	respondWithJSON(w, http.StatusOK, p)
 }
 
+// canListAttendee reports whether the caller may see the bookings attendee was invited to
+func canListAttendee(r *http.Request, attendee string) bool {
+	caller, _ := accountFromContext(r.Context())
+	return len(attendee) == 0 || caller.Admin || (len(caller.UserID) > 0 && (attendee == caller.UserID || attendee == caller.Email))
+}
+
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
 }
 
+func respondWithBookingError(w http.ResponseWriter, err error) {
+	if v, ok := err.(*ruleViolation); ok {
+		respondWithJSON(w, http.StatusUnprocessableEntity, v)
+		return
+	}
+
+	if err == errBookingOverlap || err == errWaitlistChanged {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	respondWithError(w, http.StatusInternalServerError, err.Error())
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	response, _ := json.Marshal(payload)
 
@@ -79,11 +139,19 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
+func respondWithCalendar(w http.ResponseWriter, calendar string) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(calendar))
+}
+
 func (a *App) getBookings(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 	count, _ := strconv.Atoi(r.FormValue("count"))
 	start, _ := strconv.Atoi(r.FormValue("start"))
 	userid := r.FormValue("user_id")
+	status := r.FormValue("status")
+	attendee := r.FormValue("attendee")
 
 	if count < 1 {
 		count = 10
@@ -92,12 +160,24 @@ func (a *App) getBookings(w http.ResponseWriter, r *http.Request) {
 		start = 0
 	}
 
-	bookings, err := getBookings(a.DB, start, count, userid)
+	if !canListAttendee(r, attendee) {
+		respondWithError(w, http.StatusForbidden, "Cannot list the bookings of other attendees")
+		return
+	}
+
+	bookings, err := getBookings(a.DB, start, count, userid, status, attendee)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	caller, _ := accountFromContext(r.Context())
+	for i := range bookings {
+		if !caller.canManageBooking(bookings[i].UserID) {
+			bookings[i].hideAttendees()
+		}
+	}
+
 	respondWithJSON(w, http.StatusOK, bookings)
 }
 
@@ -105,8 +185,15 @@ func (a *App) getBookingsCount(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 
 	userid := r.FormValue("user_id")
+	status := r.FormValue("status")
+	attendee := r.FormValue("attendee")
+
+	if !canListAttendee(r, attendee) {
+		respondWithError(w, http.StatusForbidden, "Cannot list the bookings of other attendees")
+		return
+	}
 
-	count, err := getBookingsCount(a.DB, userid)
+	count, err := getBookingsCount(a.DB, userid, status, attendee)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -124,26 +211,26 @@ func (a *App) createBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	p.ID = 0
+	// the initial status is decided by the server, never by the client
+	p.Status = ""
 
-	var count int
-	var err error
-	count, err = p.getOverlappingBookings(a.DB)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+	caller, _ := accountFromContext(r.Context())
+	if len(p.UserID) == 0 {
+		p.UserID = caller.UserID
 	}
 
-	if count > 0 {
-		respondWithError(w, http.StatusInternalServerError, "Overlap Bookings")
+	if !caller.canManageBooking(p.UserID) {
+		respondWithError(w, http.StatusForbidden, "Cannot create bookings for other users")
 		return
 	}
 
-	err = p.createBooking(a.DB)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := p.saveBooking(a.DB); err != nil {
+		respondWithBookingError(w, err)
 		return
 	}
 
+	p.Invite = bookingInvite(&p, time.Now())
 	respondWithJSON(w, http.StatusCreated, p)
 }
 
@@ -165,11 +252,69 @@ func (a *App) updateBooking(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	p.ID = id
 
-	if err := p.updateBooking(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	scope, ok := seriesScope(r)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid scope")
+		return
+	}
+
+	existing := booking{ID: id}
+	if err := existing.getBooking(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Booking not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	caller, _ := accountFromContext(r.Context())
+	if len(p.UserID) == 0 {
+		p.UserID = existing.UserID
+	}
+
+	if !caller.canManageBooking(existing.UserID) || !caller.canManageBooking(p.UserID) {
+		respondWithError(w, http.StatusForbidden, "Cannot update bookings of other users")
+		return
+	}
+
+	if !existing.isOpen() {
+		respondWithBookingError(w, &ruleViolation{"invalid_status", fmt.Sprintf("Cannot change a %v booking", existing.Status)})
+		return
+	}
+
+	if scope != seriesScopeThis && existing.SeriesID != 0 {
+		bookings, conflicts, err := updateSeriesBookings(a.DB, existing, p, scope)
+		if err == errSeriesConflict {
+			respondWithJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error(), "conflicts": conflicts})
+			return
+		}
+		if err != nil {
+			respondWithBookingError(w, err)
+			return
+		}
+
+		a.promoteWaitlist(existing.FacilityID)
+
+		for i := range bookings {
+			bookings[i].Invite = bookingInvite(&bookings[i], time.Now())
+		}
+		respondWithJSON(w, http.StatusOK, bookings)
 		return
 	}
 
+	p.SeriesID = existing.SeriesID
+	p.Status = existing.Status
+	if err := p.saveBooking(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	// moving or shortening the booking may free part of its old slot
+	a.promoteWaitlist(existing.FacilityID)
+
+	p.Invite = bookingInvite(&p, time.Now())
 	respondWithJSON(w, http.StatusOK, p)
 }
 
@@ -182,125 +327,197 @@ func (a *App) deleteBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p := booking{ID: id}
-	if err := p.deleteBooking(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	scope, ok := seriesScope(r)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid scope")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
-}
-
-func (a *App) getBookingConfigs(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-	count, _ := strconv.Atoi(r.FormValue("count"))
-	start, _ := strconv.Atoi(r.FormValue("start"))
+	p := booking{ID: id}
+	if err := p.getBooking(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Booking not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
 
-	if count < 1 {
-		count = 10
+	caller, _ := accountFromContext(r.Context())
+	if !caller.canManageBooking(p.UserID) {
+		respondWithError(w, http.StatusForbidden, "Cannot delete bookings of other users")
+		return
 	}
-	if start < 0 {
-		start = 0
+
+	// bookings are cancelled rather than deleted so that they stay available for reporting
+	reason := r.FormValue("reason")
+	var cancelled []booking
+	if scope != seriesScopeThis && p.SeriesID != 0 {
+		cancelled, err = cancelSeriesBookings(a.DB, &p, scope, reason, caller.UserID)
+	} else {
+		err = p.cancelBooking(a.DB, reason, caller.UserID)
 	}
 
-	bookingConfigs, err := getBookingConfigs(a.DB, start, count)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithBookingError(w, err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, bookingConfigs)
+	a.promoteWaitlist(p.FacilityID)
+
+	// a cancellation carries the invite that removes its events from the owner's calendar
+	result := map[string]string{"result": "success"}
+	if len(cancelled) > 0 {
+		if invite, err := icsCalendar(icsMethodCancel, cancelled, time.Now()); err == nil {
+			result["ics"] = invite
+		}
+	} else if !p.isActive() {
+		result["ics"] = bookingInvite(&p, time.Now())
+	}
+
+	respondWithJSON(w, http.StatusOK, result)
 }
 
-func (a *App) getBookingConfig(w http.ResponseWriter, r *http.Request) {
+// updateBookingStatus moves a booking through its lifecycle, owners may only cancel
+func (a *App) updateBookingStatus(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid booking config ID")
+		respondWithError(w, http.StatusBadRequest, "Invalid booking ID")
 		return
 	}
 
-	p := bookingConfig{ID: id}
-	if err := p.getBookingConfig(a.DB); err != nil {
+	var c statusChange
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&c); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	p := booking{ID: id}
+	if err := p.getBooking(a.DB); err != nil {
 		switch err {
 		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Booking Config not found")
+			respondWithError(w, http.StatusNotFound, "Booking not found")
 		default:
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 		}
 		return
 	}
 
+	caller, _ := accountFromContext(r.Context())
+	if !caller.canManageBooking(p.UserID) || (!caller.Admin && c.Status != bookingStatusCancelled) {
+		respondWithError(w, http.StatusForbidden, "Cannot change the status of this booking")
+		return
+	}
+
+	if err := p.setStatus(a.DB, c.Status, c.Reason, caller.UserID); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	if !p.isActive() {
+		a.promoteWaitlist(p.FacilityID)
+	}
+
+	p.Invite = bookingInvite(&p, time.Now())
+
 	respondWithJSON(w, http.StatusOK, p)
 }
 
-func (a *App) updateBookingConfig(w http.ResponseWriter, r *http.Request) {
+// decideBooking approves or rejects a pending booking and notifies the requester
+func (a *App) decideBooking(w http.ResponseWriter, r *http.Request, approve bool) {
 	enableCors(&w)
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid booking config ID")
+		respondWithError(w, http.StatusBadRequest, "Invalid booking ID")
 		return
 	}
 
-	var p bookingConfig
+	var d decision
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
+	if err := decoder.Decode(&d); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 	defer r.Body.Close()
-	p.ID = id
 
-	if err := p.updateBookingConfig(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	p := booking{ID: id}
+	if err := p.getBooking(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Booking not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
+	caller, _ := accountFromContext(r.Context())
+	if err := p.decide(a.DB, approve, d.Comment, caller.UserID); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	a.sendMail(approvalNotice(&p))
+	if !approve {
+		a.promoteWaitlist(p.FacilityID)
+	}
+
 	respondWithJSON(w, http.StatusOK, p)
 }
 
-func (a *App) getBookingConfigsCount(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-
-	count, err := getBookingConfigsCount(a.DB)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
+func (a *App) approveBooking(w http.ResponseWriter, r *http.Request) {
+	a.decideBooking(w, r, true)
+}
 
-	respondWithJSON(w, http.StatusOK, count)
+func (a *App) rejectBooking(w http.ResponseWriter, r *http.Request) {
+	a.decideBooking(w, r, false)
 }
 
-func (a *App) getFacilityDetail(w http.ResponseWriter, r *http.Request) {
+func (a *App) checkInBooking(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 	vars := mux.Vars(r)
 	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid facility detail ID")
+		respondWithError(w, http.StatusBadRequest, "Invalid booking ID")
 		return
 	}
 
-	p := facilityDetail{ID: id}
-	if err := p.getFacilityDetail(a.DB); err != nil {
+	p := booking{ID: id}
+	if err := p.getBooking(a.DB); err != nil {
 		switch err {
 		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Facility detail not found")
+			respondWithError(w, http.StatusNotFound, "Booking not found")
 		default:
 			respondWithError(w, http.StatusInternalServerError, err.Error())
 		}
 		return
 	}
 
+	caller, _ := accountFromContext(r.Context())
+	if !caller.canManageBooking(p.UserID) {
+		respondWithError(w, http.StatusForbidden, "Cannot check in to bookings of other users")
+		return
+	}
+
+	if err := p.checkIn(a.DB, time.Now()); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, p)
 }
 
-func (a *App) getFacilityDetails(w http.ResponseWriter, r *http.Request) {
+// getNoShowCounts lists the no-shows per user, since limits it to bookings starting from that time
+func (a *App) getNoShowCounts(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 	count, _ := strconv.Atoi(r.FormValue("count"))
 	start, _ := strconv.Atoi(r.FormValue("start"))
-	status := r.FormValue("status")
 
 	if count < 1 {
 		count = 10
@@ -309,119 +526,1751 @@ func (a *App) getFacilityDetails(w http.ResponseWriter, r *http.Request) {
 		start = 0
 	}
 
-	facilityDetails, err := getFacilityDetails(a.DB, start, count, status)
+	var since time.Time
+	if value := r.FormValue("since"); len(value) > 0 {
+		var err error
+		if since, err = parseBookingTime(value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid since")
+			return
+		}
+	}
+
+	counts, err := getNoShowCounts(a.DB, start, count, since)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, facilityDetails)
+	respondWithJSON(w, http.StatusOK, counts)
 }
 
-func (a *App) createFacilityDetail(w http.ResponseWriter, r *http.Request) {
+func (a *App) getBookingSeries(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
-	var p facilityDetail
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid booking series ID")
 		return
 	}
-	defer r.Body.Close()
 
-	if err := p.createFacilityDetail(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	p := bookingSeries{ID: id}
+	if err := p.getBookingSeries(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Booking series not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, p)
-}
-
-func (a *App) updateFacilityDetail(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+	bookings, err := getSeriesBookings(a.DB, p.ID, "-infinity")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid facility detail ID")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	var p facilityDetail
+	respondWithJSON(w, http.StatusOK, bookingSeriesResult{Series: p, Bookings: bookings, Conflicts: []seriesConflict{}})
+}
+
+func (a *App) createBookingSeries(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p bookingSeries
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&p); err != nil {
 		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
 		return
 	}
 	defer r.Body.Close()
-	p.ID = id
+	p.ID = 0
 
-	if err := p.updateFacilityDetail(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+	caller, _ := accountFromContext(r.Context())
+	if len(p.UserID) == 0 {
+		p.UserID = caller.UserID
 	}
 
-	respondWithJSON(w, http.StatusOK, p)
-}
-
-func (a *App) deleteFacilityDetail(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid facility detail ID")
+	if !caller.canManageBooking(p.UserID) {
+		respondWithError(w, http.StatusForbidden, "Cannot create bookings for other users")
 		return
 	}
 
-	p := facilityDetail{ID: id}
-	if err := p.deleteFacilityDetail(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	result, err := p.createBookings(a.DB)
+	if err == errSeriesConflict {
+		respondWithJSON(w, http.StatusConflict, map[string]interface{}{"error": err.Error(), "conflicts": result.Conflicts})
 		return
 	}
-
-	b := booking{FacilityID: id}
-	if err := b.deleteAllBookingByFacilityID(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err != nil {
+		respondWithBookingError(w, err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	for i := range result.Bookings {
+		result.Bookings[i].Invite = bookingInvite(&result.Bookings[i], time.Now())
+	}
+	respondWithJSON(w, http.StatusCreated, result)
 }
 
-func (a *App) getFacilityDetailsCount(w http.ResponseWriter, r *http.Request) {
+// getAvailability lists free slots per facility between from and to, duration is in minutes
+func (a *App) getAvailability(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
-	status := r.FormValue("status")
 
-	count, err := getFacilityDetailsCount(a.DB, status)
+	from, err := parseBookingTime(r.FormValue("from"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusBadRequest, "Invalid from")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, count)
-}
+	to, err := parseBookingTime(r.FormValue("to"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid to")
+		return
+	}
 
-func (a *App) authenticate(w http.ResponseWriter, r *http.Request) {
-	enableCors(&w)
-	var p login
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if !to.After(from) || to.Sub(from) > maxAvailabilityWindow {
+		respondWithError(w, http.StatusBadRequest,
+			fmt.Sprintf("to must be after from and at most %v days later", maxAvailabilityWindow.Hours()/24))
 		return
 	}
-	defer r.Body.Close()
 
-	account, err := p.authenticate(a.DB)
+	duration := 60
+	if len(r.FormValue("duration")) > 0 {
+		if duration, err = strconv.Atoi(r.FormValue("duration")); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid duration")
+			return
+		}
+	}
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			respondWithError(w, http.StatusOK, "Login failed")
+	capacity := 0
+	if len(r.FormValue("capacity")) > 0 {
+		if capacity, err = strconv.Atoi(r.FormValue("capacity")); err != nil || capacity < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid capacity")
 			return
 		}
+	}
 
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+	s := availabilitySearch{
+		From:     from,
+		To:       to,
+		Duration: time.Duration(duration) * time.Minute,
+		Level:    r.FormValue("level"),
+		Capacity: capacity,
 	}
 
-	respondWithJSON(w, http.StatusOK, account)
+	results, err := getAvailability(a.DB, s, time.Now())
+	if err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, results)
+}
+
+// seriesScope reads the scope query parameter used when editing or cancelling a series occurrence
+func seriesScope(r *http.Request) (string, bool) {
+	switch scope := r.URL.Query().Get("scope"); scope {
+	case "":
+		return seriesScopeThis, true
+	case seriesScopeThis, seriesScopeFollowing, seriesScopeAll:
+		return scope, true
+	default:
+		return "", false
+	}
+}
+
+func (a *App) getBookingConfigs(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	bookingConfigs, err := getBookingConfigs(a.DB, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, bookingConfigs)
+}
+
+func (a *App) getBookingConfig(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid booking config ID")
+		return
+	}
+
+	p := bookingConfig{ID: id}
+	if err := p.getBookingConfig(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Booking Config not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) updateBookingConfig(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid booking config ID")
+		return
+	}
+
+	var p bookingConfig
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	p.ID = id
+
+	if err := p.updateBookingConfig(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) getBookingConfigsCount(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	count, err := getBookingConfigsCount(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, count)
+}
+
+func (a *App) getFacilityDetail(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid facility detail ID")
+		return
+	}
+
+	p := facilityDetail{ID: id}
+	if err := p.getFacilityDetail(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Facility detail not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) getFacilityDetails(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	status := r.FormValue("status")
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	facilityDetails, err := getFacilityDetails(a.DB, start, count, status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, facilityDetails)
+}
+
+func (a *App) createFacilityDetail(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p facilityDetail
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := p.createFacilityDetail(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (a *App) updateFacilityDetail(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid facility detail ID")
+		return
+	}
+
+	var p facilityDetail
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	p.ID = id
+
+	if err := p.updateFacilityDetail(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Facility detail not found")
+		default:
+			respondWithBookingError(w, err)
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) deleteFacilityDetail(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid facility detail ID")
+		return
+	}
+
+	// facilities are archived rather than deleted so that their past bookings are kept
+	caller, _ := accountFromContext(r.Context())
+	p := facilityDetail{ID: id}
+	cancelled, err := p.archiveFacilityDetail(a.DB, caller.UserID)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Facility detail not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	for i := range cancelled {
+		a.sendMail(archiveNotice(&p, &cancelled[i]))
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"result": "success", "facility_detail": p, "cancelled": cancelled})
+}
+
+func (a *App) getFacilityDetailsCount(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	status := r.FormValue("status")
+
+	count, err := getFacilityDetailsCount(a.DB, status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, count)
+}
+
+func (a *App) getOpeningHours(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid facility detail ID")
+		return
+	}
+
+	hours, err := getOpeningHours(a.DB, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, hours)
+}
+
+func (a *App) updateOpeningHours(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid facility detail ID")
+		return
+	}
+
+	var hours openingHours
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&hours); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	p := facilityDetail{ID: id}
+	if err := p.getFacilityDetail(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Facility detail not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := setOpeningHours(a.DB, id, hours); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	if hours, err = getOpeningHours(a.DB, id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, hours)
+}
+
+func (a *App) getBlackouts(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	facilityID, _ := strconv.Atoi(r.FormValue("facility_id"))
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	blackouts, err := getBlackouts(a.DB, start, count, facilityID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, blackouts)
+}
+
+func (a *App) getBlackout(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid blackout ID")
+		return
+	}
+
+	p := blackout{ID: id}
+	if err := p.getBlackout(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Blackout not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) createBlackout(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p blackout
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := p.createBlackout(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (a *App) updateBlackout(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid blackout ID")
+		return
+	}
+
+	var p blackout
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	p.ID = id
+
+	if err := p.updateBlackout(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) deleteBlackout(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid blackout ID")
+		return
+	}
+
+	p := blackout{ID: id}
+	if err := p.deleteBlackout(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getBookingQuotas(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	quotas, err := getBookingQuotas(a.DB, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, quotas)
+}
+
+func (a *App) getBookingQuota(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid booking quota ID")
+		return
+	}
+
+	p := bookingQuota{ID: id}
+	if err := p.getBookingQuota(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Booking quota not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) createBookingQuota(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p bookingQuota
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := p.createBookingQuota(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (a *App) updateBookingQuota(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid booking quota ID")
+		return
+	}
+
+	var p bookingQuota
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	p.ID = id
+
+	if err := p.updateBookingQuota(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) deleteBookingQuota(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid booking quota ID")
+		return
+	}
+
+	p := bookingQuota{ID: id}
+	if err := p.deleteBookingQuota(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	webhooks, err := getWebhooks(a.DB, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, webhooks)
+}
+
+func (a *App) getWebhook(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	p := webhook{ID: id}
+	if err := p.getWebhook(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Webhook not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+// createWebhook registers a subscription, the response is the only place its secret is shown
+func (a *App) createWebhook(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	p := webhook{Active: true}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := p.createWebhook(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (a *App) updateWebhook(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	p := webhook{Active: true}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	p.ID = id
+
+	if err := p.updateWebhook(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Webhook not found")
+		default:
+			respondWithBookingError(w, err)
+		}
+		return
+	}
+
+	p.Secret = ""
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	p := webhook{ID: id}
+	if err := p.deleteWebhook(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// getWebhookDeliveries is the delivery log of a webhook, newest first
+func (a *App) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	status := r.FormValue("status")
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	deliveries, err := getWebhookDeliveries(a.DB, id, start, count, status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// createFeedToken issues the caller a new calendar feed token, the previous one stops working
+func (a *App) createFeedToken(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	caller, _ := accountFromContext(r.Context())
+
+	token, err := createFeedToken(a.DB, caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, token)
+}
+
+// feedAccount returns the owner of the feed token in the request, it responds and returns false
+// when the token is missing or unknown
+func (a *App) feedAccount(w http.ResponseWriter, r *http.Request) (account, bool) {
+	acc, err := getFeedAccount(a.DB, r.FormValue("token"))
+	switch err {
+	case nil:
+		return acc, true
+	case sql.ErrNoRows:
+		respondWithError(w, http.StatusUnauthorized, "Invalid feed token")
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+
+	return acc, false
+}
+
+// getUserCalendar is the calendar feed of the bookings a user owns or was invited to,
+// only admins may read the feed of another user
+func (a *App) getUserCalendar(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	acc, ok := a.feedAccount(w, r)
+	if !ok {
+		return
+	}
+
+	userid := r.FormValue("user_id")
+	if len(userid) == 0 {
+		userid = acc.UserID
+	}
+
+	if !acc.canManageBooking(userid) {
+		respondWithError(w, http.StatusForbidden, "Cannot read the calendar of other users")
+		return
+	}
+
+	now := time.Now()
+	bookings, err := getCalendarBookings(a.DB, userid, 0, now.Add(-calendarFeedHistory))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	calendar, err := icsCalendar(icsMethodPublish, bookings, now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithCalendar(w, calendar)
+}
+
+func (a *App) getFacilityCalendar(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid facility ID")
+		return
+	}
+
+	acc, ok := a.feedAccount(w, r)
+	if !ok {
+		return
+	}
+
+	f := facilityDetail{ID: id}
+	if err := f.getFacilityDetail(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Facility not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	now := time.Now()
+	bookings, err := getCalendarBookings(a.DB, "", id, now.Add(-calendarFeedHistory))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the emails and names of other users' bookings stay out of the feed, as in the booking listings
+	for i := range bookings {
+		if !acc.canManageBooking(bookings[i].UserID) {
+			bookings[i].hideAttendees()
+			bookings[i].Email = ""
+		}
+	}
+
+	calendar, err := icsCalendar(icsMethodPublish, bookings, now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithCalendar(w, calendar)
+}
+
+// importFacilityCalendar books the events of an uploaded iCalendar file on the facility, with
+// dry_run=true it only reports which events would be booked
+func (a *App) importFacilityCalendar(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid facility ID")
+		return
+	}
+
+	// read from the query string only, FormValue would consume a form-encoded upload
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); len(v) > 0 {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid dry_run")
+			return
+		}
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	f := facilityDetail{ID: id}
+	if err := f.getFacilityDetail(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Facility not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	caller, _ := accountFromContext(r.Context())
+	report, err := importICS(a.DB, string(data), id, caller, dryRun)
+	if err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if dryRun {
+		status = http.StatusOK
+	}
+
+	respondWithJSON(w, status, report)
+}
+
+// getMyQuota shows the caller's quota and what they currently use of it
+func (a *App) getMyQuota(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	caller, _ := accountFromContext(r.Context())
+
+	usage, err := getQuotaUsage(a.DB, caller.UserID, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, usage)
+}
+
+func (a *App) getMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+	facilityID, _ := strconv.Atoi(r.FormValue("facility_id"))
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	windows, err := getMaintenanceWindows(a.DB, start, count, facilityID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, windows)
+}
+
+func (a *App) getMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid maintenance window ID")
+		return
+	}
+
+	p := maintenanceWindow{ID: id}
+	if err := p.getMaintenanceWindow(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Maintenance window not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+// scheduleMaintenance creates or updates the window in p and notifies the owners of conflicting bookings
+func (a *App) scheduleMaintenance(w http.ResponseWriter, p maintenanceRequest, code int) {
+	f := facilityDetail{ID: p.FacilityID}
+	if err := f.getFacilityDetail(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Facility detail not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	conflicts, err := p.saveMaintenanceWindow(a.DB, p.CancelConflicts)
+	if err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	for i := range conflicts {
+		a.sendMail(maintenanceNotice(&p.maintenanceWindow, &conflicts[i], p.CancelConflicts))
+	}
+
+	respondWithJSON(w, code, maintenanceResult{Window: p.maintenanceWindow, Conflicts: conflicts, Cancelled: p.CancelConflicts})
+}
+
+func (a *App) createMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p maintenanceRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	p.ID = 0
+
+	caller, _ := accountFromContext(r.Context())
+	p.CreatedBy = caller.UserID
+
+	a.scheduleMaintenance(w, p, http.StatusCreated)
+}
+
+func (a *App) updateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid maintenance window ID")
+		return
+	}
+
+	var p maintenanceRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	existing := maintenanceWindow{ID: id}
+	if err := existing.getMaintenanceWindow(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Maintenance window not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	p.ID = id
+	p.CreatedBy = existing.CreatedBy
+
+	a.scheduleMaintenance(w, p, http.StatusOK)
+}
+
+func (a *App) deleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid maintenance window ID")
+		return
+	}
+
+	p := maintenanceWindow{ID: id}
+	if err := p.deleteMaintenanceWindow(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getWaitlist(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	// admins may list everyone's entries, other callers only see their own
+	caller, _ := accountFromContext(r.Context())
+	userid := caller.UserID
+	if caller.Admin {
+		userid = r.FormValue("user_id")
+	}
+
+	entries, err := getWaitlist(a.DB, start, count, userid)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+func (a *App) joinWaitlist(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p waitlistEntry
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	caller, _ := accountFromContext(r.Context())
+	if len(p.UserID) == 0 {
+		p.UserID = caller.UserID
+	}
+
+	if !caller.canManageBooking(p.UserID) {
+		respondWithError(w, http.StatusForbidden, "Cannot join the waitlist for other users")
+		return
+	}
+
+	if err := p.joinWaitlist(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+// getOwnWaitlistEntry loads the waitlist entry in the URL for a caller allowed to manage it,
+// it responds and returns false otherwise
+func (a *App) getOwnWaitlistEntry(w http.ResponseWriter, r *http.Request) (waitlistEntry, bool) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid waitlist entry ID")
+		return waitlistEntry{}, false
+	}
+
+	p := waitlistEntry{ID: id}
+	if err := p.getWaitlistEntry(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Waitlist entry not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return p, false
+	}
+
+	caller, _ := accountFromContext(r.Context())
+	if !caller.canManageBooking(p.UserID) {
+		respondWithError(w, http.StatusForbidden, "Cannot manage waitlist entries of other users")
+		return p, false
+	}
+
+	return p, true
+}
+
+func (a *App) withdrawWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	p, ok := a.getOwnWaitlistEntry(w, r)
+	if !ok {
+		return
+	}
+
+	offered := p.Status == waitlistOffered
+	if err := p.withdraw(a.DB); err != nil {
+		respondWithBookingError(w, err)
+		return
+	}
+
+	// a withdrawn offer passes the slot on to the next in line
+	if offered {
+		a.promoteWaitlist(p.FacilityID)
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+// claimWaitlistEntry books the slot that was offered to a waitlist entry
+func (a *App) claimWaitlistEntry(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	p, ok := a.getOwnWaitlistEntry(w, r)
+	if !ok {
+		return
+	}
+
+	b, err := p.claim(a.DB, time.Now())
+	if err != nil {
+		respondWithBookingError(w, bookingError(err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, b)
+}
+
+func (a *App) authenticate(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p login
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	now := time.Now()
+	ip := clientIP(r)
+	keys := loginLockoutKeys(p.UserID, ip)
+
+	lockedUntil, err := getLockedUntil(a.DB, keys, now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !lockedUntil.IsZero() {
+		if err := recordAuthAudit(a.DB, p.UserID, ip, false, "locked"); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedUntil.Sub(now).Seconds()))))
+		respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts")
+		return
+	}
+
+	account, err := p.authenticate(a.DB)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			if err := recordLoginFailure(a.DB, keys, now); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			if err := recordAuthAudit(a.DB, p.UserID, ip, false, "invalid_credentials"); err != nil {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			respondWithError(w, http.StatusUnauthorized, "Login failed")
+			return
+		}
+
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := clearLoginFailures(a.DB, userLockoutKey(p.UserID)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := recordAuthAudit(a.DB, p.UserID, ip, true, ""); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	session, err := createSession(a.DB, account)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, session)
+}
+
+func (a *App) refreshSession(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p refreshRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	session, err := refreshSession(a.DB, p.RefreshToken)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusUnauthorized, "Invalid or expired refresh token")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, session)
+}
+
+func (a *App) logout(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if err := revokeSession(a.DB, bearerToken(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getAccounts(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	if count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	accounts, err := getAccounts(a.DB, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, accounts)
+}
+
+func (a *App) getAccountsCount(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	count, err := getAccountsCount(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, count)
+}
+
+func (a *App) getAccount(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+
+	p := account{ID: id}
+	if err := p.getAccount(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Account not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) createAccount(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var u accountUpdate
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&u); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(u.UserID) == 0 || len(u.Password) == 0 {
+		respondWithError(w, http.StatusBadRequest, "user_id and password are required")
+		return
+	}
+
+	p := account{UserID: u.UserID, Email: u.Email, Active: true}
+	if u.Admin != nil {
+		p.Admin = *u.Admin
+	}
+	if u.Active != nil {
+		p.Active = *u.Active
+	}
+
+	if err := p.createAccount(a.DB, u.Password); err != nil {
+		if e, ok := err.(*pq.Error); ok && e.Code == "23505" {
+			respondWithError(w, http.StatusConflict, "Account already exists")
+			return
+		}
+
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, p)
+}
+
+func (a *App) updateAccount(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+
+	var u accountUpdate
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&u); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	p := account{ID: id}
+	if err := p.getAccount(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Account not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if len(u.Email) > 0 {
+		p.Email = u.Email
+	}
+	if u.Admin != nil {
+		p.Admin = *u.Admin
+	}
+	if u.Active != nil {
+		p.Active = *u.Active
+	}
+
+	caller, _ := accountFromContext(r.Context())
+	if caller.ID == p.ID && (!p.Admin || !p.Active) {
+		respondWithError(w, http.StatusBadRequest, "Cannot remove admin access from your own account")
+		return
+	}
+
+	if err := p.updateAccount(a.DB, u.Password, ""); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) deactivateAccount(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+
+	if caller, _ := accountFromContext(r.Context()); caller.ID == id {
+		respondWithError(w, http.StatusBadRequest, "Cannot deactivate your own account")
+		return
+	}
+
+	p := account{ID: id}
+	if err := p.getAccount(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Account not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	p.Active = false
+	if err := p.updateAccount(a.DB, "", ""); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) unlockAccount(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid account ID")
+		return
+	}
+
+	p := account{ID: id}
+	if err := p.getAccount(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Account not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := clearLoginFailures(a.DB, userLockoutKey(p.UserID)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getMe(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	caller, _ := accountFromContext(r.Context())
+
+	respondWithJSON(w, http.StatusOK, caller)
+}
+
+func (a *App) updateMe(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var u accountUpdate
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&u); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	p, _ := accountFromContext(r.Context())
+	if len(u.Password) > 0 {
+		ok, err := p.checkPassword(a.DB, u.CurrentPassword)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if !ok {
+			respondWithError(w, http.StatusForbidden, "Current password is incorrect")
+			return
+		}
+	}
+
+	if len(u.Email) > 0 {
+		p.Email = u.Email
+	}
+
+	if err := p.updateAccount(a.DB, u.Password, bearerToken(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, p)
+}
+
+func (a *App) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p passwordResetRequest
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	accounts, err := getAccountsForReset(a.DB, p.UserID, p.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for _, account := range accounts {
+		token, err := account.createAccountToken(a.DB, passwordResetPurpose, passwordResetTTL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		a.sendMail(mail{
+			To:      account.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("A password reset was requested for %v.\n\nYour password reset token is: %v\n\nIt expires in %v. If you did not request it, you can ignore this mail.\n",
+				account.UserID, token, passwordResetTTL),
+		})
+	}
+
+	// the response is the same whether or not an account matched
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) resetPassword(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p tokenRedemption
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(p.Password) == 0 {
+		respondWithError(w, http.StatusBadRequest, "password is required")
+		return
+	}
+
+	if err := resetPassword(a.DB, p.Token, p.Password); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) requestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	caller, _ := accountFromContext(r.Context())
+	if len(caller.Email) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Account has no email")
+		return
+	}
+
+	token, err := caller.createAccountToken(a.DB, emailVerificationPurpose, emailVerificationTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	a.sendMail(mail{
+		To:      caller.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Please confirm that %v is the email for %v.\n\nYour email verification token is: %v\n\nIt expires in %v.\n",
+			caller.Email, caller.UserID, token, emailVerificationTTL),
+	})
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	var p tokenRedemption
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&p); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := verifyEmail(a.DB, p.Token); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusBadRequest, "Invalid or expired token")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// authenticateRequest resolves the caller's account from the Authorization header into the
+// request context, requests without the header pass through anonymously
+func (a *App) authenticateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if len(token) == 0 || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		account, err := getSessionAccount(a.DB, token)
+		if err != nil {
+			enableCors(&w)
+			switch err {
+			case sql.ErrNoRows:
+				respondWithError(w, http.StatusUnauthorized, "Invalid or expired token")
+			default:
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), accountContextKey, account)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAccount only serves next to logged in callers
+func (a *App) requireAccount(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := accountFromContext(r.Context()); !ok {
+			enableCors(&w)
+			respondWithError(w, http.StatusUnauthorized, "Not logged in")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireAdmin only serves next to logged in admins
+func (a *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return a.requireAccount(func(w http.ResponseWriter, r *http.Request) {
+		if caller, _ := accountFromContext(r.Context()); !caller.Admin {
+			enableCors(&w)
+			respondWithError(w, http.StatusForbidden, "Admin access required")
+			return
+		}
+
+		next(w, r)
+	})
 }
 
 func enableCors(w *http.ResponseWriter) {
@@ -436,28 +2285,123 @@ func (a *App) optionsEnableCors(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *App) initializeRoutes() {
+	a.Router.HandleFunc("/bookings", a.requireAccount(a.getBookings)).Methods("GET").Queries("attendee", "{attendee}")
 	a.Router.HandleFunc("/bookings", a.getBookings).Methods("GET")
-	a.Router.HandleFunc("/booking", a.createBooking).Methods("POST")
+	a.Router.HandleFunc("/bookings.ics", a.getUserCalendar).Methods("GET")
+	a.Router.HandleFunc("/booking", a.requireAccount(a.createBooking)).Methods("POST")
 	a.Router.HandleFunc("/booking/{id:[0-9]+}", a.getBooking).Methods("GET")
-	a.Router.HandleFunc("/booking/{id:[0-9]+}", a.updateBooking).Methods("PUT")
-	a.Router.HandleFunc("/booking/{id:[0-9]+}", a.deleteBooking).Methods("DELETE")
+	a.Router.HandleFunc("/booking/{id:[0-9]+}", a.requireAccount(a.updateBooking)).Methods("PUT")
+	a.Router.HandleFunc("/booking/{id:[0-9]+}", a.requireAccount(a.deleteBooking)).Methods("DELETE")
+	a.Router.HandleFunc("/booking/{id:[0-9]+}/status", a.requireAccount(a.updateBookingStatus)).Methods("PUT")
+	a.Router.HandleFunc("/booking/{id:[0-9]+}/approve", a.requireAdmin(a.approveBooking)).Methods("POST")
+	a.Router.HandleFunc("/booking/{id:[0-9]+}/reject", a.requireAdmin(a.rejectBooking)).Methods("POST")
+	a.Router.HandleFunc("/booking/{id:[0-9]+}/checkIn", a.requireAccount(a.checkInBooking)).Methods("POST")
+	a.Router.HandleFunc("/noShowCounts", a.requireAdmin(a.getNoShowCounts)).Methods("GET")
+	a.Router.HandleFunc("/bookingSeries", a.requireAccount(a.createBookingSeries)).Methods("POST")
+	a.Router.HandleFunc("/bookingSeries/{id:[0-9]+}", a.getBookingSeries).Methods("GET")
+	a.Router.HandleFunc("/availability", a.getAvailability).Methods("GET")
 	a.Router.HandleFunc("/bookingConfigs", a.getBookingConfigs).Methods("GET")
 	a.Router.HandleFunc("/bookingConfig/{id:[0-9]+}", a.getBookingConfig).Methods("GET")
-	a.Router.HandleFunc("/bookingConfig/{id:[0-9]+}", a.updateBookingConfig).Methods("PUT")
+	a.Router.HandleFunc("/bookingConfig/{id:[0-9]+}", a.requireAdmin(a.updateBookingConfig)).Methods("PUT")
 	a.Router.HandleFunc("/facilityDetails", a.getFacilityDetails).Methods("GET")
-	a.Router.HandleFunc("/facilityDetail", a.createFacilityDetail).Methods("POST")
+	a.Router.HandleFunc("/facilityDetail", a.requireAdmin(a.createFacilityDetail)).Methods("POST")
 	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}", a.getFacilityDetail).Methods("GET")
-	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}", a.updateFacilityDetail).Methods("PUT")
-	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}", a.deleteFacilityDetail).Methods("DELETE")
+	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}", a.requireAdmin(a.updateFacilityDetail)).Methods("PUT")
+	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}", a.requireAdmin(a.deleteFacilityDetail)).Methods("DELETE")
+	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}/calendar.ics", a.getFacilityCalendar).Methods("GET")
+	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}/import", a.requireAdmin(a.importFacilityCalendar)).Methods("POST")
+	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}/openingHours", a.getOpeningHours).Methods("GET")
+	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}/openingHours", a.requireAdmin(a.updateOpeningHours)).Methods("PUT")
+	a.Router.HandleFunc("/blackouts", a.getBlackouts).Methods("GET")
+	a.Router.HandleFunc("/blackout", a.requireAdmin(a.createBlackout)).Methods("POST")
+	a.Router.HandleFunc("/blackout/{id:[0-9]+}", a.getBlackout).Methods("GET")
+	a.Router.HandleFunc("/blackout/{id:[0-9]+}", a.requireAdmin(a.updateBlackout)).Methods("PUT")
+	a.Router.HandleFunc("/blackout/{id:[0-9]+}", a.requireAdmin(a.deleteBlackout)).Methods("DELETE")
+	a.Router.HandleFunc("/bookingQuotas", a.requireAdmin(a.getBookingQuotas)).Methods("GET")
+	a.Router.HandleFunc("/bookingQuota", a.requireAdmin(a.createBookingQuota)).Methods("POST")
+	a.Router.HandleFunc("/bookingQuota/{id:[0-9]+}", a.requireAdmin(a.getBookingQuota)).Methods("GET")
+	a.Router.HandleFunc("/bookingQuota/{id:[0-9]+}", a.requireAdmin(a.updateBookingQuota)).Methods("PUT")
+	a.Router.HandleFunc("/bookingQuota/{id:[0-9]+}", a.requireAdmin(a.deleteBookingQuota)).Methods("DELETE")
+	a.Router.HandleFunc("/webhooks", a.requireAdmin(a.getWebhooks)).Methods("GET")
+	a.Router.HandleFunc("/webhook", a.requireAdmin(a.createWebhook)).Methods("POST")
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}", a.requireAdmin(a.getWebhook)).Methods("GET")
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}", a.requireAdmin(a.updateWebhook)).Methods("PUT")
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}", a.requireAdmin(a.deleteWebhook)).Methods("DELETE")
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}/deliveries", a.requireAdmin(a.getWebhookDeliveries)).Methods("GET")
+	a.Router.HandleFunc("/maintenanceWindows", a.getMaintenanceWindows).Methods("GET")
+	a.Router.HandleFunc("/maintenanceWindow", a.requireAdmin(a.createMaintenanceWindow)).Methods("POST")
+	a.Router.HandleFunc("/maintenanceWindow/{id:[0-9]+}", a.getMaintenanceWindow).Methods("GET")
+	a.Router.HandleFunc("/maintenanceWindow/{id:[0-9]+}", a.requireAdmin(a.updateMaintenanceWindow)).Methods("PUT")
+	a.Router.HandleFunc("/maintenanceWindow/{id:[0-9]+}", a.requireAdmin(a.deleteMaintenanceWindow)).Methods("DELETE")
+	a.Router.HandleFunc("/waitlist", a.requireAccount(a.getWaitlist)).Methods("GET")
+	a.Router.HandleFunc("/waitlist", a.requireAccount(a.joinWaitlist)).Methods("POST")
+	a.Router.HandleFunc("/waitlist/{id:[0-9]+}", a.requireAccount(a.withdrawWaitlistEntry)).Methods("DELETE")
+	a.Router.HandleFunc("/waitlist/{id:[0-9]+}/claim", a.requireAccount(a.claimWaitlistEntry)).Methods("POST")
 	a.Router.HandleFunc("/booking", a.optionsEnableCors).Methods(http.MethodOptions)
 	a.Router.HandleFunc("/booking/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/booking/{id:[0-9]+}/status", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/booking/{id:[0-9]+}/approve", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/booking/{id:[0-9]+}/reject", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/booking/{id:[0-9]+}/checkIn", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/noShowCounts", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/bookingSeries", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/bookingSeries/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
 	a.Router.HandleFunc("/bookingConfig/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
 	a.Router.HandleFunc("/facilityDetail", a.optionsEnableCors).Methods(http.MethodOptions)
 	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}/openingHours", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/facilityDetail/{id:[0-9]+}/import", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/blackout", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/blackout/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/bookingQuotas", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/bookingQuota", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/bookingQuota/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/webhooks", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/webhook", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/webhook/{id:[0-9]+}/deliveries", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/maintenanceWindow", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/maintenanceWindow/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/waitlist", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/waitlist/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/waitlist/{id:[0-9]+}/claim", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/bookingsCount", a.requireAccount(a.getBookingsCount)).Methods("GET").Queries("attendee", "{attendee}")
 	a.Router.HandleFunc("/bookingsCount", a.getBookingsCount).Methods("GET")
 	a.Router.HandleFunc("/bookingConfigsCount", a.getBookingConfigsCount).Methods("GET")
 	a.Router.HandleFunc("/facilityDetailsCount", a.getFacilityDetailsCount).Methods("GET")
 	a.Router.HandleFunc("/login", a.authenticate).Methods("POST")
 	a.Router.HandleFunc("/login", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/refresh", a.refreshSession).Methods("POST")
+	a.Router.HandleFunc("/refresh", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/logout", a.requireAccount(a.logout)).Methods("POST")
+	a.Router.HandleFunc("/logout", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/accounts", a.requireAdmin(a.getAccounts)).Methods("GET")
+	a.Router.HandleFunc("/accountsCount", a.requireAdmin(a.getAccountsCount)).Methods("GET")
+	a.Router.HandleFunc("/account", a.requireAdmin(a.createAccount)).Methods("POST")
+	a.Router.HandleFunc("/account/{id:[0-9]+}", a.requireAdmin(a.getAccount)).Methods("GET")
+	a.Router.HandleFunc("/account/{id:[0-9]+}", a.requireAdmin(a.updateAccount)).Methods("PUT")
+	a.Router.HandleFunc("/account/{id:[0-9]+}", a.requireAdmin(a.deactivateAccount)).Methods("DELETE")
+	a.Router.HandleFunc("/account/{id:[0-9]+}/unlock", a.requireAdmin(a.unlockAccount)).Methods("POST")
+	a.Router.HandleFunc("/account/{id:[0-9]+}/unlock", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/accounts", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/accountsCount", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/account", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/account/{id:[0-9]+}", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/me", a.requireAccount(a.getMe)).Methods("GET")
+	a.Router.HandleFunc("/me", a.requireAccount(a.updateMe)).Methods("PUT")
+	a.Router.HandleFunc("/me", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/me/quota", a.requireAccount(a.getMyQuota)).Methods("GET")
+	a.Router.HandleFunc("/me/feedToken", a.requireAccount(a.createFeedToken)).Methods("POST")
+	a.Router.HandleFunc("/me/feedToken", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/me/quota", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/passwordResetRequest", a.requestPasswordReset).Methods("POST")
+	a.Router.HandleFunc("/passwordResetRequest", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/passwordReset", a.resetPassword).Methods("POST")
+	a.Router.HandleFunc("/passwordReset", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/me/emailVerificationRequest", a.requireAccount(a.requestEmailVerification)).Methods("POST")
+	a.Router.HandleFunc("/me/emailVerificationRequest", a.optionsEnableCors).Methods(http.MethodOptions)
+	a.Router.HandleFunc("/emailVerification", a.verifyEmail).Methods("POST")
+	a.Router.HandleFunc("/emailVerification", a.optionsEnableCors).Methods(http.MethodOptions)
 	a.Router.Use(mux.CORSMethodMiddleware(a.Router))
+	a.Router.Use(a.authenticateRequest)
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// cancel reasons of the bookings that are rejected or expire while pending, their owners are
+// told by approvalNotice
+const (
+	approvalRejectedReason = "Approval rejected"
+	approvalExpiredReason  = "Approval request expired"
+)
+
+// decision is the payload for approving or rejecting a pending booking
+type decision struct {
+	Comment string `json:"comment"`
+}
+
+// decide approves or rejects the pending booking p on behalf of by
+func (p *booking) decide(db *sql.DB, approve bool, comment, by string) error {
+	if p.Status != bookingStatusPending {
+		return &ruleViolation{"invalid_status", fmt.Sprintf("Cannot decide on a %v booking", p.Status)}
+	}
+
+	return withTx(db, func(tx *sql.Tx) error {
+		status, reason := bookingStatusConfirmed, ""
+		if !approve {
+			status, reason = bookingStatusCancelled, approvalRejectedReason
+		}
+
+		// the decision is saved first so that the event setStatus records includes it
+		if _, err := tx.Exec("UPDATE booking.booking SET decided_by=$1, decision_comment=$2 WHERE id=$3", by, comment, p.ID); err != nil {
+			return err
+		}
+		p.DecidedBy, p.DecisionComment = by, comment
+
+		return p.setStatus(tx, status, reason, by)
+	})
+}
+
+// expirePendingBookings cancels and returns the pending bookings that have started or that have
+// waited longer than approval_timeout_hr since they last changed
+func expirePendingBookings(db *sql.DB, now time.Time) ([]booking, error) {
+	rules, err := getBookingRules(db)
+	if err != nil {
+		return nil, err
+	}
+
+	// the zero time matches nothing, so without a timeout only started bookings expire
+	var cutoff time.Time
+	if rules.ApprovalTimeout > 0 {
+		cutoff = now.Add(-rules.ApprovalTimeout)
+	}
+
+	return changeBookings(db,
+		"UPDATE booking.booking SET status=$1, cancel_reason=$2, cancelled_by='', transaction_dt=$3, sequence=sequence+1 WHERE status=$4 AND (start_dt <= $3 OR transaction_dt <= $5) RETURNING "+bookingColumns,
+		bookingStatusCancelled, approvalExpiredReason, now, bookingStatusPending, cutoff)
+}
+
+// approvalNotice tells the requester of b how their request was decided
+func approvalNotice(b *booking) mail {
+	m := mail{To: b.Email}
+
+	switch {
+	case b.Status == bookingStatusConfirmed:
+		m.Subject = "Your booking request has been approved"
+		m.Body = fmt.Sprintf("Your booking from %v to %v has been approved.\n", b.StartTime, b.EndTime)
+	case len(b.DecidedBy) > 0:
+		m.Subject = "Your booking request has been rejected"
+		m.Body = fmt.Sprintf("Your booking from %v to %v has been rejected.\n", b.StartTime, b.EndTime)
+	default:
+		m.Subject = "Your booking request has expired"
+		m.Body = fmt.Sprintf("Your booking from %v to %v was not approved in time and has been cancelled.\n", b.StartTime, b.EndTime)
+	}
+
+	if len(b.DecisionComment) > 0 {
+		m.Body += fmt.Sprintf("\nComment: %v\n", b.DecisionComment)
+	}
+
+	return m
+}
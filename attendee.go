@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	netmail "net/mail"
+
+	"github.com/lib/pq"
+)
+
+// attendee is someone invited to a booking, an internal account by user_id or an external guest by email
+type attendee struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	Name   string `json:"name"`
+}
+
+// hideAttendees clears the emails and names of p's attendees, for callers other than its owner and admins
+func (p *booking) hideAttendees() {
+	for i := range p.Attendees {
+		p.Attendees[i].Email, p.Attendees[i].Name = "", ""
+	}
+}
+
+// validEmail reports whether value is a bare email address, without a display name or anything
+// that could break out of the mail headers and calendar lines it is written to
+func validEmail(value string) bool {
+	addr, err := netmail.ParseAddress(value)
+	return err == nil && addr.Address == value
+}
+
+// checkAttendees rejects p if an attendee is neither an account nor has an email, an email is
+// invalid or the headcount is negative, a zero headcount is taken to be the owner and their attendees
+func (p *booking) checkAttendees(db dbtx) error {
+	if p.Headcount < 0 {
+		return &ruleViolation{"invalid_headcount", "headcount cannot be negative"}
+	}
+
+	if len(p.Email) > 0 && !validEmail(p.Email) {
+		return &ruleViolation{"invalid_email", fmt.Sprintf("Invalid email %q", p.Email)}
+	}
+
+	for _, a := range p.Attendees {
+		if len(a.Email) > 0 && !validEmail(a.Email) {
+			return &ruleViolation{"invalid_attendee", fmt.Sprintf("Invalid email %q", a.Email)}
+		}
+
+		if len(a.UserID) == 0 {
+			if len(a.Email) == 0 {
+				return &ruleViolation{"invalid_attendee", "An attendee needs a user_id or an email"}
+			}
+			continue
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM booking.account WHERE user_id=$1)", a.UserID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return &ruleViolation{"invalid_attendee", fmt.Sprintf("No account %q", a.UserID)}
+		}
+	}
+
+	if p.Headcount == 0 {
+		p.Headcount = 1 + len(p.Attendees)
+	}
+
+	return nil
+}
+
+// checkCapacity rejects p if more people are coming than facility f seats, a zero capacity is unlimited
+func (p *booking) checkCapacity(f *facilityDetail) error {
+	if f.Capacity > 0 && p.Headcount > f.Capacity {
+		return &ruleViolation{"capacity", fmt.Sprintf("Facility only seats %v people", f.Capacity)}
+	}
+
+	return nil
+}
+
+// setAttendees replaces the stored attendee list of p with p.Attendees
+func (p *booking) setAttendees(db dbtx) error {
+	if _, err := db.Exec("DELETE FROM booking.booking_attendee WHERE booking_id=$1", p.ID); err != nil {
+		return err
+	}
+
+	for _, a := range p.Attendees {
+		_, err := db.Exec("INSERT INTO booking.booking_attendee(booking_id, user_id, email, name) VALUES($1, $2, $3, $4)",
+			p.ID, a.UserID, a.Email, a.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadAttendees fills in the attendee lists of bookings with a single query
+func loadAttendees(db dbtx, bookings []booking) error {
+	if len(bookings) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(bookings))
+	byID := map[int]*booking{}
+	for i := range bookings {
+		ids[i] = int64(bookings[i].ID)
+		bookings[i].Attendees = []attendee{}
+		byID[bookings[i].ID] = &bookings[i]
+	}
+
+	rows, err := db.Query("SELECT booking_id, user_id, email, name FROM booking.booking_attendee WHERE booking_id = ANY($1) ORDER BY id",
+		pq.Array(ids))
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var a attendee
+		if err := rows.Scan(&id, &a.UserID, &a.Email, &a.Name); err != nil {
+			return err
+		}
+		byID[id].Attendees = append(byID[id].Attendees, a)
+	}
+
+	return rows.Err()
+}
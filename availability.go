@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxAvailabilityWindow bounds how far apart from and to may be in one availability search
+const maxAvailabilityWindow = 31 * 24 * time.Hour
+
+type interval struct {
+	Start time.Time
+	End   time.Time
+}
+
+type timeSlot struct {
+	StartTime string `json:"start_dt"`
+	EndTime   string `json:"end_dt"`
+}
+
+type facilityAvailability struct {
+	FacilityID int        `json:"facility_id"`
+	Name       string     `json:"name"`
+	Level      string     `json:"level"`
+	Slots      []timeSlot `json:"slots"`
+}
+
+// availabilitySearch holds the parameters of GET /availability
+type availabilitySearch struct {
+	From     time.Time
+	To       time.Time
+	Duration time.Duration
+	Level    string
+	Capacity int
+}
+
+// alignUp rounds t up to the next multiple of granularity counted from midnight in t's location
+func alignUp(t time.Time, granularity time.Duration) time.Time {
+	if granularity <= 0 {
+		return t
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if offset := t.Sub(midnight) % granularity; offset != 0 {
+		return t.Add(granularity - offset)
+	}
+
+	return t
+}
+
+// alignDown rounds t down to the previous multiple of granularity counted from midnight in t's location
+func alignDown(t time.Time, granularity time.Duration) time.Time {
+	if granularity <= 0 {
+		return t
+	}
+
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return t.Add(-(t.Sub(midnight) % granularity))
+}
+
+// freeIntervals returns the parts of window not covered by busy that can hold a booking of
+// duration whose start and end fall on granularity boundaries, busy may be unsorted and overlapping
+func freeIntervals(window interval, busy []interval, duration, granularity time.Duration) []interval {
+	sort.Slice(busy, func(i, j int) bool { return busy[i].Start.Before(busy[j].Start) })
+
+	var gaps []interval
+	cursor := window.Start
+	for _, b := range append(busy, interval{window.End, window.End}) {
+		end := b.Start
+		if end.After(window.End) {
+			end = window.End
+		}
+
+		if end.After(cursor) {
+			gap := interval{alignUp(cursor, granularity), alignDown(end, granularity)}
+			if gap.End.Sub(gap.Start) >= duration {
+				gaps = append(gaps, gap)
+			}
+		}
+
+		if b.End.After(cursor) {
+			cursor = b.End
+		}
+	}
+
+	return gaps
+}
+
+// window returns the part of the search that bookings may start in under rules, extended by
+// the duration so that the last possible booking fits
+func (s *availabilitySearch) window(rules bookingRules, now time.Time) interval {
+	w := interval{s.From, s.To}
+
+	if earliest := now.Add(rules.MinLeadTime); rules.MinLeadTime > 0 && w.Start.Before(earliest) {
+		w.Start = earliest.In(s.From.Location())
+	}
+
+	if latest := now.Add(rules.MaxAdvance).Add(s.Duration); rules.MaxAdvance > 0 && w.End.After(latest) {
+		w.End = latest.In(s.From.Location())
+	}
+
+	return w
+}
+
+// validate checks the requested duration against rules
+func (s *availabilitySearch) validate(rules bookingRules) error {
+	if s.Duration <= 0 {
+		return &ruleViolation{"invalid_interval", "duration must be positive"}
+	}
+
+	if rules.MaxDuration > 0 && s.Duration > rules.MaxDuration {
+		return &ruleViolation{maxHrPerBookingKey,
+			fmt.Sprintf("Booking cannot be longer than %v hours", formatFloat(rules.MaxDuration.Hours()))}
+	}
+
+	if rules.MinDuration > 0 && s.Duration < rules.MinDuration {
+		return &ruleViolation{minMinPerBookingKey,
+			fmt.Sprintf("Booking cannot be shorter than %v minutes", formatFloat(rules.MinDuration.Minutes()))}
+	}
+
+	if rules.SlotGranularity > 0 && s.Duration%rules.SlotGranularity != 0 {
+		return &ruleViolation{slotGranularityMinKey,
+			fmt.Sprintf("Booking must start and end on %v minute slots", formatFloat(rules.SlotGranularity.Minutes()))}
+	}
+
+	return nil
+}
+
+// getBusyIntervals returns the slots of facilityID within w held by active bookings or by open waitlist offers
+func getBusyIntervals(db dbtx, facilityID int, w interval) ([]interval, error) {
+	rows, err := db.Query(
+		"SELECT start_dt, end_dt FROM booking.booking WHERE facility_id=$1 AND start_dt < $3 AND end_dt > $2 AND status IN "+activeBookingStatuses+
+			" UNION ALL SELECT start_dt, end_dt FROM booking.waitlist WHERE facility_id=$1 AND start_dt < $3 AND end_dt > $2 AND status=$4 AND offer_expires_dt > $5",
+		facilityID, w.Start, w.End, waitlistOffered, time.Now())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	busy := []interval{}
+
+	for rows.Next() {
+		var b interval
+		if err := rows.Scan(&b.Start, &b.End); err != nil {
+			return nil, err
+		}
+		busy = append(busy, b)
+	}
+
+	return busy, rows.Err()
+}
+
+// getAvailability returns the open facilities matching s that have free slots, the facility
+// with the earliest free slot first
+func getAvailability(db dbtx, s availabilitySearch, now time.Time) ([]facilityAvailability, error) {
+	rules, err := getBookingRules(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.validate(rules); err != nil {
+		return nil, err
+	}
+
+	facilities, err := getOpenFacilityDetails(db, s.Level, s.Capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []facilityAvailability{}
+	w := s.window(rules, now)
+	if !w.End.After(w.Start) {
+		return results, nil
+	}
+
+	for _, f := range facilities {
+		busy, err := getBusyIntervals(db, f.ID, w)
+		if err != nil {
+			return nil, err
+		}
+
+		closed, err := getClosedIntervals(db, f.ID, w)
+		if err != nil {
+			return nil, err
+		}
+		busy = append(busy, closed...)
+
+		fa := facilityAvailability{FacilityID: f.ID, Name: f.Name, Level: f.Level, Slots: []timeSlot{}}
+		for _, gap := range freeIntervals(w, busy, s.Duration, rules.SlotGranularity) {
+			fa.Slots = append(fa.Slots, timeSlot{
+				StartTime: gap.Start.In(s.From.Location()).Format(time.RFC3339),
+				EndTime:   gap.End.In(s.From.Location()).Format(time.RFC3339),
+			})
+		}
+
+		if len(fa.Slots) > 0 {
+			results = append(results, fa)
+		}
+	}
+
+	// RFC3339 strings in one location sort chronologically
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Slots[0].StartTime < results[j].Slots[0].StartTime
+	})
+
+	return results, nil
+}
@@ -2,66 +2,314 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+// errBookingOverlap is returned when a booking clashes with another booking on the same facility
+var errBookingOverlap = errors.New("Overlap Bookings")
+
+// booking statuses, bookingTransitions lists the changes allowed between them
+const (
+	bookingStatusPending   = "pending"
+	bookingStatusConfirmed = "confirmed"
+	bookingStatusCancelled = "cancelled"
+	bookingStatusCompleted = "completed"
+	bookingStatusNoShow    = "no_show"
 )
 
+var bookingTransitions = map[string][]string{
+	bookingStatusPending:   {bookingStatusConfirmed, bookingStatusCancelled},
+	bookingStatusConfirmed: {bookingStatusCancelled, bookingStatusCompleted, bookingStatusNoShow},
+}
+
+// activeBookingStatuses is the SQL list of statuses that hold their slot, the same list
+// makes up the WHERE clause of the booking_no_overlap exclusion constraint
+const activeBookingStatuses = "('pending', 'confirmed', 'completed')"
+
+// bookingColumns are selected in the order scanned by booking.scanTargets
+const bookingColumns = "id, user_id, email, purpose, facility_id, start_dt, end_dt, transaction_dt, COALESCE(series_id, 0), status, cancel_reason, cancelled_by, decided_by, decision_comment, checked_in_dt, headcount, sequence"
+
 type booking struct {
-	ID              int    `json:"id"`
-	UserID          string `json:"user_id"`
-	Email           string `json:"email"`
-	Purpose         string `json:"purpose"`
-	FacilityID      int    `json:"facility_id"`
-	StartTime       string `json:"start_dt"`
-	EndTime         string `json:"end_dt"`
-	TransactionTime string `json:"transaction_dt"`
+	ID              int        `json:"id"`
+	UserID          string     `json:"user_id"`
+	Email           string     `json:"email"`
+	Purpose         string     `json:"purpose"`
+	FacilityID      int        `json:"facility_id"`
+	StartTime       string     `json:"start_dt"`
+	EndTime         string     `json:"end_dt"`
+	TransactionTime string     `json:"transaction_dt"`
+	SeriesID        int        `json:"series_id"`
+	Status          string     `json:"status"`
+	CancelReason    string     `json:"cancel_reason"`
+	CancelledBy     string     `json:"cancelled_by"`
+	DecidedBy       string     `json:"decided_by"`
+	DecisionComment string     `json:"decision_comment"`
+	CheckedInAt     *string    `json:"checked_in_dt"`
+	Headcount       int        `json:"headcount"`
+	Attendees       []attendee `json:"attendees"`
+	Sequence        int        `json:"sequence"`
+	Invite          string     `json:"ics,omitempty"`
 }
 
-func (p *booking) getBooking(db *sql.DB) error {
-	return db.QueryRow("SELECT user_id, email, purpose, facility_id, start_dt, end_dt, transaction_dt FROM booking.booking WHERE id=$1",
-		p.ID).Scan(&p.UserID, &p.Email, &p.Purpose, &p.FacilityID, &p.StartTime, &p.EndTime, &p.TransactionTime)
+// statusChange is the payload for changing the status of a booking
+type statusChange struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
 }
 
-func (p *booking) updateBooking(db *sql.DB) error {
-	currentTime := time.Now()
-	_, err :=
-		db.Exec("UPDATE booking.booking SET user_id=$1, email=$2, purpose=$3, facility_id=$4, start_dt=$5, end_dt=$6, transaction_dt=$7 WHERE id=$8",
-			p.UserID, p.Email, p.Purpose, p.FacilityID, p.StartTime, p.EndTime, currentTime, p.ID)
+// bookingTimeLayouts are the accepted formats for start_dt and end_dt
+var bookingTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05Z07",
+	"2006-01-02T15:04:05Z07",
+	"2006-01-02 15:04Z07:00",
+	"2006-01-02 15:04Z07",
+}
 
-	return err
+func parseBookingTime(value string) (time.Time, error) {
+	var t time.Time
+	var err error
+	for _, layout := range bookingTimeLayouts {
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return t, err
 }
 
-func (p *booking) deleteBooking(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM booking.booking WHERE id=$1", p.ID)
+// overlaps reports whether the half-open intervals [start1, end1) and [start2, end2) intersect
+func overlaps(start1, end1, start2, end2 time.Time) bool {
+	return start1.Before(end2) && end1.After(start2)
+}
 
-	return err
+func (p *booking) interval() (time.Time, time.Time, error) {
+	start, err := parseBookingTime(p.StartTime)
+	if err != nil {
+		return start, start, err
+	}
+
+	end, err := parseBookingTime(p.EndTime)
+
+	return start, end, err
 }
 
-func (p *booking) createBooking(db *sql.DB) error {
-	currentTime := time.Now()
-	err := db.QueryRow(
-		"INSERT INTO booking.booking(user_id, email, purpose, facility_id, start_dt, end_dt, transaction_dt) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id",
-		p.UserID, p.Email, p.Purpose, p.FacilityID, p.StartTime, p.EndTime, currentTime).Scan(&p.ID)
+func (p *booking) scanTargets() []interface{} {
+	return []interface{}{&p.ID, &p.UserID, &p.Email, &p.Purpose, &p.FacilityID, &p.StartTime, &p.EndTime,
+		&p.TransactionTime, &p.SeriesID, &p.Status, &p.CancelReason, &p.CancelledBy, &p.DecidedBy, &p.DecisionComment, &p.CheckedInAt, &p.Headcount, &p.Sequence}
+}
+
+// isActive reports whether p holds its slot
+func (p *booking) isActive() bool {
+	return p.Status == bookingStatusPending || p.Status == bookingStatusConfirmed || p.Status == bookingStatusCompleted
+}
 
+// isOpen reports whether p can still be edited or cancelled
+func (p *booking) isOpen() bool {
+	return len(bookingTransitions[p.Status]) > 0
+}
+
+// canTransition reports whether a booking may change from status from to status to
+func canTransition(from, to string) bool {
+	for _, s := range bookingTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getBooking loads p together with its attendees
+func (p *booking) getBooking(db dbtx) error {
+	err := db.QueryRow("SELECT "+bookingColumns+" FROM booking.booking WHERE id=$1",
+		p.ID).Scan(p.scanTargets()...)
 	if err != nil {
 		return err
 	}
 
+	bookings := []booking{*p}
+	if err := loadAttendees(db, bookings); err != nil {
+		return err
+	}
+	p.Attendees = bookings[0].Attendees
+
 	return nil
 }
 
-func getBookings(db *sql.DB, start, count int, userid string) ([]booking, error) {
-	var rows *sql.Rows
-	var err error
-	if len(userid) > 0 {
-		rows, err = db.Query(
-			"SELECT id, user_id, email, purpose, facility_id, start_dt, end_dt, transaction_dt FROM booking.booking WHERE user_id=$1 LIMIT $2 OFFSET $3",
-			userid, count, start)
-	} else {
-		rows, err = db.Query(
-			"SELECT id, user_id, email, purpose, facility_id, start_dt, end_dt, transaction_dt FROM booking.booking LIMIT $1 OFFSET $2",
-			count, start)
+// updateBooking saves p and bumps its sequence so that calendar clients replace the event, moving
+// the start of p lets its reminder be sent again. A moved booking goes through approval again when
+// its facility requires it, which clears the previous decision. The update only applies while p is
+// still in the status it was read with, so that it cannot undo a cancellation made in the meantime.
+func (p *booking) updateBooking(db dbtx) error {
+	return withinTx(db, func(tx dbtx) error {
+		read := p.Status
+		if err := p.reapprove(tx); err != nil {
+			return err
+		}
+
+		currentTime := time.Now()
+		err :=
+			tx.QueryRow("UPDATE booking.booking SET user_id=$1, email=$2, purpose=$3, facility_id=$4, start_dt=$5, end_dt=$6, headcount=$7, transaction_dt=$8, sequence=sequence+1, reminder_sent_dt=CASE WHEN start_dt=$5 THEN reminder_sent_dt END, reminder_attempts=CASE WHEN start_dt=$5 THEN reminder_attempts ELSE 0 END, status=$10, decided_by=CASE WHEN status=$10 THEN decided_by ELSE '' END, decision_comment=CASE WHEN status=$10 THEN decision_comment ELSE '' END WHERE id=$9 AND status=$11 RETURNING sequence, decided_by, decision_comment",
+				p.UserID, p.Email, p.Purpose, p.FacilityID, p.StartTime, p.EndTime, p.Headcount, currentTime, p.ID, p.Status, read).Scan(&p.Sequence, &p.DecidedBy, &p.DecisionComment)
+
+		// the status changed since p was read
+		if err == sql.ErrNoRows {
+			return &ruleViolation{"invalid_status", "Booking status has changed, reload and retry"}
+		}
+		if err != nil {
+			return bookingError(err)
+		}
+		p.TransactionTime = currentTime.Format(time.RFC3339)
+
+		if err := p.setAttendees(tx); err != nil {
+			return err
+		}
+
+		return writeBookingEvents(tx, eventBookingUpdated, *p)
+	})
+}
+
+// setStatus moves p to status, by and reason are recorded when it is cancelled
+func (p *booking) setStatus(db dbtx, status, reason, by string) error {
+	if !canTransition(p.Status, status) {
+		return &ruleViolation{"invalid_status", fmt.Sprintf("Cannot change a %v booking to %v", p.Status, status)}
+	}
+
+	if status != bookingStatusCancelled {
+		reason, by = "", ""
 	}
 
+	return withinTx(db, func(tx dbtx) error {
+		currentTime := time.Now()
+		err := tx.QueryRow("UPDATE booking.booking SET status=$1, cancel_reason=$2, cancelled_by=$3, transaction_dt=$4, sequence=sequence+1 WHERE id=$5 AND status=$6 RETURNING sequence",
+			status, reason, by, currentTime, p.ID, p.Status).Scan(&p.Sequence)
+
+		// the status changed since p was read
+		if err == sql.ErrNoRows {
+			return &ruleViolation{"invalid_status", "Booking status has changed, reload and retry"}
+		}
+		if err != nil {
+			return err
+		}
+
+		p.Status, p.CancelReason, p.CancelledBy, p.TransactionTime = status, reason, by, currentTime.Format(time.RFC3339)
+		return writeBookingEvents(tx, "", *p)
+	})
+}
+
+func (p *booking) cancelBooking(db dbtx, reason, by string) error {
+	return p.setStatus(db, bookingStatusCancelled, reason, by)
+}
+
+// changeBookings runs query, an UPDATE of booking.booking RETURNING bookingColumns, and records an
+// event for each booking it changed in the same transaction. The changed bookings are returned.
+func changeBookings(db dbtx, query string, args ...interface{}) ([]booking, error) {
+	changed := []booking{}
+
+	err := withinTx(db, func(tx dbtx) error {
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var p booking
+			if err := rows.Scan(p.scanTargets()...); err != nil {
+				rows.Close()
+				return err
+			}
+			changed = append(changed, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if err := loadAttendees(tx, changed); err != nil {
+			return err
+		}
+
+		return writeBookingEvents(tx, "", changed...)
+	})
+
+	return changed, err
+}
+
+// approvalStatus is the status a booking of facilityID starts out in, pending when the facility requires approval
+func approvalStatus(db dbtx, facilityID int) (string, error) {
+	var requiresApproval bool
+	err := db.QueryRow("SELECT requires_approval FROM booking.facility_detail WHERE id=$1", facilityID).Scan(&requiresApproval)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if requiresApproval {
+		return bookingStatusPending, nil
+	}
+
+	return bookingStatusConfirmed, nil
+}
+
+// reapprove decides again whether p needs approval when an update moves it to another facility or
+// time, so that a confirmed booking cannot be moved onto a facility that requires approval without it
+func (p *booking) reapprove(tx dbtx) error {
+	if p.Status != bookingStatusPending && p.Status != bookingStatusConfirmed {
+		return nil
+	}
+
+	var moved bool
+	err := tx.QueryRow("SELECT facility_id <> $2 OR start_dt <> $3::timestamptz OR end_dt <> $4::timestamptz FROM booking.booking WHERE id=$1",
+		p.ID, p.FacilityID, p.StartTime, p.EndTime).Scan(&moved)
+	if err != nil || !moved {
+		return err
+	}
+
+	p.Status, err = approvalStatus(tx, p.FacilityID)
+	return err
+}
+
+// createBooking inserts p, a new booking of a facility that requires approval starts out pending
+func (p *booking) createBooking(db dbtx) error {
+	return withinTx(db, func(tx dbtx) error {
+		currentTime := time.Now()
+		status, err := approvalStatus(tx, p.FacilityID)
+		if err != nil {
+			return err
+		}
+		p.Status = status
+
+		err = tx.QueryRow(
+			"INSERT INTO booking.booking(user_id, email, purpose, facility_id, start_dt, end_dt, transaction_dt, series_id, status, headcount) VALUES($1, $2, $3, $4, $5, $6, $7, NULLIF($8, 0), $9, $10) RETURNING id",
+			p.UserID, p.Email, p.Purpose, p.FacilityID, p.StartTime, p.EndTime, currentTime, p.SeriesID, p.Status, p.Headcount).Scan(&p.ID)
+
+		if err != nil {
+			return bookingError(err)
+		}
+		p.TransactionTime = currentTime.Format(time.RFC3339)
+
+		if err := p.setAttendees(tx); err != nil {
+			return err
+		}
+
+		return writeBookingEvents(tx, eventBookingCreated, *p)
+	})
+}
+
+// attendeeCondition matches the bookings the user_id or email in $3 was invited to, or every booking when it is empty
+const attendeeCondition = "($3 = '' OR id IN (SELECT booking_id FROM booking.booking_attendee WHERE user_id = $3 OR email = $3))"
+
+// getBookings lists bookings, filtered by userid, status and attendee when they are given
+func getBookings(db *sql.DB, start, count int, userid, status, attendee string) ([]booking, error) {
+	rows, err := db.Query(
+		"SELECT "+bookingColumns+" FROM booking.booking WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR status = $2) AND "+attendeeCondition+" LIMIT $4 OFFSET $5",
+		userid, status, attendee, count, start)
+
 	if err != nil {
 		return nil, err
 	}
@@ -72,24 +320,24 @@ func getBookings(db *sql.DB, start, count int, userid string) ([]booking, error)
 
 	for rows.Next() {
 		var p booking
-		if err := rows.Scan(&p.ID, &p.UserID, &p.Email, &p.Purpose, &p.FacilityID, &p.StartTime, &p.EndTime, &p.TransactionTime); err != nil {
+		if err := rows.Scan(p.scanTargets()...); err != nil {
 			return nil, err
 		}
 		bookings = append(bookings, p)
 	}
 
-	return bookings, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bookings, loadAttendees(db, bookings)
 }
 
-func getBookingsCount(db *sql.DB, userid string) (int, error) {
+func getBookingsCount(db *sql.DB, userid, status, attendee string) (int, error) {
 
 	var count int
-	var err error
-	if len(userid) > 0 {
-		err = db.QueryRow("SELECT COUNT (id) FROM booking.booking WHERE user_id=$1", userid).Scan(&count)
-	} else {
-		err = db.QueryRow("SELECT COUNT (id) FROM booking.booking").Scan(&count)
-	}
+	err := db.QueryRow("SELECT COUNT (id) FROM booking.booking WHERE ($1 = '' OR user_id = $1) AND ($2 = '' OR status = $2) AND "+attendeeCondition,
+		userid, status, attendee).Scan(&count)
 
 	if err != nil {
 		return 0, err
@@ -98,16 +346,15 @@ func getBookingsCount(db *sql.DB, userid string) (int, error) {
 	return count, nil
 }
 
-func (p *booking) deleteAllBookingByFacilityID(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM booking.booking WHERE facility_id=$1", p.FacilityID)
-
-	return err
-}
-
-func (p *booking) getOverlappingBookings(db *sql.DB) (int, error) {
+// getOverlappingBookings counts the other active bookings on p's facility that clash with p,
+// p itself is excluded so that an update does not conflict with its current slot. A slot offered
+// to another user from the waitlist counts as taken until the offer expires.
+func (p *booking) getOverlappingBookings(db dbtx) (int, error) {
 	var count int
 	var err error
-	err = db.QueryRow("SELECT COUNT (id) FROM booking.booking WHERE (facility_id=$1) AND ((start_dt <= $2::timestamp AND end_dt > $2::timestamp) OR (start_dt < $3::timestamp AND end_dt >= $3::timestamp))", p.FacilityID, p.StartTime, p.EndTime).Scan(&count)
+	err = db.QueryRow("SELECT (SELECT COUNT (id) FROM booking.booking WHERE (facility_id=$1) AND (id <> $4) AND (start_dt < $3::timestamptz AND end_dt > $2::timestamptz) AND status IN "+activeBookingStatuses+")"+
+		" + (SELECT COUNT (id) FROM booking.waitlist WHERE facility_id=$1 AND user_id <> $5 AND status=$6 AND offer_expires_dt > $7 AND start_dt < $3::timestamptz AND end_dt > $2::timestamptz)",
+		p.FacilityID, p.StartTime, p.EndTime, p.ID, p.UserID, waitlistOffered, time.Now()).Scan(&count)
 
 	if err != nil {
 		return 0, err
@@ -115,3 +362,46 @@ func (p *booking) getOverlappingBookings(db *sql.DB) (int, error) {
 
 	return count, nil
 }
+
+// checkOverlap returns errBookingOverlap if p clashes with any other booking
+func (p *booking) checkOverlap(db dbtx) error {
+	count, err := p.getOverlappingBookings(db)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return errBookingOverlap
+	}
+
+	return nil
+}
+
+// saveBooking validates p and then creates or updates it in one transaction, the
+// booking_no_overlap exclusion constraint rejects a concurrent write that slipped past the check
+func (p *booking) saveBooking(db *sql.DB) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		if err := validateBooking(tx, p, time.Now()); err != nil {
+			return err
+		}
+
+		if err := p.checkOverlap(tx); err != nil {
+			return err
+		}
+
+		if p.ID == 0 {
+			return p.createBooking(tx)
+		}
+
+		return p.updateBooking(tx)
+	})
+}
+
+// bookingError maps a violation of the booking_no_overlap exclusion constraint to errBookingOverlap
+func bookingError(err error) error {
+	if e, ok := err.(*pq.Error); ok && e.Code == "23P01" {
+		return errBookingOverlap
+	}
+
+	return err
+}
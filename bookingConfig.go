@@ -16,6 +16,10 @@ func (p *bookingConfig) getBookingConfig(db *sql.DB) error {
 }
 
 func (p *bookingConfig) updateBookingConfig(db *sql.DB) error {
+	if err := checkBookingConfig(p.Key, p.Value); err != nil {
+		return err
+	}
+
 	_, err :=
 		db.Exec("UPDATE booking.booking_config SET key=$1, value=$2 WHERE id=$3",
 			p.Key, p.Value, p.ID)
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	htmltemplate "html/template"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// mailTemplate renders the subject, text body and HTML body of a mail from the same data
+type mailTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// mailFuncs are the functions available to the mail templates
+var mailFuncs = map[string]interface{}{
+	"when": bookingWhen,
+}
+
+func newMailTemplate(name, subject, text, html string) *mailTemplate {
+	return &mailTemplate{
+		subject: template.Must(template.New(name).Funcs(mailFuncs).Parse(subject)),
+		text:    template.Must(template.New(name).Funcs(mailFuncs).Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name).Funcs(mailFuncs).Parse(html)),
+	}
+}
+
+func (t *mailTemplate) render(to string, data interface{}) (mail, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return mail{}, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return mail{}, err
+	}
+	if err := t.html.Execute(&html, data); err != nil {
+		return mail{}, err
+	}
+
+	return mail{To: to, Subject: strings.TrimSpace(subject.String()), Body: text.String(), HTML: html.String()}, nil
+}
+
+// bookingMailData is what the booking mail templates are rendered with, Bookings all belong to the
+// same owner and facility
+type bookingMailData struct {
+	Title    string
+	Note     string
+	Facility string
+	Bookings []booking
+}
+
+const bookingMailText = `Hello,
+
+{{.Title}}.
+
+{{range .Bookings}}- {{with $.Facility}}{{.}}, {{end}}{{when .}}{{with .Purpose}}: {{.}}{{end}}
+{{end}}{{with .Note}}
+{{.}}
+{{end}}`
+
+const bookingMailHTML = `<!DOCTYPE html>
+<html>
+<body>
+<p>Hello,</p>
+<p>{{.Title}}.</p>
+<ul>
+{{range .Bookings}}<li>{{with $.Facility}}<strong>{{.}}</strong>, {{end}}{{when .}}{{with .Purpose}}: {{.}}{{end}}</li>
+{{end}}</ul>
+{{with .Note}}<p>{{.}}</p>
+{{end}}</body>
+</html>
+`
+
+// maxReminderAttempts is how many times a reminder is tried before the booking is left without one
+const maxReminderAttempts = 3
+
+var (
+	confirmationTemplate = newMailTemplate("confirmation", "{{.Title}}", bookingMailText, bookingMailHTML)
+	reminderTemplate     = newMailTemplate("reminder", "{{.Title}}", bookingMailText, bookingMailHTML)
+)
+
+// bookingWhen formats the time of b for people, falling back to the stored values
+func bookingWhen(b booking) string {
+	start, end, err := b.interval()
+	if err != nil {
+		return b.StartTime + " to " + b.EndTime
+	}
+
+	end = end.In(start.Location())
+	if end.Year() == start.Year() && end.YearDay() == start.YearDay() {
+		return start.Format("Mon 2 Jan 2006 15:04") + " to " + end.Format("15:04 MST")
+	}
+
+	return start.Format("Mon 2 Jan 2006 15:04") + " to " + end.Format("Mon 2 Jan 2006 15:04 MST")
+}
+
+// renderBookingMail renders t for the owner of bookings, the facility name is left out if it cannot be read
+func renderBookingMail(t *mailTemplate, db dbtx, title, note string, bookings []booking) (mail, error) {
+	data := bookingMailData{Title: title, Note: note, Bookings: bookings}
+
+	f := facilityDetail{ID: bookings[0].FacilityID}
+	if err := f.getFacilityDetail(db); err == nil {
+		data.Facility = f.Name
+	}
+
+	return t.render(bookings[0].Email, data)
+}
+
+// confirmationMail tells the owner of bookings that they were created, updated or cancelled by one request
+func confirmationMail(db dbtx, event string, bookings []booking) (mail, error) {
+	n := len(bookings)
+	var title, note string
+
+	switch {
+	case event == eventBookingCancelled:
+		title = plural(n, "Your booking has been cancelled", "Your bookings have been cancelled")
+		if reason := bookings[0].CancelReason; len(reason) > 0 {
+			note = "Reason: " + reason
+		}
+	case event == eventBookingUpdated:
+		title = plural(n, "Your booking has been updated", "Your bookings have been updated")
+	case bookings[0].Status == bookingStatusPending:
+		title = plural(n, "Your booking request has been received", "Your booking requests have been received")
+		note = "The facility needs approval, you will be emailed once the request has been decided."
+	default:
+		title = plural(n, "Your booking is confirmed", "Your bookings are confirmed")
+	}
+
+	return renderBookingMail(confirmationTemplate, db, title, note, bookings)
+}
+
+// plural picks the wording for n bookings
+func plural(n int, one, many string) string {
+	if n > 1 {
+		return many
+	}
+
+	return one
+}
+
+// needsConfirmation reports whether the owner of b is mailed a confirmation of event. Check-ins and
+// completions need none, and the owners of no-shows and of bookings cancelled by an approval decision,
+// archiving or maintenance are told by notices of their own.
+func needsConfirmation(event string, b *booking) bool {
+	switch {
+	case len(b.Email) == 0:
+		return false
+	case event == eventBookingCreated:
+		return true
+	case event == eventBookingUpdated:
+		return b.CheckedInAt == nil && (b.Status == bookingStatusPending || b.Status == bookingStatusConfirmed)
+	case event == eventBookingCancelled && b.Status == bookingStatusCancelled:
+		switch b.CancelReason {
+		case approvalRejectedReason, approvalExpiredReason, facilityArchivedReason:
+			return false
+		}
+		return !strings.HasPrefix(b.CancelReason, maintenanceReasonPrefix)
+	}
+
+	return false
+}
+
+// confirmationSink mails the owner of a booking event a confirmation, whichever request or
+// background job made the change. Failed mails are logged rather than returned, so that a mail
+// outage does not hold up the outbox and the other sinks.
+type confirmationSink struct {
+	App *App
+}
+
+func (s *confirmationSink) publish(tx dbtx, e *outboxEvent, now time.Time) error {
+	var payload struct {
+		Data booking `json:"data"`
+	}
+	if e.Event != eventBookingCreated && e.Event != eventBookingUpdated && e.Event != eventBookingCancelled {
+		return nil
+	}
+	if err := json.Unmarshal(e.Payload, &payload); err != nil {
+		return err
+	}
+
+	if !needsConfirmation(e.Event, &payload.Data) {
+		return nil
+	}
+
+	m, err := confirmationMail(tx, e.Event, []booking{payload.Data})
+	if err != nil {
+		log.Printf("Failed to render confirmation of booking %v: %v", payload.Data.ID, err)
+		return nil
+	}
+
+	s.App.sendMail(m)
+	return nil
+}
+
+// sendReminders mails the owner of each confirmed booking that starts within the reminder_min lead
+// time and returns how many reminders were sent. A booking is claimed by setting reminder_sent_dt
+// in a transaction that only commits once its mail has been handed to m, so each reminder is sent
+// by exactly one instance. A failed mail is recorded on the booking and the run goes on with the
+// others, the reminder is retried on later runs until the booking starts or maxReminderAttempts
+// have failed. The last mail error is returned with the count.
+func sendReminders(db *sql.DB, m mailer, now time.Time) (int, error) {
+	rules, err := getBookingRules(db)
+	if err != nil || rules.ReminderLead == 0 {
+		return 0, err
+	}
+
+	sent := 0
+	failed := []int64{}
+	var mailErr error
+	for {
+		var p booking
+		claimed := false
+		err := withTx(db, func(tx *sql.Tx) error {
+			err := tx.QueryRow(
+				"UPDATE booking.booking SET reminder_sent_dt=$1, reminder_attempts=reminder_attempts+1, reminder_error='' WHERE id=(SELECT id FROM booking.booking WHERE status=$2 AND reminder_sent_dt IS NULL AND reminder_attempts < $4 AND id <> ALL($5) AND start_dt > $1 AND start_dt <= $3 ORDER BY start_dt, id LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING "+bookingColumns,
+				now, bookingStatusConfirmed, now.Add(rules.ReminderLead), maxReminderAttempts, pq.Array(failed)).Scan(p.scanTargets()...)
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			claimed = true
+
+			if len(p.Email) == 0 {
+				return nil
+			}
+
+			msg, err := renderBookingMail(reminderTemplate, tx, "Your booking starts soon", "", []booking{p})
+			if err != nil {
+				return err
+			}
+
+			return m.send(msg)
+		})
+
+		if !claimed {
+			if err != nil {
+				return sent, err
+			}
+			return sent, mailErr
+		}
+		if err == nil {
+			sent++
+			continue
+		}
+
+		// the claim was rolled back with the failed mail, the attempt is recorded on its own so
+		// that a reminder that keeps failing is eventually left alone
+		log.Printf("Failed to send reminder of booking %v: %v", p.ID, err)
+		mailErr = err
+		if _, err := db.Exec("UPDATE booking.booking SET reminder_attempts=reminder_attempts+1, reminder_error=$1 WHERE id=$2", mailErr.Error(), p.ID); err != nil {
+			return sent, err
+		}
+		failed = append(failed, int64(p.ID))
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// booking_config keys understood by the booking rules engine
+const (
+	maxHrPerBookingKey    = "max_hr_per_booking"
+	minMinPerBookingKey   = "min_min_per_booking"
+	minLeadTimeMinKey     = "min_lead_time_min"
+	maxAdvanceDayKey      = "max_advance_day"
+	slotGranularityMinKey = "slot_granularity_min"
+	approvalTimeoutHrKey  = "approval_timeout_hr"
+	waitlistClaimMinKey   = "waitlist_claim_min"
+	checkInGraceMinKey    = "check_in_grace_min"
+	reminderMinKey        = "reminder_min"
+)
+
+// bookingRules holds the typed booking_config values, a zero value disables the rule
+type bookingRules struct {
+	MaxDuration     time.Duration
+	MinDuration     time.Duration
+	MinLeadTime     time.Duration
+	MaxAdvance      time.Duration
+	SlotGranularity time.Duration
+	ApprovalTimeout time.Duration
+	WaitlistClaim   time.Duration
+	CheckInGrace    time.Duration
+	ReminderLead    time.Duration
+}
+
+// ruleViolation is returned when a booking breaks one of the booking rules
+type ruleViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"error"`
+}
+
+func (v *ruleViolation) Error() string {
+	return v.Message
+}
+
+func getBookingRules(db dbtx) (bookingRules, error) {
+	var rules bookingRules
+
+	rows, err := db.Query("SELECT key, value FROM booking.booking_config")
+	if err != nil {
+		return rules, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value sql.NullString
+		if err := rows.Scan(&key, &value); err != nil {
+			return rules, err
+		}
+
+		unit, target := rules.field(key)
+		if target == nil {
+			continue
+		}
+
+		n, err := parseRuleValue(value.String)
+		if err != nil {
+			return rules, fmt.Errorf("Invalid booking config %v: %q", key, value.String)
+		}
+		*target = time.Duration(n * float64(unit))
+	}
+
+	return rules, rows.Err()
+}
+
+// field returns the unit of the booking_config key and the rule it sets, or a nil rule for other keys
+func (r *bookingRules) field(key string) (time.Duration, *time.Duration) {
+	switch key {
+	case maxHrPerBookingKey:
+		return time.Hour, &r.MaxDuration
+	case minMinPerBookingKey:
+		return time.Minute, &r.MinDuration
+	case minLeadTimeMinKey:
+		return time.Minute, &r.MinLeadTime
+	case maxAdvanceDayKey:
+		return 24 * time.Hour, &r.MaxAdvance
+	case slotGranularityMinKey:
+		return time.Minute, &r.SlotGranularity
+	case approvalTimeoutHrKey:
+		return time.Hour, &r.ApprovalTimeout
+	case waitlistClaimMinKey:
+		return time.Minute, &r.WaitlistClaim
+	case checkInGraceMinKey:
+		return time.Minute, &r.CheckInGrace
+	case reminderMinKey:
+		return time.Minute, &r.ReminderLead
+	}
+
+	return 0, nil
+}
+
+// parseRuleValue reads a booking_config value, a non-negative number of the key's unit
+func parseRuleValue(value string) (float64, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+		return 0, fmt.Errorf("Invalid booking config value %q", value)
+	}
+
+	return n, nil
+}
+
+// checkBookingConfig rejects a value the booking rules cannot read for key, other keys take any value
+func checkBookingConfig(key, value string) error {
+	var rules bookingRules
+	if _, target := rules.field(key); target == nil {
+		return nil
+	}
+
+	if _, err := parseRuleValue(value); err != nil {
+		return &ruleViolation{"invalid_config", fmt.Sprintf("%v must be a number that is not negative. Got %q", key, value)}
+	}
+
+	return nil
+}
+
+func (r *bookingRules) validate(p *booking, now time.Time) error {
+	start, end, err := p.interval()
+	if err != nil {
+		return &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	if !start.Before(end) {
+		return &ruleViolation{"invalid_interval", "start_dt must be before end_dt"}
+	}
+
+	duration := end.Sub(start)
+
+	if r.MaxDuration > 0 && duration > r.MaxDuration {
+		return &ruleViolation{maxHrPerBookingKey,
+			fmt.Sprintf("Booking cannot be longer than %v hours", formatFloat(r.MaxDuration.Hours()))}
+	}
+
+	if r.MinDuration > 0 && duration < r.MinDuration {
+		return &ruleViolation{minMinPerBookingKey,
+			fmt.Sprintf("Booking cannot be shorter than %v minutes", formatFloat(r.MinDuration.Minutes()))}
+	}
+
+	if r.MinLeadTime > 0 && start.Before(now.Add(r.MinLeadTime)) {
+		return &ruleViolation{minLeadTimeMinKey,
+			fmt.Sprintf("Booking must be made at least %v minutes in advance", formatFloat(r.MinLeadTime.Minutes()))}
+	}
+
+	if r.MaxAdvance > 0 && start.After(now.Add(r.MaxAdvance)) {
+		return &ruleViolation{maxAdvanceDayKey,
+			fmt.Sprintf("Booking cannot be made more than %v days in advance", formatFloat(r.MaxAdvance.Hours()/24))}
+	}
+
+	if r.SlotGranularity > 0 {
+		midnight := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
+		if start.Sub(midnight)%r.SlotGranularity != 0 || duration%r.SlotGranularity != 0 {
+			return &ruleViolation{slotGranularityMinKey,
+				fmt.Sprintf("Booking must start and end on %v minute slots", formatFloat(r.SlotGranularity.Minutes()))}
+		}
+	}
+
+	return nil
+}
+
+// validateBooking checks p against the rules currently stored in booking_config, its facility, the facility
+// calendar and its owner's quota
+func validateBooking(db dbtx, p *booking, now time.Time) error {
+	rules, err := getBookingRules(db)
+	if err != nil {
+		return err
+	}
+
+	if err := rules.validate(p, now); err != nil {
+		return err
+	}
+
+	if err := checkFacility(db, p); err != nil {
+		return err
+	}
+
+	if err := checkFacilityCalendar(db, p); err != nil {
+		return err
+	}
+
+	return checkQuota(db, p, now)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scopes for editing or cancelling an occurrence of a booking series
+const (
+	seriesScopeThis      = "this"
+	seriesScopeFollowing = "following"
+	seriesScopeAll       = "all"
+)
+
+const maxSeriesOccurrences = 200
+
+// errSeriesConflict is returned when an edit to a series would leave an occurrence invalid
+var errSeriesConflict = errors.New("Booking series has conflicting occurrences")
+
+var weekdayCodes = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// recurrence is a subset of the iCalendar RRULE: FREQ, INTERVAL, BYDAY, UNTIL and COUNT
+type recurrence struct {
+	Frequency string   `json:"frequency"`
+	Interval  int      `json:"interval"`
+	ByWeekday []string `json:"by_weekday"`
+	Until     string   `json:"until"`
+	Count     int      `json:"count"`
+}
+
+type bookingSeries struct {
+	ID              int        `json:"id"`
+	UserID          string     `json:"user_id"`
+	Email           string     `json:"email"`
+	Purpose         string     `json:"purpose"`
+	FacilityID      int        `json:"facility_id"`
+	StartTime       string     `json:"start_dt"`
+	EndTime         string     `json:"end_dt"`
+	Recurrence      recurrence `json:"recurrence"`
+	TransactionTime string     `json:"transaction_dt"`
+}
+
+// seriesConflict reports an occurrence that could not be booked or changed
+type seriesConflict struct {
+	StartTime string `json:"start_dt"`
+	EndTime   string `json:"end_dt"`
+	Rule      string `json:"rule,omitempty"`
+	Message   string `json:"error"`
+}
+
+type bookingSeriesResult struct {
+	Series    bookingSeries    `json:"series"`
+	Bookings  []booking        `json:"bookings"`
+	Conflicts []seriesConflict `json:"conflicts"`
+}
+
+func newSeriesConflict(p *booking, err error) seriesConflict {
+	c := seriesConflict{StartTime: p.StartTime, EndTime: p.EndTime, Message: err.Error()}
+	if v, ok := err.(*ruleViolation); ok {
+		c.Rule = v.Rule
+	}
+
+	return c
+}
+
+// isBookingConflict reports whether err means the booking itself is invalid, as opposed to a failure
+func isBookingConflict(err error) bool {
+	_, ok := err.(*ruleViolation)
+	return ok || err == errBookingOverlap
+}
+
+// untilTime parses UNTIL, a date without a time covers that whole day
+func (r *recurrence) untilTime(loc *time.Location) (time.Time, error) {
+	if d, err := time.ParseInLocation("2006-01-02", r.Until, loc); err == nil {
+		return d.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+
+	return parseBookingTime(r.Until)
+}
+
+// occurrences expands the recurrence into the start times of each occurrence, beginning with start
+func (r *recurrence) occurrences(start time.Time) ([]time.Time, error) {
+	interval := r.Interval
+	if interval == 0 {
+		interval = 1
+	}
+	if interval < 0 {
+		return nil, &ruleViolation{"invalid_recurrence", "interval must be positive"}
+	}
+
+	if r.Count < 0 || r.Count > maxSeriesOccurrences {
+		return nil, &ruleViolation{"invalid_recurrence", fmt.Sprintf("count must be between 1 and %v", maxSeriesOccurrences)}
+	}
+
+	var until time.Time
+	if len(r.Until) > 0 {
+		var err error
+		if until, err = r.untilTime(start.Location()); err != nil {
+			return nil, &ruleViolation{"invalid_recurrence", "Invalid until"}
+		}
+	} else if r.Count == 0 {
+		return nil, &ruleViolation{"invalid_recurrence", "count or until is required"}
+	}
+
+	var next func(i int) []time.Time
+	switch strings.ToUpper(r.Frequency) {
+	case "DAILY":
+		next = func(i int) []time.Time {
+			return []time.Time{start.AddDate(0, 0, i*interval)}
+		}
+	case "WEEKLY":
+		weekdays := []time.Weekday{start.Weekday()}
+		if len(r.ByWeekday) > 0 {
+			seen := map[time.Weekday]bool{}
+			weekdays = nil
+			for _, code := range r.ByWeekday {
+				wd, ok := weekdayCodes[strings.ToUpper(code)]
+				if !ok {
+					return nil, &ruleViolation{"invalid_recurrence", fmt.Sprintf("Invalid weekday %q", code)}
+				}
+				seen[wd] = true
+			}
+			for _, wd := range []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday} {
+				if seen[wd] {
+					weekdays = append(weekdays, wd)
+				}
+			}
+		}
+
+		// weeks start on Monday, as in the iCalendar default WKST
+		monday := start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+		next = func(i int) []time.Time {
+			var times []time.Time
+			for _, wd := range weekdays {
+				t := monday.AddDate(0, 0, i*7*interval+(int(wd)+6)%7)
+				if !t.Before(start) {
+					times = append(times, t)
+				}
+			}
+			return times
+		}
+	case "MONTHLY":
+		next = func(i int) []time.Time {
+			t := start.AddDate(0, i*interval, 0)
+			// months without this day of the month are skipped
+			if t.Day() != start.Day() {
+				return nil
+			}
+			return []time.Time{t}
+		}
+	default:
+		return nil, &ruleViolation{"invalid_recurrence", "frequency must be DAILY, WEEKLY or MONTHLY"}
+	}
+
+	var times []time.Time
+	for i := 0; i < maxSeriesOccurrences*12; i++ {
+		for _, t := range next(i) {
+			if !until.IsZero() && t.After(until) {
+				return times, nil
+			}
+
+			times = append(times, t)
+			if len(times) == r.Count {
+				return times, nil
+			}
+
+			if len(times) > maxSeriesOccurrences {
+				return nil, &ruleViolation{"invalid_recurrence", fmt.Sprintf("A series cannot have more than %v occurrences", maxSeriesOccurrences)}
+			}
+		}
+	}
+
+	return times, nil
+}
+
+func (p *bookingSeries) getBookingSeries(db dbtx) error {
+	var byWeekday string
+	var until sql.NullString
+	err := db.QueryRow("SELECT user_id, email, purpose, facility_id, start_dt, end_dt, frequency, repeat_interval, by_weekday, until_dt, occurrence_count, transaction_dt FROM booking.booking_series WHERE id=$1",
+		p.ID).Scan(&p.UserID, &p.Email, &p.Purpose, &p.FacilityID, &p.StartTime, &p.EndTime,
+		&p.Recurrence.Frequency, &p.Recurrence.Interval, &byWeekday, &until, &p.Recurrence.Count, &p.TransactionTime)
+	if err != nil {
+		return err
+	}
+
+	p.Recurrence.Until = until.String
+	p.Recurrence.ByWeekday = []string{}
+	if len(byWeekday) > 0 {
+		p.Recurrence.ByWeekday = strings.Split(byWeekday, ",")
+	}
+
+	return nil
+}
+
+func (p *bookingSeries) createBookingSeries(db dbtx) error {
+	currentTime := time.Now()
+	var until interface{}
+	if len(p.Recurrence.Until) > 0 {
+		start, _ := parseBookingTime(p.StartTime)
+		t, err := p.Recurrence.untilTime(start.Location())
+		if err != nil {
+			return err
+		}
+		until = t
+	}
+
+	return db.QueryRow(
+		"INSERT INTO booking.booking_series(user_id, email, purpose, facility_id, start_dt, end_dt, frequency, repeat_interval, by_weekday, until_dt, occurrence_count, transaction_dt) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id",
+		p.UserID, p.Email, p.Purpose, p.FacilityID, p.StartTime, p.EndTime, strings.ToUpper(p.Recurrence.Frequency), p.Recurrence.Interval,
+		strings.ToUpper(strings.Join(p.Recurrence.ByWeekday, ",")), until, p.Recurrence.Count, currentTime).Scan(&p.ID)
+}
+
+// createBookings saves the series and books every occurrence that passes validation, occurrences
+// that do not are reported as conflicts. Nothing is saved if no occurrence could be booked.
+func (p *bookingSeries) createBookings(db *sql.DB) (bookingSeriesResult, error) {
+	result := bookingSeriesResult{Bookings: []booking{}, Conflicts: []seriesConflict{}}
+
+	template := booking{StartTime: p.StartTime, EndTime: p.EndTime}
+	start, end, err := template.interval()
+	if err != nil {
+		return result, &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	if p.Recurrence.Interval == 0 {
+		p.Recurrence.Interval = 1
+	}
+
+	starts, err := p.Recurrence.occurrences(start)
+	if err != nil {
+		return result, err
+	}
+
+	err = withTx(db, func(tx *sql.Tx) error {
+		if err := p.createBookingSeries(tx); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, t := range starts {
+			b := booking{
+				UserID:     p.UserID,
+				Email:      p.Email,
+				Purpose:    p.Purpose,
+				FacilityID: p.FacilityID,
+				StartTime:  t.Format(time.RFC3339),
+				EndTime:    t.Add(end.Sub(start)).Format(time.RFC3339),
+				SeriesID:   p.ID,
+			}
+
+			err := validateBooking(tx, &b, now)
+			if err == nil {
+				err = b.checkOverlap(tx)
+			}
+
+			if isBookingConflict(err) {
+				result.Conflicts = append(result.Conflicts, newSeriesConflict(&b, err))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := b.createBooking(tx); err != nil {
+				return err
+			}
+			result.Bookings = append(result.Bookings, b)
+		}
+
+		if len(result.Bookings) == 0 {
+			return errSeriesConflict
+		}
+
+		return nil
+	})
+
+	result.Series = *p
+	return result, err
+}
+
+// getSeriesBookings returns the occurrences of a series starting at or after from
+func getSeriesBookings(db dbtx, seriesID int, from string) ([]booking, error) {
+	rows, err := db.Query(
+		"SELECT "+bookingColumns+" FROM booking.booking WHERE series_id=$1 AND start_dt >= $2::timestamptz ORDER BY start_dt",
+		seriesID, from)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	bookings := []booking{}
+
+	for rows.Next() {
+		var p booking
+		if err := rows.Scan(p.scanTargets()...); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, p)
+	}
+
+	return bookings, nil
+}
+
+// seriesScopeStart returns the earliest start_dt covered by scope when editing occurrence p
+func seriesScopeStart(p *booking, scope string) string {
+	if scope == seriesScopeFollowing {
+		return p.StartTime
+	}
+
+	return "-infinity"
+}
+
+// wallClock returns the date and time of day of t in facilityZone as a UTC time, offsets between
+// wall clocks can then be added without daylight saving changes shifting the time of day
+func wallClock(t time.Time) time.Time {
+	t = t.In(facilityZone)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// moveWallClock moves t by offset on the wall clock of facilityZone
+func moveWallClock(t time.Time, offset time.Duration) time.Time {
+	w := wallClock(t).Add(offset)
+	return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), w.Nanosecond(), facilityZone)
+}
+
+// updateSeriesBookings applies the change from existing to p to every occurrence in scope: each
+// occurrence is moved by the same offset on the wall clock of facilityZone, given p's duration and
+// takes p's other fields, and the series itself is changed the same way. If any occurrence would
+// conflict nothing is changed and the conflicts are returned.
+func updateSeriesBookings(db *sql.DB, existing, p booking, scope string) ([]booking, []seriesConflict, error) {
+	updated := []booking{}
+	conflicts := []seriesConflict{}
+
+	oldStart, err := parseBookingTime(existing.StartTime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newStart, newEnd, err := p.interval()
+	if err != nil {
+		return nil, nil, &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	offset := wallClock(newStart).Sub(wallClock(oldStart))
+	duration := newEnd.Sub(newStart)
+
+	err = withTx(db, func(tx *sql.Tx) error {
+		occurrences, err := getSeriesBookings(tx, existing.SeriesID, seriesScopeStart(&existing, scope))
+		if err != nil {
+			return err
+		}
+
+		// move the occurrence furthest in the direction of travel first so that
+		// an occurrence never lands on the old slot of one that has not moved yet
+		if offset > 0 {
+			for i, j := 0, len(occurrences)-1; i < j; i, j = i+1, j-1 {
+				occurrences[i], occurrences[j] = occurrences[j], occurrences[i]
+			}
+		}
+
+		now := time.Now()
+		for _, o := range occurrences {
+			// cancelled and finished occurrences stay where they were
+			if !o.isOpen() {
+				continue
+			}
+
+			start, err := parseBookingTime(o.StartTime)
+			if err != nil {
+				return err
+			}
+			start = moveWallClock(start, offset)
+
+			o.UserID = p.UserID
+			o.Email = p.Email
+			o.Purpose = p.Purpose
+			o.FacilityID = p.FacilityID
+			o.Headcount = p.Headcount
+			o.Attendees = p.Attendees
+			o.StartTime = start.Format(time.RFC3339)
+			o.EndTime = start.Add(duration).Format(time.RFC3339)
+
+			err = validateBooking(tx, &o, now)
+			if err == nil {
+				err = o.checkOverlap(tx)
+			}
+
+			if isBookingConflict(err) {
+				conflicts = append(conflicts, newSeriesConflict(&o, err))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if len(conflicts) == 0 {
+				if err := o.updateBooking(tx); err != nil {
+					return err
+				}
+				updated = append(updated, o)
+			}
+		}
+
+		if len(conflicts) > 0 {
+			return errSeriesConflict
+		}
+
+		return updateSeries(tx, existing.SeriesID, p, offset, duration)
+	})
+
+	return updated, conflicts, err
+}
+
+// updateSeries gives series seriesID the fields of p and moves its times by offset, as an edit of
+// its occurrences does
+func updateSeries(db dbtx, seriesID int, p booking, offset, duration time.Duration) error {
+	series := bookingSeries{ID: seriesID}
+	if err := series.getBookingSeries(db); err != nil {
+		return err
+	}
+
+	start, err := parseBookingTime(series.StartTime)
+	if err != nil {
+		return err
+	}
+	start = moveWallClock(start, offset)
+
+	_, err = db.Exec("UPDATE booking.booking_series SET user_id=$1, email=$2, purpose=$3, facility_id=$4, start_dt=$5, end_dt=$6, transaction_dt=$7 WHERE id=$8",
+		p.UserID, p.Email, p.Purpose, p.FacilityID, start, start.Add(duration), time.Now(), seriesID)
+	return err
+}
+
+// cancelSeriesBookings cancels and returns the pending and confirmed occurrences in scope
+func cancelSeriesBookings(db dbtx, existing *booking, scope, reason, by string) ([]booking, error) {
+	return changeBookings(db,
+		"UPDATE booking.booking SET status=$1, cancel_reason=$2, cancelled_by=$3, transaction_dt=$4, sequence=sequence+1 WHERE series_id=$5 AND start_dt >= $6::timestamptz AND status IN ($7, $8) RETURNING "+bookingColumns,
+		bookingStatusCancelled, reason, by, time.Now(), existing.SeriesID, seriesScopeStart(existing, scope), bookingStatusPending, bookingStatusConfirmed)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// iCalendar methods, feeds are published while the invite attached to a booking response
+// requests the event or, once the booking is no longer active, cancels it
+const (
+	icsMethodPublish = "PUBLISH"
+	icsMethodRequest = "REQUEST"
+	icsMethodCancel  = "CANCEL"
+)
+
+// icsDomain qualifies the UID of every booking event so that it does not clash with other calendars
+const icsDomain = "bookingbackend"
+
+// calendarFeedHistory is how far back the calendar feeds go
+const calendarFeedHistory = 30 * 24 * time.Hour
+
+// feedToken is returned once when a calendar feed token is issued, only its hash is stored
+type feedToken struct {
+	Token string `json:"token"`
+}
+
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsStripControls drops the control characters, line breaks included, that would end a content line early
+func icsStripControls(value string) string {
+	return strings.Map(func(r rune) rune {
+		if (r < ' ' && r != '\t') || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// icsParamValue quotes a parameter value, RFC 5545 has no escapes inside a quoted-string so
+// control characters are dropped and double quotes replaced
+func icsParamValue(value string) string {
+	return `"` + strings.ReplaceAll(icsStripControls(value), `"`, "'") + `"`
+}
+
+// writeICSLine writes one content line, folded at 75 octets without splitting a UTF-8 sequence
+func writeICSLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		// the leading space of a continuation line counts towards its length
+		limit = 74
+	}
+
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+func icsStatus(p *booking) string {
+	switch {
+	case !p.isActive():
+		return "CANCELLED"
+	case p.Status == bookingStatusPending:
+		return "TENTATIVE"
+	default:
+		return "CONFIRMED"
+	}
+}
+
+// writeICSEvent writes p as a VEVENT, its UID stays the same for the life of the booking and its
+// SEQUENCE grows with every change so that calendar clients replace the event they already have
+func writeICSEvent(b *strings.Builder, p *booking, now time.Time) error {
+	start, end, err := p.interval()
+	if err != nil {
+		return err
+	}
+
+	summary := p.Purpose
+	if len(summary) == 0 {
+		summary = "Facility booking"
+	}
+
+	writeICSLine(b, "BEGIN:VEVENT")
+	writeICSLine(b, fmt.Sprintf("UID:booking-%v@%v", p.ID, icsDomain))
+	writeICSLine(b, fmt.Sprintf("SEQUENCE:%v", p.Sequence))
+	writeICSLine(b, "DTSTAMP:"+icsTime(now))
+	writeICSLine(b, "DTSTART:"+icsTime(start))
+	writeICSLine(b, "DTEND:"+icsTime(end))
+	writeICSLine(b, "SUMMARY:"+icsEscaper.Replace(summary))
+	writeICSLine(b, fmt.Sprintf("LOCATION:Facility %v", p.FacilityID))
+	writeICSLine(b, "STATUS:"+icsStatus(p))
+	if len(p.Email) > 0 {
+		writeICSLine(b, "ORGANIZER:mailto:"+icsStripControls(p.Email))
+	}
+	for _, a := range p.Attendees {
+		if len(a.Email) == 0 {
+			continue
+		}
+		name := a.Name
+		if len(name) == 0 {
+			name = a.Email
+		}
+		writeICSLine(b, fmt.Sprintf("ATTENDEE;CN=%v:mailto:%v", icsParamValue(name), icsStripControls(a.Email)))
+	}
+	writeICSLine(b, "END:VEVENT")
+
+	return nil
+}
+
+// icsCalendar renders bookings as an RFC 5545 calendar
+func icsCalendar(method string, bookings []booking, now time.Time) (string, error) {
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//BookingBackend//Facility Booking//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:"+method)
+
+	for i := range bookings {
+		if err := writeICSEvent(&b, &bookings[i], now); err != nil {
+			return "", err
+		}
+	}
+
+	writeICSLine(&b, "END:VCALENDAR")
+
+	return b.String(), nil
+}
+
+// bookingInvite returns the invite for p that creates or updates the event in the owner's
+// calendar, or removes it once p is no longer active
+func bookingInvite(p *booking, now time.Time) string {
+	method := icsMethodRequest
+	if !p.isActive() {
+		method = icsMethodCancel
+	}
+
+	invite, err := icsCalendar(method, []booking{*p}, now)
+	if err != nil {
+		return ""
+	}
+
+	return invite
+}
+
+// createFeedToken issues the calendar feed token of userID, replacing the one they had before
+func createFeedToken(db dbtx, userID string) (feedToken, error) {
+	token, err := newToken()
+	if err != nil {
+		return feedToken{}, err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO booking.feed_token(user_id, token_hash, transaction_dt) VALUES($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET token_hash=excluded.token_hash, transaction_dt=excluded.transaction_dt",
+		userID, hashToken(token), time.Now())
+
+	return feedToken{token}, err
+}
+
+// getFeedAccount returns the active account that owns the calendar feed token
+func getFeedAccount(db dbtx, token string) (account, error) {
+	var acc account
+	err := db.QueryRow(
+		"SELECT a.id, a.user_id, a.admin, a.email, a.email_verified, a.active FROM booking.feed_token f JOIN booking.account a ON a.user_id = f.user_id WHERE f.token_hash=$1 AND a.active",
+		hashToken(token)).Scan(&acc.ID, &acc.UserID, &acc.Admin, &acc.Email, &acc.EmailVerified, &acc.Active)
+
+	return acc, err
+}
+
+// getCalendarBookings returns the active bookings that end after since, those userID owns or was
+// invited to when it is given and those of facilityID when it is given
+func getCalendarBookings(db dbtx, userID string, facilityID int, since time.Time) ([]booking, error) {
+	rows, err := db.Query(
+		"SELECT "+bookingColumns+" FROM booking.booking WHERE ($1 = '' OR user_id = $1 OR id IN (SELECT booking_id FROM booking.booking_attendee WHERE user_id = $1)) AND ($2 = 0 OR facility_id = $2) AND end_dt > $3 AND status IN "+activeBookingStatuses+" ORDER BY start_dt, id",
+		userID, facilityID, since)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	bookings := []booking{}
+
+	for rows.Next() {
+		var p booking
+		if err := rows.Scan(p.scanTargets()...); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return bookings, loadAttendees(db, bookings)
+}
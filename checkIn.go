@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// noShowCount is the number of bookings a user did not check in to
+type noShowCount struct {
+	UserID  string `json:"user_id"`
+	NoShows int    `json:"no_shows"`
+}
+
+// checkIn records that the owner of p turned up. With check_in_grace_min set check-in opens that
+// long before start_dt and closes that long after it, otherwise it is open for the whole booking.
+func (p *booking) checkIn(db dbtx, now time.Time) error {
+	if p.Status != bookingStatusConfirmed {
+		return &ruleViolation{"invalid_status", fmt.Sprintf("Cannot check in to a %v booking", p.Status)}
+	}
+
+	if p.CheckedInAt != nil {
+		return &ruleViolation{"checked_in", "Booking is already checked in"}
+	}
+
+	start, end, err := p.interval()
+	if err != nil {
+		return &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	rules, err := getBookingRules(db)
+	if err != nil {
+		return err
+	}
+
+	opens, closes := start, end
+	if rules.CheckInGrace > 0 {
+		opens, closes = start.Add(-rules.CheckInGrace), start.Add(rules.CheckInGrace)
+	}
+
+	if now.Before(opens) || !now.Before(closes) {
+		return &ruleViolation{checkInGraceMinKey,
+			fmt.Sprintf("Check-in is only open from %v to %v", opens.Format(time.RFC3339), closes.Format(time.RFC3339))}
+	}
+
+	return withinTx(db, func(tx dbtx) error {
+		res, err := tx.Exec("UPDATE booking.booking SET checked_in_dt=$1 WHERE id=$2 AND status=$3 AND checked_in_dt IS NULL",
+			now, p.ID, bookingStatusConfirmed)
+		if err != nil {
+			return err
+		}
+
+		// the booking was cancelled, released or checked in since p was read
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return &ruleViolation{"invalid_status", "Booking status has changed, reload and retry"}
+		}
+
+		checkedIn := now.Format(time.RFC3339Nano)
+		p.CheckedInAt = &checkedIn
+		return writeBookingEvents(tx, eventBookingUpdated, *p)
+	})
+}
+
+// markNoShows releases and returns the confirmed bookings nobody checked in to within
+// check_in_grace_min of start_dt. Nothing is released while the key is unset, and bookings that
+// already ended are left alone so that enabling it does not mark the whole history as no-shows.
+func markNoShows(db *sql.DB, now time.Time) ([]booking, error) {
+	rules, err := getBookingRules(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if rules.CheckInGrace == 0 {
+		return []booking{}, nil
+	}
+
+	// no_show is not an active status, so the rest of the slot is free as soon as the row changes
+	return changeBookings(db,
+		"UPDATE booking.booking SET status=$1, transaction_dt=$2, sequence=sequence+1 WHERE status=$3 AND checked_in_dt IS NULL AND start_dt <= $4 AND end_dt > $2 RETURNING "+bookingColumns,
+		bookingStatusNoShow, now, bookingStatusConfirmed, now.Add(-rules.CheckInGrace))
+}
+
+// getNoShowCounts counts the no-shows of each user since the given time, most no-shows first
+func getNoShowCounts(db dbtx, start, count int, since time.Time) ([]noShowCount, error) {
+	rows, err := db.Query(
+		"SELECT user_id, COUNT (id) FROM booking.booking WHERE status=$1 AND start_dt >= $2 GROUP BY user_id ORDER BY COUNT (id) DESC, user_id LIMIT $3 OFFSET $4",
+		bookingStatusNoShow, since, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	counts := []noShowCount{}
+
+	for rows.Next() {
+		var c noShowCount
+		if err := rows.Scan(&c.UserID, &c.NoShows); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+// noShowNotice tells the owner of b that b was released for not checking in
+func noShowNotice(b *booking) mail {
+	return mail{
+		To:      b.Email,
+		Subject: "Your booking has been released",
+		Body: fmt.Sprintf("Nobody checked in to your booking from %v to %v, so it has been marked as a no-show and the room released.\n",
+			b.StartTime, b.EndTime),
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// facilityZone is the time zone that opening hours and quota days are kept in, whatever offset a
+// booking is sent with, and that imported calendar times without a zone are read in. main sets it
+// from APP_TIMEZONE.
+var facilityZone = time.Local
+
+// openingHour is one weekly opening period of a facility, times are in facilityZone
+type openingHour struct {
+	Weekday   string `json:"weekday"`
+	OpenTime  string `json:"open_time"`
+	CloseTime string `json:"close_time"`
+}
+
+// openingHours is the weekly template of a facility, a facility without one is always open
+type openingHours []openingHour
+
+// blackout closes one or, with facility_id 0, every facility between start_dt and end_dt
+type blackout struct {
+	ID              int    `json:"id"`
+	FacilityID      int    `json:"facility_id"`
+	Reason          string `json:"reason"`
+	StartTime       string `json:"start_dt"`
+	EndTime         string `json:"end_dt"`
+	TransactionTime string `json:"transaction_dt"`
+}
+
+// parseClock parses a time of day such as "09:00", "17:30:00" or "24:00" into the offset from midnight
+func parseClock(value string) (time.Duration, error) {
+	var h, m, s int
+	n, _ := fmt.Sscanf(value, "%d:%d:%d", &h, &m, &s)
+	if n < 2 || h < 0 || m < 0 || m > 59 || s < 0 || s > 59 {
+		return 0, fmt.Errorf("Invalid time of day %q", value)
+	}
+
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if d > 24*time.Hour {
+		return 0, fmt.Errorf("Invalid time of day %q", value)
+	}
+
+	return d, nil
+}
+
+func weekdayCode(wd time.Weekday) string {
+	for code, d := range weekdayCodes {
+		if d == wd {
+			return code
+		}
+	}
+
+	return ""
+}
+
+func (h openingHours) validate() error {
+	for _, o := range h {
+		if _, ok := weekdayCodes[strings.ToUpper(o.Weekday)]; !ok {
+			return &ruleViolation{"invalid_opening_hours", fmt.Sprintf("Invalid weekday %q", o.Weekday)}
+		}
+
+		open, err := parseClock(o.OpenTime)
+		if err != nil {
+			return &ruleViolation{"invalid_opening_hours", err.Error()}
+		}
+
+		closeAt, err := parseClock(o.CloseTime)
+		if err != nil {
+			return &ruleViolation{"invalid_opening_hours", err.Error()}
+		}
+
+		if open >= closeAt {
+			return &ruleViolation{"invalid_opening_hours", "open_time must be before close_time"}
+		}
+	}
+
+	return nil
+}
+
+// closedIntervals returns the parts of w outside the opening hours, days are taken in facilityZone
+func (h openingHours) closedIntervals(w interval) ([]interval, error) {
+	if len(h) == 0 {
+		return nil, nil
+	}
+
+	var closed []interval
+	start := w.Start.In(facilityZone)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, facilityZone)
+	for day.Before(w.End) {
+		next := day.AddDate(0, 0, 1)
+
+		var open []interval
+		for _, o := range h {
+			if weekdayCodes[strings.ToUpper(o.Weekday)] != day.Weekday() {
+				continue
+			}
+			from, err := parseClock(o.OpenTime)
+			if err != nil {
+				return nil, err
+			}
+			to, err := parseClock(o.CloseTime)
+			if err != nil {
+				return nil, err
+			}
+			open = append(open, interval{day.Add(from), day.Add(to)})
+		}
+		sort.Slice(open, func(i, j int) bool { return open[i].Start.Before(open[j].Start) })
+
+		cursor := day
+		for _, o := range append(open, interval{next, next}) {
+			if o.Start.After(cursor) {
+				closed = append(closed, interval{cursor, o.Start})
+			}
+			if o.End.After(cursor) {
+				cursor = o.End
+			}
+		}
+
+		day = next
+	}
+
+	return closed, nil
+}
+
+// covers reports whether the facility is open for the whole of [start, end)
+func (h openingHours) covers(start, end time.Time) (bool, error) {
+	closed, err := h.closedIntervals(interval{start, end})
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range closed {
+		if overlaps(c.Start, c.End, start, end) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// clockColumn selects the time column as HH:MM:SS, lib/pq would scan it as a date-time otherwise
+func clockColumn(column string) string {
+	return "CASE WHEN " + column + " = '24:00' THEN '24:00:00' ELSE to_char(" + column + ", 'HH24:MI:SS') END"
+}
+
+func getOpeningHours(db dbtx, facilityID int) (openingHours, error) {
+	rows, err := db.Query(
+		"SELECT weekday, "+clockColumn("open_time")+", "+clockColumn("close_time")+" FROM booking.opening_hour WHERE facility_id=$1 ORDER BY (weekday + 6) % 7, open_time",
+		facilityID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	hours := openingHours{}
+
+	for rows.Next() {
+		var o openingHour
+		var wd int
+		if err := rows.Scan(&wd, &o.OpenTime, &o.CloseTime); err != nil {
+			return nil, err
+		}
+		o.Weekday = weekdayCode(time.Weekday(wd))
+		hours = append(hours, o)
+	}
+
+	return hours, rows.Err()
+}
+
+// setOpeningHours replaces the weekly template of a facility, an empty template leaves it always open
+func setOpeningHours(db *sql.DB, facilityID int, hours openingHours) error {
+	if err := hours.validate(); err != nil {
+		return err
+	}
+
+	return withTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM booking.opening_hour WHERE facility_id=$1", facilityID); err != nil {
+			return err
+		}
+
+		for _, o := range hours {
+			_, err := tx.Exec("INSERT INTO booking.opening_hour(facility_id, weekday, open_time, close_time) VALUES($1, $2, $3, $4)",
+				facilityID, int(weekdayCodes[strings.ToUpper(o.Weekday)]), o.OpenTime, o.CloseTime)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (p *blackout) validate() error {
+	start, err := parseBookingTime(p.StartTime)
+	if err != nil {
+		return &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	end, err := parseBookingTime(p.EndTime)
+	if err != nil {
+		return &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	if !start.Before(end) {
+		return &ruleViolation{"invalid_interval", "start_dt must be before end_dt"}
+	}
+
+	return nil
+}
+
+func (p *blackout) getBlackout(db dbtx) error {
+	return db.QueryRow("SELECT COALESCE(facility_id, 0), reason, start_dt, end_dt, transaction_dt FROM booking.blackout WHERE id=$1",
+		p.ID).Scan(&p.FacilityID, &p.Reason, &p.StartTime, &p.EndTime, &p.TransactionTime)
+}
+
+func (p *blackout) createBlackout(db dbtx) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	currentTime := time.Now()
+	return db.QueryRow(
+		"INSERT INTO booking.blackout(facility_id, reason, start_dt, end_dt, transaction_dt) VALUES(NULLIF($1, 0), $2, $3, $4, $5) RETURNING id",
+		p.FacilityID, p.Reason, p.StartTime, p.EndTime, currentTime).Scan(&p.ID)
+}
+
+func (p *blackout) updateBlackout(db dbtx) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	currentTime := time.Now()
+	_, err :=
+		db.Exec("UPDATE booking.blackout SET facility_id=NULLIF($1, 0), reason=$2, start_dt=$3, end_dt=$4, transaction_dt=$5 WHERE id=$6",
+			p.FacilityID, p.Reason, p.StartTime, p.EndTime, currentTime, p.ID)
+
+	return err
+}
+
+func (p *blackout) deleteBlackout(db dbtx) error {
+	_, err := db.Exec("DELETE FROM booking.blackout WHERE id=$1", p.ID)
+
+	return err
+}
+
+// getBlackouts lists blackouts by start_dt, those of facilityID and the global ones when it is given
+func getBlackouts(db dbtx, start, count, facilityID int) ([]blackout, error) {
+	rows, err := db.Query(
+		"SELECT id, COALESCE(facility_id, 0), reason, start_dt, end_dt, transaction_dt FROM booking.blackout WHERE ($1 = 0 OR facility_id IS NULL OR facility_id = $1) ORDER BY start_dt, id LIMIT $2 OFFSET $3",
+		facilityID, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	blackouts := []blackout{}
+
+	for rows.Next() {
+		var p blackout
+		if err := rows.Scan(&p.ID, &p.FacilityID, &p.Reason, &p.StartTime, &p.EndTime, &p.TransactionTime); err != nil {
+			return nil, err
+		}
+		blackouts = append(blackouts, p)
+	}
+
+	return blackouts, rows.Err()
+}
+
+// getBlackoutIntervals returns the blackouts closing facilityID that intersect w
+func getBlackoutIntervals(db dbtx, facilityID int, w interval) ([]interval, error) {
+	rows, err := db.Query(
+		"SELECT start_dt, end_dt FROM booking.blackout WHERE (facility_id IS NULL OR facility_id=$1) AND start_dt < $3 AND end_dt > $2",
+		facilityID, w.Start, w.End)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	closed := []interval{}
+
+	for rows.Next() {
+		var b interval
+		if err := rows.Scan(&b.Start, &b.End); err != nil {
+			return nil, err
+		}
+		closed = append(closed, b)
+	}
+
+	return closed, rows.Err()
+}
+
+// getClosedIntervals returns the parts of w in which facilityID is outside its opening hours,
+// blacked out or under maintenance
+func getClosedIntervals(db dbtx, facilityID int, w interval) ([]interval, error) {
+	hours, err := getOpeningHours(db, facilityID)
+	if err != nil {
+		return nil, err
+	}
+
+	closed, err := getBlackoutIntervals(db, facilityID, w)
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance, err := getMaintenanceIntervals(db, facilityID, w)
+	if err != nil {
+		return nil, err
+	}
+
+	outside, err := hours.closedIntervals(w)
+	if err != nil {
+		return nil, err
+	}
+
+	closed = append(closed, maintenance...)
+	return append(closed, outside...), nil
+}
+
+// checkFacilityCalendar rejects p if any part of it is outside opening hours, inside a blackout
+// or inside a maintenance window
+func checkFacilityCalendar(db dbtx, p *booking) error {
+	start, end, err := p.interval()
+	if err != nil {
+		return &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	hours, err := getOpeningHours(db, p.FacilityID)
+	if err != nil {
+		return err
+	}
+
+	covers, err := hours.covers(start, end)
+	if err != nil {
+		return err
+	}
+	if !covers {
+		return &ruleViolation{"opening_hours", "Booking is outside the facility's opening hours"}
+	}
+
+	var reason string
+	err = db.QueryRow(
+		"SELECT reason FROM booking.blackout WHERE (facility_id IS NULL OR facility_id=$1) AND start_dt < $3::timestamptz AND end_dt > $2::timestamptz ORDER BY start_dt LIMIT 1",
+		p.FacilityID, p.StartTime, p.EndTime).Scan(&reason)
+
+	switch err {
+	case sql.ErrNoRows:
+	case nil:
+		return &ruleViolation{"blackout", fmt.Sprintf("Facility is closed: %v", reason)}
+	default:
+		return err
+	}
+
+	err = db.QueryRow(
+		"SELECT reason FROM booking.maintenance_window WHERE facility_id=$1 AND start_dt < $3::timestamptz AND end_dt > $2::timestamptz ORDER BY start_dt LIMIT 1",
+		p.FacilityID, p.StartTime, p.EndTime).Scan(&reason)
+
+	switch err {
+	case sql.ErrNoRows:
+		return nil
+	case nil:
+		return &ruleViolation{"maintenance", fmt.Sprintf("Facility is under maintenance: %v", reason)}
+	default:
+		return err
+	}
+}
@@ -2,49 +2,191 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 )
 
+// facilityStatusOpen is the status of a facility that can be booked, an archived facility
+// is retired and kept only for the history of its bookings
+const (
+	facilityStatusOpen     = "OPEN"
+	facilityStatusArchived = "ARCHIVED"
+)
+
 type facilityDetail struct {
-	ID              int    `json:"id"`
-	Name            string `json:"name"`
-	Level           string `json:"level"`
-	Description     string `json:"description"`
-	Status          string `json:"status"`
-	TransactionTime string `json:"transaction_dt"`
+	ID               int    `json:"id"`
+	Name             string `json:"name"`
+	Level            string `json:"level"`
+	Description      string `json:"description"`
+	Status           string `json:"status"`
+	RequiresApproval bool   `json:"requires_approval"`
+	Capacity         int    `json:"capacity"`
+	TransactionTime  string `json:"transaction_dt"`
 }
 
-func (p *facilityDetail) getFacilityDetail(db *sql.DB) error {
-	return db.QueryRow("SELECT name, level, description, status, transaction_dt FROM booking.facility_detail WHERE id=$1",
-		p.ID).Scan(&p.Name, &p.Level, &p.Description, &p.Status, &p.TransactionTime)
+// facilityStatusChange is the data of a facility.status_changed event
+type facilityStatusChange struct {
+	Facility       facilityDetail `json:"facility"`
+	PreviousStatus string         `json:"previous_status"`
 }
 
+func (p *facilityDetail) getFacilityDetail(db dbtx) error {
+	return db.QueryRow("SELECT name, level, description, status, requires_approval, capacity, transaction_dt FROM booking.facility_detail WHERE id=$1",
+		p.ID).Scan(&p.Name, &p.Level, &p.Description, &p.Status, &p.RequiresApproval, &p.Capacity, &p.TransactionTime)
+}
+
+// updateFacilityDetail saves p, a change of status is recorded as its own event as well. Archiving
+// goes through archiveFacilityDetail so that its bookings are cancelled, and an archived facility stays archived.
 func (p *facilityDetail) updateFacilityDetail(db *sql.DB) error {
-	currentTime := time.Now()
-	_, err :=
-		db.Exec("UPDATE booking.facility_detail SET name=$1, level=$2, description=$3, status=$4, transaction_dt=$5 WHERE id=$6",
-			p.Name, p.Level, p.Description, p.Status, currentTime, p.ID)
+	return withTx(db, func(tx *sql.Tx) error {
+		previous, err := lockFacilityStatus(tx, p.ID)
+		if err != nil {
+			return err
+		}
 
-	return err
+		if previous == facilityStatusArchived {
+			return &ruleViolation{"invalid_status", "An archived facility cannot be changed"}
+		}
+		if p.Status == facilityStatusArchived {
+			return &ruleViolation{"invalid_status", "Archive a facility with DELETE /facilityDetail/{id}"}
+		}
+
+		currentTime := time.Now()
+		_, err =
+			tx.Exec("UPDATE booking.facility_detail SET name=$1, level=$2, description=$3, status=$4, requires_approval=$5, capacity=$6, transaction_dt=$7 WHERE id=$8",
+				p.Name, p.Level, p.Description, p.Status, p.RequiresApproval, p.Capacity, currentTime, p.ID)
+		if err != nil {
+			return err
+		}
+		p.TransactionTime = currentTime.Format(time.RFC3339)
+
+		if err := writeOutbox(tx, eventFacilityUpdated, *p); err != nil {
+			return err
+		}
+
+		return writeFacilityStatusChange(tx, p, previous)
+	})
+}
+
+// lockFacilityStatus returns the status of facility id and locks it until the transaction ends
+func lockFacilityStatus(tx dbtx, id int) (string, error) {
+	var status string
+	err := tx.QueryRow("SELECT status FROM booking.facility_detail WHERE id=$1 FOR UPDATE", id).Scan(&status)
+	return status, err
 }
 
-func (p *facilityDetail) deleteFacilityDetail(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM booking.facility_detail WHERE id=$1", p.ID)
+// writeFacilityStatusChange records a facility.status_changed event if p's status is no longer previous
+func writeFacilityStatusChange(tx dbtx, p *facilityDetail, previous string) error {
+	if p.Status == previous {
+		return nil
+	}
 
-	return err
+	return writeOutbox(tx, eventFacilityStatusChanged, facilityStatusChange{*p, previous})
 }
 
-func (p *facilityDetail) createFacilityDetail(db *sql.DB) error {
-	currentTime := time.Now()
-	err := db.QueryRow(
-		"INSERT INTO booking.facility_detail(name, level, description, status, transaction_dt) VALUES($1, $2, $3, $4, $5) RETURNING id",
-		p.Name, p.Level, p.Description, p.Status, currentTime).Scan(&p.ID)
+// facilityArchivedReason is the cancel reason of the bookings of an archived facility, their owners are told by archiveNotice
+const facilityArchivedReason = "Facility archived"
 
-	if err != nil {
+// archiveFacilityDetail retires p in one transaction: the facility is archived and its bookings
+// that have not started yet are cancelled by by and returned, past bookings are kept as they are
+func (p *facilityDetail) archiveFacilityDetail(db *sql.DB, by string) ([]booking, error) {
+	cancelled := []booking{}
+
+	err := withTx(db, func(tx *sql.Tx) error {
+		previous, err := lockFacilityStatus(tx, p.ID)
+		if err != nil {
+			return err
+		}
+
+		currentTime := time.Now()
+		err = tx.QueryRow("UPDATE booking.facility_detail SET status=$1, transaction_dt=$2 WHERE id=$3 RETURNING name, level, description, status, requires_approval, capacity, transaction_dt",
+			facilityStatusArchived, currentTime, p.ID).Scan(&p.Name, &p.Level, &p.Description, &p.Status, &p.RequiresApproval, &p.Capacity, &p.TransactionTime)
+		if err != nil {
+			return err
+		}
+
+		if err := writeFacilityStatusChange(tx, p, previous); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(
+			"SELECT "+bookingColumns+" FROM booking.booking WHERE facility_id=$1 AND start_dt > $2 AND status IN ($3, $4) ORDER BY start_dt FOR UPDATE",
+			p.ID, currentTime, bookingStatusPending, bookingStatusConfirmed)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			var b booking
+			if err := rows.Scan(b.scanTargets()...); err != nil {
+				rows.Close()
+				return err
+			}
+			cancelled = append(cancelled, b)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i := range cancelled {
+			if err := cancelled[i].cancelBooking(tx, facilityArchivedReason, by); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return cancelled, err
+}
+
+// checkFacility rejects p if its facility does not exist, has been archived or cannot seat p's attendees
+func checkFacility(db dbtx, p *booking) error {
+	f := facilityDetail{ID: p.FacilityID}
+	switch err := f.getFacilityDetail(db); err {
+	case nil:
+	case sql.ErrNoRows:
+		return &ruleViolation{"invalid_facility", "Facility not found"}
+	default:
 		return err
 	}
 
-	return nil
+	if f.Status == facilityStatusArchived {
+		return &ruleViolation{"invalid_facility", "Facility has been archived"}
+	}
+
+	if err := p.checkAttendees(db); err != nil {
+		return err
+	}
+
+	return p.checkCapacity(&f)
+}
+
+// archiveNotice tells the owner of b that it was cancelled because facility p was archived
+func archiveNotice(p *facilityDetail, b *booking) mail {
+	return mail{
+		To:      b.Email,
+		Subject: "Your booking has been cancelled",
+		Body: fmt.Sprintf("Facility %v has been retired.\n\nYour booking from %v to %v has been cancelled, please book another facility.\n",
+			p.Name, b.StartTime, b.EndTime),
+	}
+}
+
+func (p *facilityDetail) createFacilityDetail(db *sql.DB) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		currentTime := time.Now()
+		err := tx.QueryRow(
+			"INSERT INTO booking.facility_detail(name, level, description, status, requires_approval, capacity, transaction_dt) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+			p.Name, p.Level, p.Description, p.Status, p.RequiresApproval, p.Capacity, currentTime).Scan(&p.ID)
+
+		if err != nil {
+			return err
+		}
+		p.TransactionTime = currentTime.Format(time.RFC3339)
+
+		return writeOutbox(tx, eventFacilityCreated, *p)
+	})
 }
 
 func getFacilityDetails(db *sql.DB, start, count int, status string) ([]facilityDetail, error) {
@@ -54,11 +196,11 @@ func getFacilityDetails(db *sql.DB, start, count int, status string) ([]facility
 
 	if len(status) > 0 {
 		rows, err = db.Query(
-			"SELECT id, name, level, description, status, transaction_dt FROM booking.facility_detail WHERE status=$1 LIMIT $2 OFFSET $3",
+			"SELECT id, name, level, description, status, requires_approval, capacity, transaction_dt FROM booking.facility_detail WHERE status=$1 LIMIT $2 OFFSET $3",
 			status, count, start)
 	} else {
 		rows, err = db.Query(
-			"SELECT id, name, level, description, status, transaction_dt FROM booking.facility_detail LIMIT $1 OFFSET $2",
+			"SELECT id, name, level, description, status, requires_approval, capacity, transaction_dt FROM booking.facility_detail LIMIT $1 OFFSET $2",
 			count, start)
 	}
 
@@ -72,7 +214,7 @@ func getFacilityDetails(db *sql.DB, start, count int, status string) ([]facility
 
 	for rows.Next() {
 		var p facilityDetail
-		if err := rows.Scan(&p.ID, &p.Name, &p.Level, &p.Description, &p.Status, &p.TransactionTime); err != nil {
+		if err := rows.Scan(&p.ID, &p.Name, &p.Level, &p.Description, &p.Status, &p.RequiresApproval, &p.Capacity, &p.TransactionTime); err != nil {
 			return nil, err
 		}
 		facilityDetails = append(facilityDetails, p)
@@ -98,3 +240,29 @@ func getFacilityDetailsCount(db *sql.DB, status string) (int, error) {
 
 	return count, nil
 }
+
+// getOpenFacilityDetails returns the OPEN facilities, only those on level and seating at least
+// capacity people when they are given
+func getOpenFacilityDetails(db dbtx, level string, capacity int) ([]facilityDetail, error) {
+	rows, err := db.Query(
+		"SELECT id, name, level, description, status, requires_approval, capacity, transaction_dt FROM booking.facility_detail WHERE status=$1 AND ($2 = '' OR level::text=$2) AND (capacity = 0 OR capacity >= $3) ORDER BY id",
+		facilityStatusOpen, level, capacity)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	facilityDetails := []facilityDetail{}
+
+	for rows.Next() {
+		var p facilityDetail
+		if err := rows.Scan(&p.ID, &p.Name, &p.Level, &p.Description, &p.Status, &p.RequiresApproval, &p.Capacity, &p.TransactionTime); err != nil {
+			return nil, err
+		}
+		facilityDetails = append(facilityDetails, p)
+	}
+
+	return facilityDetails, nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// import result statuses, conflicts are events that break a booking rule or overlap a booking
+const (
+	importCreated  = "created"
+	importConflict = "conflict"
+	importInvalid  = "invalid"
+	importSkipped  = "skipped"
+)
+
+// maxImportSize caps the size of an uploaded calendar
+const maxImportSize = 5 << 20
+
+// errImportDryRun rolls back the import transaction of a dry run
+var errImportDryRun = errors.New("Dry run")
+
+// icsProperty is one unfolded content line of a calendar
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icsEvent is a VEVENT of an uploaded calendar, Err is set when it could not be read
+type icsEvent struct {
+	UID        string
+	Summary    string
+	Organizer  string
+	Start      time.Time
+	End        time.Time
+	Recurrence *recurrence
+	ExDates    []time.Time
+	Cancelled  bool
+	Err        error
+}
+
+// importResult reports what happened to one event or occurrence of an import
+type importResult struct {
+	UID       string `json:"uid"`
+	Summary   string `json:"summary"`
+	StartTime string `json:"start_dt"`
+	EndTime   string `json:"end_dt"`
+	Status    string `json:"status"`
+	BookingID int    `json:"booking_id,omitempty"`
+	SeriesID  int    `json:"series_id,omitempty"`
+	Rule      string `json:"rule,omitempty"`
+	Message   string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	DryRun    bool           `json:"dry_run"`
+	Created   int            `json:"created"`
+	Conflicts int            `json:"conflicts"`
+	Invalid   int            `json:"invalid"`
+	Results   []importResult `json:"results"`
+}
+
+// unfoldICS splits a calendar into content lines, joining the continuation lines that start with a space or tab
+func unfoldICS(data string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if len(strings.TrimSpace(line)) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// parseICSProperty splits NAME;PARAM=value;...:VALUE, a colon inside a quoted parameter value does not end the name
+func parseICSProperty(line string) (icsProperty, error) {
+	p := icsProperty{Params: map[string]string{}}
+
+	quoted := false
+	end := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return p, fmt.Errorf("Invalid content line %q", line)
+	}
+
+	p.Value = line[end+1:]
+	parts := strings.Split(line[:end], ";")
+	p.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+			p.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	return p, nil
+}
+
+var icsUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// parseICSTime reads a DATE-TIME in UTC, in the TZID parameter's zone or floating in facilityZone,
+// or a DATE at midnight. It also reports whether the value was a DATE.
+func parseICSTime(value string, params map[string]string) (time.Time, bool, error) {
+	loc := facilityZone
+	if tzid, ok := params["TZID"]; ok {
+		var err error
+		if loc, err = time.LoadLocation(tzid); err != nil {
+			return time.Time{}, false, fmt.Errorf("Unknown TZID %q", tzid)
+		}
+	}
+
+	if len(value) == 8 || params["VALUE"] == "DATE" {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+var icsDurationPattern = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICSDuration reads a positive DURATION such as PT1H30M, P1D or P2W
+func parseICSDuration(value string) (time.Duration, error) {
+	m := icsDurationPattern.FindStringSubmatch(strings.TrimPrefix(value, "+"))
+	if m == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("Invalid duration %q", value)
+	}
+
+	var d time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if len(m[i+1]) > 0 {
+			n, _ := strconv.Atoi(m[i+1])
+			d += time.Duration(n) * unit
+		}
+	}
+
+	return d, nil
+}
+
+// parseRRule reads the FREQ, INTERVAL, BYDAY, UNTIL and COUNT parts of an RRULE into a recurrence,
+// any other part would change the occurrences and is rejected rather than ignored. BYDAY is only
+// read as plain weekdays of a weekly rule, and a rule without COUNT or UNTIL never ends so it
+// cannot be booked.
+func parseRRule(value string) (*recurrence, error) {
+	r := &recurrence{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid RRULE part %q", part)
+		}
+
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			r.Frequency = strings.ToUpper(kv[1])
+		case "INTERVAL":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid RRULE INTERVAL %q", kv[1])
+			}
+			r.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid RRULE COUNT %q", kv[1])
+			}
+			r.Count = n
+		case "UNTIL":
+			t, date, err := parseICSTime(kv[1], map[string]string{})
+			if err != nil {
+				return nil, fmt.Errorf("Invalid RRULE UNTIL %q", kv[1])
+			}
+			if date {
+				r.Until = t.Format("2006-01-02")
+			} else {
+				r.Until = t.Format(time.RFC3339)
+			}
+		case "BYDAY":
+			r.ByWeekday = strings.Split(strings.ToUpper(kv[1]), ",")
+			for _, code := range r.ByWeekday {
+				if _, ok := weekdayCodes[code]; !ok {
+					return nil, fmt.Errorf("Unsupported RRULE BYDAY %q, only plain weekdays such as MO or TU are supported", code)
+				}
+			}
+		case "WKST":
+			if strings.ToUpper(kv[1]) != "MO" {
+				return nil, fmt.Errorf("Unsupported RRULE WKST %q", kv[1])
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported RRULE part %q", kv[0])
+		}
+	}
+
+	if len(r.ByWeekday) > 0 && r.Frequency != "WEEKLY" {
+		return nil, fmt.Errorf("Unsupported RRULE BYDAY with FREQ=%v, BYDAY is only supported with FREQ=WEEKLY", r.Frequency)
+	}
+
+	if r.Count == 0 && len(r.Until) == 0 {
+		return nil, &ruleViolation{"open_ended_recurrence", "RRULE has neither COUNT nor UNTIL, an event that repeats forever cannot be booked"}
+	}
+
+	return r, nil
+}
+
+// parseICSEvents reads the VEVENTs of a calendar, an event that cannot be read is returned with Err set
+func parseICSEvents(data string) ([]icsEvent, error) {
+	var events []icsEvent
+	var e *icsEvent
+	var duration time.Duration
+	var hasEnd, allDay bool
+	depth := 0
+
+	for _, line := range unfoldICS(data) {
+		p, err := parseICSProperty(line)
+		if err != nil {
+			if e != nil && e.Err == nil {
+				e.Err = err
+			}
+			continue
+		}
+
+		switch {
+		case p.Name == "BEGIN" && strings.ToUpper(p.Value) == "VEVENT":
+			e, duration, hasEnd, allDay, depth = &icsEvent{}, 0, false, false, 0
+			continue
+		case p.Name == "END" && strings.ToUpper(p.Value) == "VEVENT" && e != nil:
+			if e.Err == nil && e.Start.IsZero() {
+				e.Err = errors.New("Event has no DTSTART")
+			}
+			if e.Err == nil && !hasEnd {
+				switch {
+				case duration > 0:
+					e.End = e.Start.Add(duration)
+				case allDay:
+					e.End = e.Start.AddDate(0, 0, 1)
+				default:
+					e.Err = errors.New("Event has no DTEND or DURATION")
+				}
+			}
+			events = append(events, *e)
+			e = nil
+			continue
+		case e == nil:
+			continue
+		// properties of a nested component such as VALARM do not belong to the event
+		case p.Name == "BEGIN":
+			depth++
+			continue
+		case p.Name == "END":
+			depth--
+			continue
+		case depth > 0 || e.Err != nil:
+			continue
+		}
+
+		switch p.Name {
+		case "UID":
+			e.UID = p.Value
+		case "SUMMARY":
+			e.Summary = icsUnescaper.Replace(p.Value)
+		case "ORGANIZER":
+			if strings.HasPrefix(strings.ToLower(p.Value), "mailto:") {
+				e.Organizer = p.Value[len("mailto:"):]
+			}
+		case "STATUS":
+			e.Cancelled = strings.ToUpper(p.Value) == "CANCELLED"
+		case "DTSTART":
+			e.Start, allDay, e.Err = parseICSTime(p.Value, p.Params)
+		case "DTEND":
+			e.End, _, e.Err = parseICSTime(p.Value, p.Params)
+			hasEnd = true
+		case "DURATION":
+			duration, e.Err = parseICSDuration(p.Value)
+		case "RRULE":
+			e.Recurrence, e.Err = parseRRule(p.Value)
+		case "EXDATE":
+			for _, value := range strings.Split(p.Value, ",") {
+				t, _, err := parseICSTime(value, p.Params)
+				if err != nil {
+					e.Err = err
+					break
+				}
+				e.ExDates = append(e.ExDates, t)
+			}
+		}
+	}
+
+	if e != nil {
+		return events, errors.New("Calendar ends inside a VEVENT")
+	}
+
+	return events, nil
+}
+
+// occurrences returns the start time of every occurrence of e, leaving out its EXDATEs
+func (e *icsEvent) occurrences() ([]time.Time, error) {
+	if e.Recurrence == nil {
+		return []time.Time{e.Start}, nil
+	}
+
+	starts, err := e.Recurrence.occurrences(e.Start)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := starts[:0]
+	for _, t := range starts {
+		excluded := false
+		for _, x := range e.ExDates {
+			if x.Equal(t) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, t)
+		}
+	}
+
+	return kept, nil
+}
+
+// importOwner returns the user_id and email of the account that organised an event, or those of
+// owner when the event has no organizer or no account has the organizer's email
+func importOwner(db dbtx, organizer string, owner account) (string, string, error) {
+	if len(organizer) == 0 {
+		return owner.UserID, owner.Email, nil
+	}
+
+	var userID string
+	err := db.QueryRow("SELECT user_id FROM booking.account WHERE lower(email)=lower($1) ORDER BY id LIMIT 1", organizer).Scan(&userID)
+	switch err {
+	case nil:
+		return userID, organizer, nil
+	case sql.ErrNoRows:
+		return owner.UserID, owner.Email, nil
+	default:
+		return "", "", err
+	}
+}
+
+// importICS books the events of an uploaded calendar on facilityID in one transaction. Every
+// occurrence goes through the same validation and overlap checks as a new booking, those that
+// fail are reported and the rest are booked, a recurring event becomes a booking series. A dry
+// run books them the same way, so imported events still conflict with each other, and then rolls
+// the transaction back.
+func importICS(db *sql.DB, data string, facilityID int, owner account, dryRun bool) (importReport, error) {
+	report := importReport{DryRun: dryRun, Results: []importResult{}}
+
+	events, err := parseICSEvents(data)
+	if err != nil {
+		return report, &ruleViolation{"invalid_calendar", err.Error()}
+	}
+
+	err = withTx(db, func(tx *sql.Tx) error {
+		now := time.Now()
+		for _, e := range events {
+			result := importResult{UID: e.UID, Summary: e.Summary}
+			if !e.Start.IsZero() {
+				result.StartTime, result.EndTime = e.Start.Format(time.RFC3339), e.End.Format(time.RFC3339)
+			}
+
+			if e.Err != nil {
+				result.Status, result.Message = importInvalid, e.Err.Error()
+				if v, ok := e.Err.(*ruleViolation); ok {
+					result.Rule = v.Rule
+				}
+				report.Results = append(report.Results, result)
+				continue
+			}
+
+			if e.Cancelled {
+				result.Status, result.Message = importSkipped, "Event is cancelled"
+				report.Results = append(report.Results, result)
+				continue
+			}
+
+			starts, err := e.occurrences()
+			if err != nil {
+				result.Status, result.Message = importInvalid, err.Error()
+				if v, ok := err.(*ruleViolation); ok {
+					result.Rule = v.Rule
+				}
+				report.Results = append(report.Results, result)
+				continue
+			}
+
+			userID, email, err := importOwner(tx, e.Organizer, owner)
+			if err != nil {
+				return err
+			}
+
+			// the series of a recurring event is saved with its first bookable occurrence
+			var series *bookingSeries
+			if e.Recurrence != nil {
+				series = &bookingSeries{UserID: userID, Email: email, Purpose: e.Summary, FacilityID: facilityID,
+					StartTime: e.Start.Format(time.RFC3339), EndTime: e.End.Format(time.RFC3339), Recurrence: *e.Recurrence}
+			}
+
+			for _, t := range starts {
+				b := booking{
+					UserID:     userID,
+					Email:      email,
+					Purpose:    e.Summary,
+					FacilityID: facilityID,
+					StartTime:  t.Format(time.RFC3339),
+					EndTime:    t.Add(e.End.Sub(e.Start)).Format(time.RFC3339),
+				}
+				r := result
+				r.StartTime, r.EndTime = b.StartTime, b.EndTime
+
+				err := validateBooking(tx, &b, now)
+				if err == nil {
+					err = b.checkOverlap(tx)
+				}
+
+				if isBookingConflict(err) {
+					c := newSeriesConflict(&b, err)
+					r.Status, r.Rule, r.Message = importConflict, c.Rule, c.Message
+					report.Conflicts++
+					report.Results = append(report.Results, r)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+
+				if series != nil {
+					if series.ID == 0 {
+						if err := series.createBookingSeries(tx); err != nil {
+							return err
+						}
+					}
+					b.SeriesID = series.ID
+				}
+
+				if err := b.createBooking(tx); err != nil {
+					return err
+				}
+
+				r.Status = importCreated
+				if !dryRun {
+					r.BookingID, r.SeriesID = b.ID, b.SeriesID
+				}
+				report.Created++
+				report.Results = append(report.Results, r)
+			}
+		}
+
+		if dryRun {
+			return errImportDryRun
+		}
+
+		return nil
+	})
+
+	if err == errImportDryRun {
+		err = nil
+	}
+
+	for _, r := range report.Results {
+		if r.Status == importInvalid {
+			report.Invalid++
+		}
+	}
+
+	return report, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"time"
+)
+
+// failed login attempts are counted per user and per client IP, once a key reaches its
+// threshold it is locked for lockoutBase, doubling with every further failure up to lockoutMax
+const userLockoutThreshold = 5
+const ipLockoutThreshold = 20
+const lockoutBase = time.Minute
+const lockoutMax = 24 * time.Hour
+
+// failures are forgotten once a key has been quiet for failureWindow after its last lockout
+const failureWindow = time.Hour
+
+type lockoutKey struct {
+	Key       string
+	Threshold int
+}
+
+func userLockoutKey(userID string) lockoutKey {
+	return lockoutKey{"user:" + userID, userLockoutThreshold}
+}
+
+func loginLockoutKeys(userID, ip string) []lockoutKey {
+	keys := []lockoutKey{userLockoutKey(userID)}
+	if len(ip) > 0 {
+		keys = append(keys, lockoutKey{"ip:" + ip, ipLockoutThreshold})
+	}
+
+	return keys
+}
+
+func lockoutDuration(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	d := lockoutBase
+	for i := threshold; i < failures && d < lockoutMax; i++ {
+		d *= 2
+	}
+
+	if d > lockoutMax {
+		d = lockoutMax
+	}
+
+	return d
+}
+
+// getLockedUntil returns the latest lockout end among keys, or the zero time if none is locked
+func getLockedUntil(db dbtx, keys []lockoutKey, now time.Time) (time.Time, error) {
+	var lockedUntil time.Time
+	for _, k := range keys {
+		var until sql.NullTime
+		err := db.QueryRow("SELECT locked_until_dt FROM booking.login_lockout WHERE key=$1", k.Key).Scan(&until)
+		if err != nil && err != sql.ErrNoRows {
+			return lockedUntil, err
+		}
+
+		if until.Valid && until.Time.After(now) && until.Time.After(lockedUntil) {
+			lockedUntil = until.Time
+		}
+	}
+
+	return lockedUntil, nil
+}
+
+func recordLoginFailure(db dbtx, keys []lockoutKey, now time.Time) error {
+	for _, k := range keys {
+		var failures int
+		err := db.QueryRow(
+			"INSERT INTO booking.login_lockout(key, failures, last_failure_dt) VALUES($1, 1, $2) ON CONFLICT (key) DO UPDATE SET failures = CASE WHEN login_lockout.last_failure_dt < $3 AND (login_lockout.locked_until_dt IS NULL OR login_lockout.locked_until_dt < $3) THEN 1 ELSE login_lockout.failures + 1 END, last_failure_dt = $2 RETURNING failures",
+			k.Key, now, now.Add(-failureWindow)).Scan(&failures)
+		if err != nil {
+			return err
+		}
+
+		if d := lockoutDuration(failures, k.Threshold); d > 0 {
+			if _, err := db.Exec("UPDATE booking.login_lockout SET locked_until_dt=$1 WHERE key=$2", now.Add(d), k.Key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func clearLoginFailures(db dbtx, k lockoutKey) error {
+	_, err := db.Exec("DELETE FROM booking.login_lockout WHERE key=$1", k.Key)
+
+	return err
+}
+
+func recordAuthAudit(db dbtx, userID, ip string, success bool, reason string) error {
+	_, err := db.Exec("INSERT INTO booking.auth_audit(user_id, ip, success, reason, attempt_dt) VALUES($1, $2, $3, $4, $5)",
+		userID, ip, success, reason, time.Now())
+
+	return err
+}
+
+// clientIP returns the address of the client connection, X-Forwarded-For is not trusted
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
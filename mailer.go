@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// mail is a plain text message, HTML is sent as an alternative body when set
+type mail struct {
+	To      string
+	Subject string
+	Body    string
+	HTML    string
+}
+
+// mailer delivers outgoing mail, App.Mailer picks the implementation
+type mailer interface {
+	send(m mail) error
+}
+
+// smtpMailer sends mail through an SMTP server, authenticating when a username is set
+type smtpMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *smtpMailer) send(m mail) error {
+	var auth smtp.Auth
+	if len(s.Username) > 0 {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	msg, err := m.message(s.From)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, s.From, []string{m.To}, msg)
+}
+
+// message encodes m from from as a MIME message, multipart/alternative when it has an HTML body
+func (m *mail) message(from string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %v\r\nTo: %v\r\nSubject: %v\r\nMIME-Version: 1.0\r\n",
+		headerValue(from), headerValue(m.To), headerValue(m.Subject))
+
+	if len(m.HTML) == 0 {
+		fmt.Fprintf(&buf, "Content-Type: text/plain; charset=UTF-8\r\n\r\n%v", m.Body)
+		return buf.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%v\r\n\r\n", parts.Boundary())
+
+	// the last part is the one clients prefer
+	for _, part := range []struct{ contentType, body string }{{"text/plain", m.Body}, {"text/html", m.HTML}} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + "; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// logMailer writes mail to a logger instead of sending it, for local testing
+type logMailer struct {
+	Logger *log.Logger
+}
+
+func (l *logMailer) send(m mail) error {
+	l.Logger.Printf("To: %v\nSubject: %v\n\n%v\n", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// memoryMailer keeps the mail it is given instead of sending it, for tests. Err is returned
+// instead of keeping the mail when set.
+type memoryMailer struct {
+	mu   sync.Mutex
+	sent []mail
+	Err  error
+}
+
+func (s *memoryMailer) send(m mail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Err != nil {
+		return s.Err
+	}
+
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+// messages returns the mail kept so far, oldest first
+func (s *memoryMailer) messages() []mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]mail{}, s.sent...)
+}
+
+// headerValue strips line breaks so a value cannot inject extra mail headers
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
+
+// sendMail delivers m through a.Mailer, failures are logged rather than returned
+// so that a mail outage does not fail the request that triggered it
+func (a *App) sendMail(m mail) {
+	if len(m.To) == 0 {
+		return
+	}
+
+	if err := a.Mailer.send(m); err != nil {
+		log.Printf("Failed to send mail to %v: %v", m.To, err)
+	}
+}
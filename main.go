@@ -1,8 +1,20 @@
 package main
 
-import "os"
+import (
+	"log"
+	"os"
+	"time"
+)
 
 func main() {
+	if tz := os.Getenv("APP_TIMEZONE"); len(tz) > 0 {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatal(err)
+		}
+		facilityZone = loc
+	}
+
 	a := App{}
 	a.Initialize(
 		os.Getenv("APP_DB_USERNAME"),
@@ -11,5 +23,38 @@ func main() {
 		os.Getenv("APP_DB_PORT"),
 		os.Getenv("APP_DB_NAME"))
 
+	if host := os.Getenv("APP_SMTP_HOST"); len(host) > 0 {
+		port := os.Getenv("APP_SMTP_PORT")
+		if len(port) == 0 {
+			port = "587"
+		}
+
+		a.Mailer = &smtpMailer{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("APP_SMTP_USERNAME"),
+			Password: os.Getenv("APP_SMTP_PASSWORD"),
+			From:     os.Getenv("APP_MAIL_FROM"),
+		}
+	} else if path := os.Getenv("APP_MAIL_LOG"); len(path) > 0 {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		a.Mailer = &logMailer{log.New(f, "", log.LstdFlags)}
+	}
+
+	if path := os.Getenv("APP_EVENT_LOG"); len(path) > 0 {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		a.Sinks = append(a.Sinks, &logSink{log.New(f, "", log.LstdFlags)})
+	}
+
 	a.Run(":8000")
 }
@@ -3,17 +3,28 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var a App
+var adminToken, userToken string
 
 func TestMain(m *testing.M) {
+	// the fixtures are written in UTC+8
+	facilityZone = time.FixedZone("SGT", 8*60*60)
+
 	a.Initialize(
 		"facilityadmin",
 		"faci1ityAdmin",
@@ -22,7 +33,10 @@ func TestMain(m *testing.M) {
 		"facility_booking")
 
 	ensureTableExists()
+	adminToken = addTestSession("testAdmin", true)
+	userToken = addTestSession("testUser", false)
 	code := m.Run()
+	removeTestSessions()
 	clearBookingTable()
 	resetBookingConfigRecord()
 	clearFacilityDetailTable()
@@ -42,6 +56,26 @@ const bookingTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.booking
 	CONSTRAINT booking_pkey PRIMARY KEY (id)
 )`
 
+const bookingSeriesTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.booking_series
+(
+	id SERIAL,
+	user_id text,
+	email text,
+	purpose text,
+	facility_id integer,
+	start_dt timestamptz,
+	end_dt timestamptz,
+	frequency text NOT NULL,
+	repeat_interval integer NOT NULL DEFAULT 1,
+	by_weekday text NOT NULL DEFAULT '',
+	until_dt timestamptz,
+	occurrence_count integer NOT NULL DEFAULT 0,
+	transaction_dt timestamptz,
+	CONSTRAINT booking_series_pkey PRIMARY KEY (id)
+)`
+
+const bookingSeriesColumnQuery = `ALTER TABLE booking.booking ADD COLUMN IF NOT EXISTS series_id integer REFERENCES booking.booking_series (id)`
+
 const bookingConfigTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.booking_config
 (
 	id SERIAL,
@@ -61,6 +95,179 @@ const facilityDetailTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.fac
 	CONSTRAINT facility_detail_pkey PRIMARY KEY (id)
 )`
 
+const openingHourTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.opening_hour
+(
+	id SERIAL,
+	facility_id integer NOT NULL,
+	weekday smallint NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+	open_time time NOT NULL,
+	close_time time NOT NULL,
+	CONSTRAINT opening_hour_pkey PRIMARY KEY (id)
+)`
+
+const blackoutTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.blackout
+(
+	id SERIAL,
+	facility_id integer,
+	reason text NOT NULL DEFAULT '',
+	start_dt timestamptz NOT NULL,
+	end_dt timestamptz NOT NULL,
+	transaction_dt timestamptz,
+	CONSTRAINT blackout_pkey PRIMARY KEY (id)
+)`
+
+const maintenanceWindowTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.maintenance_window
+(
+	id SERIAL,
+	facility_id integer NOT NULL,
+	reason text NOT NULL DEFAULT '',
+	start_dt timestamptz NOT NULL,
+	end_dt timestamptz NOT NULL,
+	created_by text NOT NULL DEFAULT '',
+	transaction_dt timestamptz,
+	CONSTRAINT maintenance_window_pkey PRIMARY KEY (id)
+)`
+
+const waitlistTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.waitlist
+(
+	id SERIAL,
+	user_id text,
+	email text,
+	purpose text,
+	facility_id integer NOT NULL,
+	start_dt timestamptz NOT NULL,
+	end_dt timestamptz NOT NULL,
+	status text NOT NULL DEFAULT 'waiting',
+	offer_expires_dt timestamptz,
+	booking_id integer REFERENCES booking.booking (id),
+	transaction_dt timestamptz,
+	CONSTRAINT waitlist_pkey PRIMARY KEY (id)
+)`
+
+const bookingQuotaTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.booking_quota
+(
+	id SERIAL,
+	role text UNIQUE,
+	user_id text UNIQUE,
+	max_active_bookings integer NOT NULL DEFAULT 0,
+	max_hr_per_day numeric NOT NULL DEFAULT 0,
+	max_hr_per_week numeric NOT NULL DEFAULT 0,
+	max_bookings_per_facility integer NOT NULL DEFAULT 0,
+	CONSTRAINT booking_quota_pkey PRIMARY KEY (id),
+	CONSTRAINT booking_quota_owner CHECK ((role IS NULL) <> (user_id IS NULL))
+)`
+
+// NOT VALID so that existing orphaned bookings do not block the migration, new rows are still checked
+const bookingFacilityForeignKeyQuery = `DO $$
+BEGIN
+	ALTER TABLE booking.booking ADD CONSTRAINT booking_facility_fkey
+		FOREIGN KEY (facility_id) REFERENCES booking.facility_detail (id) NOT VALID;
+EXCEPTION
+	WHEN duplicate_object THEN NULL;
+END
+$$`
+
+const bookingStatusColumnsQuery = `ALTER TABLE booking.booking
+	ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'confirmed',
+	ADD COLUMN IF NOT EXISTS cancel_reason text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS cancelled_by text NOT NULL DEFAULT ''`
+
+const bookingStatusCheckQuery = `DO $$
+BEGIN
+	ALTER TABLE booking.booking ADD CONSTRAINT booking_status_check
+		CHECK (status IN ('pending', 'confirmed', 'cancelled', 'completed', 'no_show'));
+EXCEPTION
+	WHEN duplicate_object THEN NULL;
+END
+$$`
+
+const bookingApprovalColumnsQuery = `ALTER TABLE booking.booking
+	ADD COLUMN IF NOT EXISTS decided_by text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS decision_comment text NOT NULL DEFAULT ''`
+
+const bookingCheckInColumnQuery = `ALTER TABLE booking.booking ADD COLUMN IF NOT EXISTS checked_in_dt timestamptz`
+
+const bookingHeadcountColumnQuery = `ALTER TABLE booking.booking ADD COLUMN IF NOT EXISTS headcount integer NOT NULL DEFAULT 1`
+
+const bookingAttendeeTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.booking_attendee
+(
+	id SERIAL,
+	booking_id integer NOT NULL REFERENCES booking.booking (id),
+	user_id text NOT NULL DEFAULT '',
+	email text NOT NULL DEFAULT '',
+	name text NOT NULL DEFAULT '',
+	CONSTRAINT booking_attendee_pkey PRIMARY KEY (id)
+)`
+
+const bookingSequenceColumnQuery = `ALTER TABLE booking.booking ADD COLUMN IF NOT EXISTS sequence integer NOT NULL DEFAULT 0`
+
+const bookingReminderColumnQuery = `ALTER TABLE booking.booking ADD COLUMN IF NOT EXISTS reminder_sent_dt timestamptz,
+	ADD COLUMN IF NOT EXISTS reminder_attempts integer NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS reminder_error text NOT NULL DEFAULT ''`
+
+const feedTokenTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.feed_token
+(
+	user_id text NOT NULL,
+	token_hash text NOT NULL UNIQUE,
+	transaction_dt timestamptz,
+	CONSTRAINT feed_token_pkey PRIMARY KEY (user_id)
+)`
+
+const webhookTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.webhook
+(
+	id SERIAL,
+	url text NOT NULL,
+	secret text NOT NULL,
+	events text NOT NULL,
+	active boolean NOT NULL DEFAULT true,
+	transaction_dt timestamptz,
+	CONSTRAINT webhook_pkey PRIMARY KEY (id)
+)`
+
+const webhookDeliveryTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.webhook_delivery
+(
+	id SERIAL,
+	webhook_id integer NOT NULL REFERENCES booking.webhook (id),
+	event text NOT NULL,
+	payload text NOT NULL,
+	status text NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_dt timestamptz,
+	response_code integer NOT NULL DEFAULT 0,
+	last_error text NOT NULL DEFAULT '',
+	created_dt timestamptz NOT NULL,
+	delivered_dt timestamptz,
+	CONSTRAINT webhook_delivery_pkey PRIMARY KEY (id)
+)`
+
+const outboxTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.outbox
+(
+	id BIGSERIAL,
+	event text NOT NULL,
+	payload text NOT NULL,
+	attempts integer NOT NULL DEFAULT 0,
+	last_error text NOT NULL DEFAULT '',
+	created_dt timestamptz NOT NULL,
+	dispatched_dt timestamptz,
+	CONSTRAINT outbox_pkey PRIMARY KEY (id)
+)`
+
+const outboxFailedColumnQuery = `ALTER TABLE booking.outbox ADD COLUMN IF NOT EXISTS failed_dt timestamptz`
+
+const outboxPendingIndexQuery = `CREATE INDEX IF NOT EXISTS outbox_pending ON booking.outbox (id) WHERE dispatched_dt IS NULL`
+
+const webhookDeliveryDueIndexQuery = `CREATE INDEX IF NOT EXISTS webhook_delivery_due ON booking.webhook_delivery (next_attempt_dt) WHERE status = 'pending'`
+
+const facilityCapacityColumnQuery = `ALTER TABLE booking.facility_detail ADD COLUMN IF NOT EXISTS capacity integer NOT NULL DEFAULT 0`
+
+const facilityApprovalColumnQuery = `ALTER TABLE booking.facility_detail ADD COLUMN IF NOT EXISTS requires_approval boolean NOT NULL DEFAULT false`
+
+const bookingOverlapConstraintQuery = `CREATE EXTENSION IF NOT EXISTS btree_gist;
+ALTER TABLE booking.booking DROP CONSTRAINT IF EXISTS booking_no_overlap;
+ALTER TABLE booking.booking ADD CONSTRAINT booking_no_overlap
+	EXCLUDE USING gist (facility_id WITH =, tstzrange(start_dt, end_dt) WITH &&)
+	WHERE (status IN ` + activeBookingStatuses + `)`
+
 const accountTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.account
 (
     id SERIAL,
@@ -71,11 +278,105 @@ const accountTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.account
 	CONSTRAINT account_pkey PRIMARY KEY (id)
 )`
 
+const accountActiveColumnQuery = `ALTER TABLE booking.account ADD COLUMN IF NOT EXISTS active boolean NOT NULL DEFAULT true`
+
+const accountEmailVerifiedColumnQuery = `ALTER TABLE booking.account ADD COLUMN IF NOT EXISTS email_verified boolean NOT NULL DEFAULT false`
+
+const accountTokenTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.account_token
+(
+	id SERIAL,
+	user_id text NOT NULL,
+	email text,
+	purpose text NOT NULL,
+	token_hash text NOT NULL UNIQUE,
+	expires_dt timestamptz NOT NULL,
+	used_dt timestamptz,
+	transaction_dt timestamptz,
+	CONSTRAINT account_token_pkey PRIMARY KEY (id)
+)`
+
+const loginLockoutTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.login_lockout
+(
+	key text NOT NULL,
+	failures integer NOT NULL,
+	last_failure_dt timestamptz,
+	locked_until_dt timestamptz,
+	CONSTRAINT login_lockout_pkey PRIMARY KEY (key)
+)`
+
+const authAuditTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.auth_audit
+(
+	id SERIAL,
+	user_id text,
+	ip text,
+	success boolean NOT NULL,
+	reason text,
+	attempt_dt timestamptz,
+	CONSTRAINT auth_audit_pkey PRIMARY KEY (id)
+)`
+
+const sessionTableCreationQuery = `CREATE TABLE IF NOT EXISTS booking.session
+(
+	id SERIAL,
+	user_id text NOT NULL,
+	access_token_hash text NOT NULL UNIQUE,
+	refresh_token_hash text NOT NULL UNIQUE,
+	expires_dt timestamptz NOT NULL,
+	refresh_expires_dt timestamptz NOT NULL,
+	revoked_dt timestamptz,
+	transaction_dt timestamptz,
+	CONSTRAINT session_pkey PRIMARY KEY (id)
+)`
+
 func ensureTableExists() {
 	if _, err := a.DB.Exec(bookingTableCreationQuery); err != nil {
 		log.Fatal(err)
 	}
 
+	if _, err := a.DB.Exec(bookingStatusColumnsQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingStatusCheckQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingApprovalColumnsQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingCheckInColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingHeadcountColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingAttendeeTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingSequenceColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingReminderColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingOverlapConstraintQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingSeriesTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingSeriesColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
 	if _, err := a.DB.Exec(bookingConfigTableCreationQuery); err != nil {
 		log.Fatal(err)
 	}
@@ -84,23 +385,133 @@ func ensureTableExists() {
 		log.Fatal(err)
 	}
 
+	if _, err := a.DB.Exec(facilityApprovalColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(facilityCapacityColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingFacilityForeignKeyQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(openingHourTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(blackoutTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(maintenanceWindowTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(waitlistTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(bookingQuotaTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
 	if _, err := a.DB.Exec(accountTableCreationQuery); err != nil {
 		log.Fatal(err)
 	}
+
+	if _, err := a.DB.Exec(accountActiveColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(accountEmailVerifiedColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(accountTokenTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(loginLockoutTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(authAuditTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(sessionTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(feedTokenTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(webhookTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(webhookDeliveryTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(webhookDeliveryDueIndexQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(outboxTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(outboxFailedColumnQuery); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := a.DB.Exec(outboxPendingIndexQuery); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func clearBookingTable() {
+	a.DB.Exec("DELETE FROM booking.outbox")
+	a.DB.Exec("DELETE FROM booking.waitlist")
+	a.DB.Exec("ALTER SEQUENCE booking.waitlist_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM booking.booking_attendee")
 	a.DB.Exec("DELETE FROM booking.booking")
 	a.DB.Exec("ALTER SEQUENCE booking.booking_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM booking.booking_series")
+	a.DB.Exec("ALTER SEQUENCE booking.booking_series_id_seq RESTART WITH 1")
 	a.DB.Exec("DELETE FROM booking.facility_detail")
 	a.DB.Exec("ALTER SEQUENCE booking.facility_detail_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM booking.opening_hour")
+	a.DB.Exec("DELETE FROM booking.blackout")
+	a.DB.Exec("ALTER SEQUENCE booking.blackout_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM booking.maintenance_window")
+	a.DB.Exec("ALTER SEQUENCE booking.maintenance_window_id_seq RESTART WITH 1")
+	// bookings need an existing facility, tests book facilities 1 and 2 unless they create their own
+	for i := 1; i <= 2; i++ {
+		a.DB.Exec("INSERT INTO booking.facility_detail(name, level, description, status, transaction_dt) VALUES($1, $2, $3, $4, $5)", "Meeting Room L"+strconv.Itoa(i)+"-01", i, "Meeting Room", "OPEN", "2021-01-24 10:00:00+08")
+	}
 }
 
 func clearFacilityDetailTable() {
+	a.DB.Exec("DELETE FROM booking.outbox")
+	a.DB.Exec("DELETE FROM booking.waitlist")
+	a.DB.Exec("DELETE FROM booking.booking_attendee")
+	a.DB.Exec("DELETE FROM booking.booking")
 	a.DB.Exec("DELETE FROM booking.facility_detail")
 	a.DB.Exec("ALTER SEQUENCE booking.facility_detail_id_seq RESTART WITH 1")
 }
 
+func clearWebhookTables() {
+	a.DB.Exec("DELETE FROM booking.webhook_delivery")
+	a.DB.Exec("ALTER SEQUENCE booking.webhook_delivery_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM booking.webhook")
+	a.DB.Exec("ALTER SEQUENCE booking.webhook_id_seq RESTART WITH 1")
+}
+
 func resetBookingConfigRecord() {
 	a.DB.Exec("UPDATE booking.booking_config SET key='max_hr_per_booking', value='2' WHERE id=1")
 }
@@ -153,6 +564,12 @@ func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	return rr
 }
 
+func executeRequestAs(req *http.Request, token string) *httptest.ResponseRecorder {
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return executeRequest(req)
+}
+
 func checkResponseCode(t *testing.T, expected, actual int) {
 	if expected != actual {
 		t.Errorf("Expected response code %d. Got %d\n", expected, actual)
@@ -178,11 +595,11 @@ func TestCreateBooking(t *testing.T) {
 
 	clearBookingTable()
 
-	var jsonStr = []byte(`{"user_id":"test", "email": "test@email.com", "purpose": "nil", "facility_id": 1, "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 18:00:00+08"}`)
+	var jsonStr = []byte(`{"user_id":"test", "email": "test@email.com", "purpose": "nil", "facility_id": 1, "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 12:00:00+08"}`)
 	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
 	req.Header.Set("Content-Type", "application/json")
 
-	response := executeRequest(req)
+	response := executeRequestAs(req, adminToken)
 	checkResponseCode(t, http.StatusCreated, response.Code)
 
 	var m map[string]interface{}
@@ -212,10 +629,107 @@ func TestCreateBooking(t *testing.T) {
 		t.Errorf("Expected start_dt to be '2021-01-24 10:00:00+08'. Got '%v'", m["start_dt"])
 	}
 
-	if m["end_dt"] != "2021-01-24 18:00:00+08" {
-		t.Errorf("Expected end_dt to be '2021-01-24 18:00:00+08'. Got '%v'", m["end_dt"])
+	if m["end_dt"] != "2021-01-24 12:00:00+08" {
+		t.Errorf("Expected end_dt to be '2021-01-24 12:00:00+08'. Got '%v'", m["end_dt"])
+	}
+
+}
+
+func TestCreateBookingExceedingMaxHours(t *testing.T) {
+	clearBookingTable()
+
+	var jsonStr = []byte(`{"user_id":"test", "email": "test@email.com", "purpose": "nil", "facility_id": 1, "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 18:00:00+08"}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["rule"] != "max_hr_per_booking" {
+		t.Errorf("Expected the 'rule' key of the response to be set to 'max_hr_per_booking'. Got '%s'", m["rule"])
+	}
+
+	req, _ = http.NewRequest("GET", "/bookingsCount", nil)
+	response = executeRequest(req)
+
+	var count int
+	json.Unmarshal(response.Body.Bytes(), &count)
+	if count != 0 {
+		t.Errorf("Expected the count to be 0. Got %d", count)
+	}
+}
+
+func TestCreateBookingOffSlot(t *testing.T) {
+	clearBookingTable()
+	addBookingConfig(slotGranularityMinKey, "30")
+	defer removeBookingConfig(slotGranularityMinKey)
+
+	var jsonStr = []byte(`{"user_id":"test", "email": "test@email.com", "purpose": "nil", "facility_id": 1, "start_dt": "2021-01-24 10:15:00+08", "end_dt": "2021-01-24 11:15:00+08"}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["rule"] != slotGranularityMinKey {
+		t.Errorf("Expected the 'rule' key of the response to be set to '%s'. Got '%s'", slotGranularityMinKey, m["rule"])
+	}
+}
+
+func TestBookingRules(t *testing.T) {
+	now, _ := parseBookingTime("2021-01-24 08:00:00+08")
+	rules := bookingRules{
+		MaxDuration:     2 * time.Hour,
+		MinDuration:     30 * time.Minute,
+		MinLeadTime:     time.Hour,
+		MaxAdvance:      14 * 24 * time.Hour,
+		SlotGranularity: 15 * time.Minute,
+	}
+
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		rule  string
+	}{
+		{"valid", "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08", ""},
+		{"invalid time", "24/01/2021 10am", "2021-01-24 11:00:00+08", "invalid_time"},
+		{"end before start", "2021-01-24 11:00:00+08", "2021-01-24 10:00:00+08", "invalid_interval"},
+		{"empty", "2021-01-24 10:00:00+08", "2021-01-24 10:00:00+08", "invalid_interval"},
+		{"too long", "2021-01-24 10:00:00+08", "2021-01-24 12:15:00+08", maxHrPerBookingKey},
+		{"too short", "2021-01-24 10:00:00+08", "2021-01-24 10:15:00+08", minMinPerBookingKey},
+		{"too soon", "2021-01-24 08:30:00+08", "2021-01-24 09:30:00+08", minLeadTimeMinKey},
+		{"too far ahead", "2021-02-24 10:00:00+08", "2021-02-24 11:00:00+08", maxAdvanceDayKey},
+		{"off slot", "2021-01-24 10:05:00+08", "2021-01-24 11:05:00+08", slotGranularityMinKey},
+	}
+
+	for _, tt := range tests {
+		p := booking{StartTime: tt.start, EndTime: tt.end}
+		err := rules.validate(&p, now)
+
+		rule := ""
+		if v, ok := err.(*ruleViolation); ok {
+			rule = v.Rule
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+
+		if rule != tt.rule {
+			t.Errorf("%s: expected rule '%s'. Got '%s'", tt.name, tt.rule, rule)
+		}
 	}
+}
+
+func addBookingConfig(key, value string) {
+	a.DB.Exec("INSERT INTO booking.booking_config(key, value) VALUES($1, $2)", key, value)
+}
 
+func removeBookingConfig(key string) {
+	a.DB.Exec("DELETE FROM booking.booking_config WHERE key=$1", key)
 }
 
 func addBookings(count int) {
@@ -248,11 +762,11 @@ func TestUpdateBooking(t *testing.T) {
 	var originalBooking map[string]interface{}
 	json.Unmarshal(response.Body.Bytes(), &originalBooking)
 
-	var jsonStr = []byte(`{"user_id":"updated", "email": "updated@email.com", "purpose": "updated", "facility_id": 2, "start_dt": "2021-01-24 11:00:00+08", "end_dt": "2021-01-24 17:00:00+08"}`)
+	var jsonStr = []byte(`{"user_id":"updated", "email": "updated@email.com", "purpose": "updated", "facility_id": 2, "start_dt": "2021-01-24 11:00:00+08", "end_dt": "2021-01-24 13:00:00+08"}`)
 	req, _ = http.NewRequest("PUT", "/booking/1", bytes.NewBuffer(jsonStr))
 	req.Header.Set("Content-Type", "application/json")
 
-	response = executeRequest(req)
+	response = executeRequestAs(req, adminToken)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
@@ -279,8 +793,8 @@ func TestUpdateBooking(t *testing.T) {
 		t.Errorf("Expected the user_id to change from '%v' to '2021-01-24 11:00:00+08'. Got '%v'", originalBooking["start_dt"], m["start_dt"])
 	}
 
-	if m["end_dt"] != "2021-01-24 17:00:00+08" {
-		t.Errorf("Expected the email to change from '%v' to '2021-01-24 17:00:00+08'. Got '%v'", originalBooking["end_dt"], m["end_dt"])
+	if m["end_dt"] != "2021-01-24 13:00:00+08" {
+		t.Errorf("Expected the email to change from '%v' to '2021-01-24 13:00:00+08'. Got '%v'", originalBooking["end_dt"], m["end_dt"])
 	}
 
 	if m["id"] != originalBooking["id"] {
@@ -288,25 +802,189 @@ func TestUpdateBooking(t *testing.T) {
 	}
 }
 
-func TestDeleteBooking(t *testing.T) {
+func TestUpdateBookingOverlap(t *testing.T) {
 	clearBookingTable()
-	addBookings(1)
-
-	req, _ := http.NewRequest("GET", "/booking/1", nil)
-	response := executeRequest(req)
-	checkResponseCode(t, http.StatusOK, response.Code)
+	addBooking("user_1", 1, "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08")
+	addBooking("user_2", 1, "2021-01-24 12:00:00+08", "2021-01-24 13:00:00+08")
+	addBooking("user_3", 2, "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08")
+
+	tests := []struct {
+		id      string
+		payload string
+		code    int
+	}{
+		{"2", `{"user_id":"user_2", "facility_id": 1, "start_dt": "2021-01-24 10:30:00+08", "end_dt": "2021-01-24 11:30:00+08"}`, http.StatusConflict},
+		{"1", `{"user_id":"user_1", "facility_id": 1, "start_dt": "2021-01-24 10:30:00+08", "end_dt": "2021-01-24 11:30:00+08"}`, http.StatusOK},
+		{"2", `{"user_id":"user_2", "facility_id": 2, "start_dt": "2021-01-24 10:30:00+08", "end_dt": "2021-01-24 11:30:00+08"}`, http.StatusConflict},
+		{"2", `{"user_id":"user_2", "facility_id": 2, "start_dt": "2021-01-24 11:00:00+08", "end_dt": "2021-01-24 12:00:00+08"}`, http.StatusOK},
+	}
 
-	req, _ = http.NewRequest("DELETE", "/booking/1", nil)
-	response = executeRequest(req)
+	for _, tt := range tests {
+		req, _ := http.NewRequest("PUT", "/booking/"+tt.id, bytes.NewBuffer([]byte(tt.payload)))
+		req.Header.Set("Content-Type", "application/json")
+		response := executeRequestAs(req, adminToken)
 
-	checkResponseCode(t, http.StatusOK, response.Code)
+		checkResponseCode(t, tt.code, response.Code)
 
-	req, _ = http.NewRequest("GET", "/booking/1", nil)
-	response = executeRequest(req)
-	checkResponseCode(t, http.StatusNotFound, response.Code)
+		if tt.code != http.StatusOK {
+			var m map[string]string
+			json.Unmarshal(response.Body.Bytes(), &m)
+			if m["error"] != "Overlap Bookings" {
+				t.Errorf("Expected the 'error' key of the response to be set to 'Overlap Bookings'. Got '%s'", m["error"])
+			}
+		}
+	}
 }
 
-func TestGetBookingConfigs(t *testing.T) {
+func TestOverlappingBookings(t *testing.T) {
+	clearBookingTable()
+	addBooking("user_1", 1, "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08")
+	existingStart, _ := parseBookingTime("2021-01-24 10:00:00+08")
+	existingEnd, _ := parseBookingTime("2021-01-24 11:00:00+08")
+
+	tests := []struct {
+		name     string
+		facility int
+		start    string
+		end      string
+		overlap  bool
+	}{
+		{"before", 1, "2021-01-24 08:00:00+08", "2021-01-24 09:00:00+08", false},
+		{"meets", 1, "2021-01-24 09:00:00+08", "2021-01-24 10:00:00+08", false},
+		{"overlaps", 1, "2021-01-24 09:30:00+08", "2021-01-24 10:30:00+08", true},
+		{"starts", 1, "2021-01-24 10:00:00+08", "2021-01-24 10:30:00+08", true},
+		{"during", 1, "2021-01-24 10:15:00+08", "2021-01-24 10:45:00+08", true},
+		{"finishes", 1, "2021-01-24 10:30:00+08", "2021-01-24 11:00:00+08", true},
+		{"equals", 1, "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08", true},
+		{"contains", 1, "2021-01-24 09:00:00+08", "2021-01-24 17:00:00+08", true},
+		{"started by", 1, "2021-01-24 10:00:00+08", "2021-01-24 12:00:00+08", true},
+		{"finished by", 1, "2021-01-24 09:00:00+08", "2021-01-24 11:00:00+08", true},
+		{"overlapped by", 1, "2021-01-24 10:30:00+08", "2021-01-24 11:30:00+08", true},
+		{"met by", 1, "2021-01-24 11:00:00+08", "2021-01-24 12:00:00+08", false},
+		{"after", 1, "2021-01-24 12:00:00+08", "2021-01-24 13:00:00+08", false},
+		{"other time zone", 1, "2021-01-24 02:30:00Z", "2021-01-24 03:30:00Z", true},
+		{"other facility", 2, "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08", false},
+	}
+
+	for _, tt := range tests {
+		p := booking{FacilityID: tt.facility, StartTime: tt.start, EndTime: tt.end}
+
+		count, err := p.getOverlappingBookings(a.DB)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+
+		if (count > 0) != tt.overlap {
+			t.Errorf("%s: expected overlap to be %v. Got %d overlapping bookings", tt.name, tt.overlap, count)
+		}
+
+		start, end, _ := p.interval()
+		if p.FacilityID == 1 && overlaps(start, end, existingStart, existingEnd) != tt.overlap {
+			t.Errorf("%s: expected overlaps() to be %v", tt.name, tt.overlap)
+		}
+	}
+}
+
+func TestCreateBookingContainingExistingBooking(t *testing.T) {
+	clearBookingTable()
+	addBooking("user_1", 1, "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08")
+
+	var jsonStr = []byte(`{"user_id":"test", "facility_id": 1, "start_dt": "2021-01-24 09:30:00+08", "end_dt": "2021-01-24 11:30:00+08"}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestCreateBookingEndingBeforeStart(t *testing.T) {
+	clearBookingTable()
+
+	var jsonStr = []byte(`{"user_id":"test", "facility_id": 1, "start_dt": "2021-01-24 11:00:00+08", "end_dt": "2021-01-24 10:00:00+08"}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	req.Header.Set("Content-Type", "application/json")
+
+	response := executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["rule"] != "invalid_interval" {
+		t.Errorf("Expected the 'rule' key of the response to be set to 'invalid_interval'. Got '%s'", m["rule"])
+	}
+}
+
+func TestCreateBookingConcurrently(t *testing.T) {
+	clearBookingTable()
+
+	const requests = 10
+	codes := make(chan int, requests)
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var jsonStr = []byte(`{"user_id":"user_` + strconv.Itoa(i) + `", "facility_id": 1, "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08"}`)
+			req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+			req.Header.Set("Content-Type", "application/json")
+			codes <- executeRequestAs(req, adminToken).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	created, conflicts := 0, 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+			conflicts++
+		default:
+			t.Errorf("Expected response code %d or %d. Got %d", http.StatusCreated, http.StatusConflict, code)
+		}
+	}
+
+	if created != 1 || conflicts != requests-1 {
+		t.Errorf("Expected 1 created and %d conflicts. Got %d created and %d conflicts", requests-1, created, conflicts)
+	}
+}
+
+func addBooking(userID string, facilityID int, start, end string) {
+	a.DB.Exec("INSERT INTO booking.booking(user_id, email, purpose, facility_id, start_dt, end_dt, transaction_dt) VALUES($1, $2, $3, $4, $5, $6, $7)", userID, userID+"@email", "nil", facilityID, start, end, "2021-01-24 10:00:00+08")
+}
+
+func TestDeleteBooking(t *testing.T) {
+	clearBookingTable()
+	addBookings(1)
+
+	req, _ := http.NewRequest("GET", "/booking/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/booking/1?reason=No+longer+needed", nil)
+	response = executeRequestAs(req, adminToken)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/booking/1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["status"] != "cancelled" || m["cancel_reason"] != "No longer needed" || m["cancelled_by"] != "testAdmin" {
+		t.Errorf("Expected the booking to be cancelled by testAdmin. Got %v", m)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/booking/1", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+func TestGetBookingConfigs(t *testing.T) {
 
 	req, _ := http.NewRequest("GET", "/bookingConfigs", nil)
 	response := executeRequest(req)
@@ -353,7 +1031,7 @@ func TestUpdateBookingConfig(t *testing.T) {
 	req, _ = http.NewRequest("PUT", "/bookingConfig/1", bytes.NewBuffer(jsonStr))
 	req.Header.Set("Content-Type", "application/json")
 
-	response = executeRequest(req)
+	response = executeRequestAs(req, adminToken)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
@@ -371,6 +1049,17 @@ func TestUpdateBookingConfig(t *testing.T) {
 	if m["id"] != originalBookingConfig["id"] {
 		t.Errorf("Expected the id to remain the same (%v). Got %v", originalBookingConfig["id"], m["id"])
 	}
+
+	// a value the booking rules cannot read is rejected instead of breaking every booking
+	for _, value := range []string{"two", "-1", ""} {
+		req, _ = http.NewRequest("PUT", "/bookingConfig/1", bytes.NewBuffer([]byte(`{"key":"max_hr_per_booking", "value": "`+value+`"}`)))
+		response = executeRequestAs(req, adminToken)
+		checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	}
+
+	if err := checkBookingConfig("max_hr_per_booking", "1.5"); err != nil {
+		t.Errorf("Expected a fractional value to be accepted. Got %v", err)
+	}
 }
 
 func TestEmptyFacilityDetailTable(t *testing.T) {
@@ -447,7 +1136,7 @@ func TestCreateFacilityDetail(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/facilityDetail", bytes.NewBuffer(jsonStr))
 	req.Header.Set("Content-Type", "application/json")
 
-	response := executeRequest(req)
+	response := executeRequestAs(req, adminToken)
 	checkResponseCode(t, http.StatusCreated, response.Code)
 
 	var m map[string]interface{}
@@ -509,7 +1198,7 @@ func TestUpdateFacilityDetail(t *testing.T) {
 	req, _ = http.NewRequest("PUT", "/facilityDetail/1", bytes.NewBuffer(jsonStr))
 	req.Header.Set("Content-Type", "application/json")
 
-	response = executeRequest(req)
+	response = executeRequestAs(req, adminToken)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
@@ -535,6 +1224,12 @@ func TestUpdateFacilityDetail(t *testing.T) {
 	if m["id"] != originalFacilityDetail["id"] {
 		t.Errorf("Expected the id to remain the same (%v). Got %v", originalFacilityDetail["id"], m["id"])
 	}
+
+	// archiving through PUT would skip cancelling the facility's bookings
+	jsonStr = []byte(`{"name":"Meeting Room L1-01", "level": "1", "description": "Meeting Rm", "status": "ARCHIVED"}`)
+	req, _ = http.NewRequest("PUT", "/facilityDetail/1", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
 }
 
 func TestDeleteFacilityDetail(t *testing.T) {
@@ -551,18 +1246,54 @@ func TestDeleteFacilityDetail(t *testing.T) {
 	response = executeRequest(req)
 	checkResponseCode(t, http.StatusOK, response.Code)
 
+	future := time.Now().AddDate(0, 0, 7).Format(time.RFC3339)
+	addBooking("futureUser", 1, future, future)
+	buf, restore := captureMail()
+	defer restore()
+
 	req, _ = http.NewRequest("DELETE", "/facilityDetail/1", nil)
-	response = executeRequest(req)
+	response = executeRequestAs(req, adminToken)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
 	req, _ = http.NewRequest("GET", "/facilityDetail/1", nil)
 	response = executeRequest(req)
-	checkResponseCode(t, http.StatusNotFound, response.Code)
+	checkResponseCode(t, http.StatusOK, response.Code)
 
-	req, _ = http.NewRequest("GET", "/booking/1", nil)
-	response = executeRequest(req)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["status"] != "ARCHIVED" {
+		t.Errorf("Expected the facility to be archived. Got '%v'", m["status"])
+	}
+
+	for id, status := range map[string]string{"1": "confirmed", "2": "cancelled"} {
+		req, _ = http.NewRequest("GET", "/booking/"+id, nil)
+		response = executeRequest(req)
+		var b booking
+		json.Unmarshal(response.Body.Bytes(), &b)
+		if b.Status != status {
+			t.Errorf("Expected booking %s to be %s. Got '%v'", id, status, b.Status)
+		}
+	}
+
+	if !strings.Contains(buf.String(), "To: futureUser@email") || strings.Contains(buf.String(), "To: user_0@email") {
+		t.Errorf("Expected only the owner of the future booking to be notified. Got '%s'", buf.String())
+	}
+
+	var jsonStr = []byte(`{"facility_id": 1, "purpose": "archived", "start_dt": "2021-01-24 14:00:00+08", "end_dt": "2021-01-24 15:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/facilityDetail/99", nil)
+	response = executeRequestAs(req, adminToken)
 	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	// an archived facility cannot be reopened through PUT
+	jsonStr = []byte(`{"name":"Meeting Room L1-01", "level": "1", "description": "Meeting Room", "status": "OPEN"}`)
+	req, _ = http.NewRequest("PUT", "/facilityDetail/1", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
 }
 
 func TestGetBookingsCount(t *testing.T) {
@@ -663,16 +1394,37 @@ func addTestAccount() {
 }
 
 func removeTestAccount() {
+	a.DB.Exec("DELETE FROM booking.login_lockout WHERE key IN ('user:testAccount', 'user:wrongAccount', 'ip:192.0.2.1')")
+	a.DB.Exec("DELETE FROM booking.auth_audit WHERE user_id IN ('testAccount', 'wrongAccount')")
+	a.DB.Exec("DELETE FROM booking.account_token WHERE user_id=$1", "testAccount")
+	a.DB.Exec("DELETE FROM booking.session WHERE user_id=$1", "testAccount")
 	a.DB.Exec("DELETE FROM booking.account WHERE user_id=$1", "testAccount")
 }
 
+func addTestSession(userID string, admin bool) string {
+	a.DB.Exec("INSERT INTO booking.account(user_id, admin, email, password) VALUES ($1, $2, $3, crypt($4, gen_salt('bf'))) ON CONFLICT (user_id) DO NOTHING", userID, admin, userID+"@mail.com", "TestAccountPassword")
+
+	s, err := createSession(a.DB, account{UserID: userID, Admin: admin, Email: userID + "@mail.com"})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return s.AccessToken
+}
+
+func removeTestSessions() {
+	a.DB.Exec("DELETE FROM booking.session WHERE user_id IN ('testAdmin', 'testUser')")
+	a.DB.Exec("DELETE FROM booking.feed_token WHERE user_id IN ('testAdmin', 'testUser')")
+	a.DB.Exec("DELETE FROM booking.account WHERE user_id IN ('testAdmin', 'testUser')")
+}
+
 func TestLogin(t *testing.T) {
 	addTestAccount()
 
 	var jsonStr = []byte(`{"user_id":"testAccount", "password": "wrongpassword"}`)
 	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(jsonStr))
 	response := executeRequest(req)
-	checkResponseCode(t, http.StatusOK, response.Code)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
 	var m map[string]interface{}
 	json.Unmarshal(response.Body.Bytes(), &m)
 	if m["error"] != "Login failed" {
@@ -682,7 +1434,7 @@ func TestLogin(t *testing.T) {
 	jsonStr = []byte(`{"user_id":"wrongAccount", "password": "TestAccountPassword"}`)
 	req, _ = http.NewRequest("POST", "/login", bytes.NewBuffer(jsonStr))
 	response = executeRequest(req)
-	checkResponseCode(t, http.StatusOK, response.Code)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
 	json.Unmarshal(response.Body.Bytes(), &m)
 	if m["error"] != "Login failed" {
 		t.Errorf("Expected the error to be 'Login failed'. Got '%v'", m["error"])
@@ -706,5 +1458,2239 @@ func TestLogin(t *testing.T) {
 		t.Errorf("Expected the email to be testAccount@mail.com. Got '%v'", m["email"])
 	}
 
+	if token, _ := m["access_token"].(string); len(token) == 0 {
+		t.Errorf("Expected an access_token. Got '%v'", m["access_token"])
+	}
+
+	if token, _ := m["refresh_token"].(string); len(token) == 0 {
+		t.Errorf("Expected a refresh_token. Got '%v'", m["refresh_token"])
+	}
+
 	removeTestAccount()
 }
+
+func loginAs(userID, password string) map[string]interface{} {
+	var jsonStr = []byte(`{"user_id":"` + userID + `", "password": "` + password + `"}`)
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	return m
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	addTestAccount()
+	defer removeTestAccount()
+
+	m := loginAs("testAccount", "TestAccountPassword")
+
+	req, _ := http.NewRequest("GET", "/bookings", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	var jsonStr = []byte(`{"refresh_token":"` + m["refresh_token"].(string) + `"}`)
+	req, _ = http.NewRequest("POST", "/refresh", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var refreshed map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &refreshed)
+	if refreshed["user_id"] != "testAccount" {
+		t.Errorf("Expected the user_id to be testAccount. Got '%v'", refreshed["user_id"])
+	}
+
+	if refreshed["access_token"] == m["access_token"] {
+		t.Errorf("Expected a new access_token. Got '%v'", refreshed["access_token"])
+	}
+
+	req, _ = http.NewRequest("POST", "/refresh", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	req, _ = http.NewRequest("POST", "/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+m["access_token"].(string))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	req, _ = http.NewRequest("POST", "/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshed["access_token"].(string))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshed["access_token"].(string))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestAuthorization(t *testing.T) {
+	clearBookingTable()
+	addFacilityDetail(1)
+	addBooking("testAdmin", 1, "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08")
+	addBooking("testUser", 1, "2021-01-24 12:00:00+08", "2021-01-24 13:00:00+08")
+	addBooking("testUser", 1, "2021-01-24 18:00:00+08", "2021-01-24 19:00:00+08")
+
+	const anonymous, user, admin = 1, 2, 4
+
+	tests := []struct {
+		method  string
+		path    string
+		body    string
+		allowed int
+	}{
+		{"GET", "/bookings", "", anonymous | user | admin},
+		{"GET", "/bookingsCount", "", anonymous | user | admin},
+		{"GET", "/booking/1", "", anonymous | user | admin},
+		{"POST", "/booking", `{"user_id":"testAdmin", "facility_id": 1, "start_dt": "2021-01-24 14:00:00+08", "end_dt": "2021-01-24 15:00:00+08"}`, admin},
+		{"POST", "/booking", `{"user_id":"testUser", "facility_id": 1, "start_dt": "2021-01-24 15:00:00+08", "end_dt": "2021-01-24 16:00:00+08"}`, user | admin},
+		{"PUT", "/booking/1", `{"facility_id": 1, "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08"}`, admin},
+		{"PUT", "/booking/2", `{"facility_id": 1, "start_dt": "2021-01-24 12:00:00+08", "end_dt": "2021-01-24 13:00:00+08"}`, user | admin},
+		{"PUT", "/booking/3", `{"user_id":"someoneElse", "facility_id": 1, "start_dt": "2021-01-24 18:00:00+08", "end_dt": "2021-01-24 19:00:00+08"}`, admin},
+		{"GET", "/bookingConfigs", "", anonymous | user | admin},
+		{"GET", "/bookingConfigsCount", "", anonymous | user | admin},
+		{"GET", "/bookingConfig/1", "", anonymous | user | admin},
+		{"PUT", "/bookingConfig/1", `{"key":"max_hr_per_booking", "value": "2"}`, admin},
+		{"GET", "/facilityDetails", "", anonymous | user | admin},
+		{"GET", "/facilityDetailsCount", "", anonymous | user | admin},
+		{"GET", "/facilityDetail/1", "", anonymous | user | admin},
+		{"POST", "/facilityDetail", `{"name":"Meeting Room L2-01", "level": "2", "description": "Meeting Room", "status": "OPEN"}`, admin},
+		{"PUT", "/facilityDetail/1", `{"name":"Meeting Room L0", "level": "0", "description": "Meeting Room", "status": "OPEN"}`, admin},
+		{"DELETE", "/booking/1", "", admin},
+		{"DELETE", "/booking/2", "", user | admin},
+		{"DELETE", "/facilityDetail/2", "", admin},
+	}
+
+	for _, tt := range tests {
+		for _, role := range []int{anonymous, user, admin} {
+			req, _ := http.NewRequest(tt.method, tt.path, bytes.NewBuffer([]byte(tt.body)))
+			req.Header.Set("Content-Type", "application/json")
+
+			var response *httptest.ResponseRecorder
+			switch role {
+			case anonymous:
+				response = executeRequest(req)
+			case user:
+				response = executeRequestAs(req, userToken)
+			case admin:
+				response = executeRequestAs(req, adminToken)
+			}
+
+			denied := response.Code == http.StatusUnauthorized || response.Code == http.StatusForbidden
+			if tt.allowed&role != 0 && denied {
+				t.Errorf("%s %s: expected role %d to be allowed. Got %d", tt.method, tt.path, role, response.Code)
+			}
+
+			if tt.allowed&role == 0 {
+				expected := http.StatusForbidden
+				if role == anonymous {
+					expected = http.StatusUnauthorized
+				}
+
+				if response.Code != expected {
+					t.Errorf("%s %s: expected role %d to get %d. Got %d", tt.method, tt.path, role, expected, response.Code)
+				}
+			}
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	for _, path := range []string{"/accounts", "/accountsCount", "/webhooks", "/bookingQuotas", "/noShowCounts"} {
+		req, _ := http.NewRequest("OPTIONS", path, nil)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response.Code)
+		if response.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("Expected %s to allow cross-origin requests. Got %v", path, response.Header())
+		}
+	}
+}
+
+func TestAccountManagement(t *testing.T) {
+	defer func() {
+		a.DB.Exec("DELETE FROM booking.session WHERE user_id=$1", "managedAccount")
+		a.DB.Exec("DELETE FROM booking.account WHERE user_id=$1", "managedAccount")
+	}()
+
+	var jsonStr = []byte(`{"user_id":"managedAccount", "email": "managed@mail.com", "password": "ManagedPassword"}`)
+	req, _ := http.NewRequest("POST", "/account", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/account", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var created map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if created["admin"] != false || created["active"] != true {
+		t.Errorf("Expected an active non-admin account. Got '%v'", created)
+	}
+	id := strconv.Itoa(int(created["id"].(float64)))
+
+	req, _ = http.NewRequest("POST", "/account", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("GET", "/account/"+id, nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	m := loginAs("managedAccount", "ManagedPassword")
+	token, _ := m["access_token"].(string)
+	if len(token) == 0 {
+		t.Fatalf("Expected the new account to be able to login. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/me", nil)
+	response = executeRequestAs(req, token)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["user_id"] != "managedAccount" {
+		t.Errorf("Expected the user_id to be managedAccount. Got '%v'", m["user_id"])
+	}
+
+	jsonStr = []byte(`{"email": "changed@mail.com", "password": "ChangedPassword", "current_password": "wrong"}`)
+	req, _ = http.NewRequest("PUT", "/me", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, token)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	jsonStr = []byte(`{"email": "changed@mail.com", "password": "ChangedPassword", "current_password": "ManagedPassword"}`)
+	req, _ = http.NewRequest("PUT", "/me", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, token)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["email"] != "changed@mail.com" {
+		t.Errorf("Expected the email to be changed@mail.com. Got '%v'", m["email"])
+	}
+
+	if m = loginAs("managedAccount", "ChangedPassword"); m["user_id"] != "managedAccount" {
+		t.Errorf("Expected login with the new password to succeed. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/account/"+id, nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if m = loginAs("managedAccount", "ChangedPassword"); m["error"] != "Login failed" {
+		t.Errorf("Expected login of a deactivated account to fail. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/me", nil)
+	response = executeRequestAs(req, token)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	jsonStr = []byte(`{"active": true}`)
+	req, _ = http.NewRequest("PUT", "/account/"+id, bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if m = loginAs("managedAccount", "ChangedPassword"); m["user_id"] != "managedAccount" {
+		t.Errorf("Expected login of a reactivated account to succeed. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/accounts", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("GET", "/accounts?count=100", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var accounts []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &accounts)
+	found := false
+	for _, account := range accounts {
+		if account["user_id"] == "managedAccount" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("Expected managedAccount to be listed. Got '%v'", accounts)
+	}
+}
+
+// captureMail redirects outgoing mail into the returned buffer until restore is called
+func captureMail() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	previous := a.Mailer
+	a.Mailer = &logMailer{log.New(&buf, "", 0)}
+
+	return &buf, func() { a.Mailer = previous }
+}
+
+func mailedToken(buf *bytes.Buffer) string {
+	m := regexp.MustCompile(`token is: (\S+)`).FindStringSubmatch(buf.String())
+	if m == nil {
+		return ""
+	}
+
+	return m[1]
+}
+
+func TestPasswordReset(t *testing.T) {
+	addTestAccount()
+	defer removeTestAccount()
+	buf, restore := captureMail()
+	defer restore()
+
+	before := loginAs("testAccount", "TestAccountPassword")
+
+	var jsonStr = []byte(`{"user_id":"testAccount"}`)
+	req, _ := http.NewRequest("POST", "/passwordResetRequest", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	token := mailedToken(buf)
+	if len(token) == 0 {
+		t.Fatalf("Expected a password reset mail. Got '%s'", buf.String())
+	}
+
+	jsonStr = []byte(`{"user_id":"noSuchAccount"}`)
+	req, _ = http.NewRequest("POST", "/passwordResetRequest", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	jsonStr = []byte(`{"token":"` + token + `", "password": "ResetPassword"}`)
+	req, _ = http.NewRequest("POST", "/passwordReset", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/passwordReset", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	if m := loginAs("testAccount", "TestAccountPassword"); m["error"] != "Login failed" {
+		t.Errorf("Expected login with the old password to fail. Got '%v'", m)
+	}
+
+	if m := loginAs("testAccount", "ResetPassword"); m["user_id"] != "testAccount" {
+		t.Errorf("Expected login with the new password to succeed. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/me", nil)
+	response = executeRequestAs(req, before["access_token"].(string))
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestEmailVerification(t *testing.T) {
+	addTestAccount()
+	defer removeTestAccount()
+	buf, restore := captureMail()
+	defer restore()
+
+	m := loginAs("testAccount", "TestAccountPassword")
+	if m["email_verified"] != false {
+		t.Errorf("Expected email_verified to be false. Got '%v'", m["email_verified"])
+	}
+	token := m["access_token"].(string)
+
+	req, _ := http.NewRequest("POST", "/me/emailVerificationRequest", nil)
+	response := executeRequestAs(req, token)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	verificationToken := mailedToken(buf)
+	if len(verificationToken) == 0 {
+		t.Fatalf("Expected a verification mail. Got '%s'", buf.String())
+	}
+
+	var jsonStr = []byte(`{"token":"` + verificationToken + `"}`)
+	req, _ = http.NewRequest("POST", "/emailVerification", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/me", nil)
+	response = executeRequestAs(req, token)
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["email_verified"] != true {
+		t.Errorf("Expected email_verified to be true. Got '%v'", m["email_verified"])
+	}
+
+	jsonStr = []byte(`{"email":"changed@mail.com"}`)
+	req, _ = http.NewRequest("PUT", "/me", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, token)
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["email_verified"] != false {
+		t.Errorf("Expected email_verified to be reset by an email change. Got '%v'", m["email_verified"])
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	addTestAccount()
+	defer removeTestAccount()
+
+	var wrongPassword = []byte(`{"user_id":"testAccount", "password": "wrongpassword"}`)
+	for i := 0; i < userLockoutThreshold; i++ {
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(wrongPassword))
+		req.RemoteAddr = "192.0.2.1:1234"
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	}
+
+	var rightPassword = []byte(`{"user_id":"testAccount", "password": "TestAccountPassword"}`)
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(rightPassword))
+	req.RemoteAddr = "192.0.2.1:1234"
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+
+	if response.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+
+	var count int
+	a.DB.QueryRow("SELECT COUNT (id) FROM booking.auth_audit WHERE user_id='testAccount' AND ip='192.0.2.1'").Scan(&count)
+	if count != userLockoutThreshold+1 {
+		t.Errorf("Expected %d audited attempts. Got %d", userLockoutThreshold+1, count)
+	}
+
+	var id int
+	a.DB.QueryRow("SELECT id FROM booking.account WHERE user_id='testAccount'").Scan(&id)
+
+	req, _ = http.NewRequest("POST", "/account/"+strconv.Itoa(id)+"/unlock", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/account/"+strconv.Itoa(id)+"/unlock", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/login", bytes.NewBuffer(rightPassword))
+	req.RemoteAddr = "192.0.2.1:1234"
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{userLockoutThreshold - 1, 0},
+		{userLockoutThreshold, lockoutBase},
+		{userLockoutThreshold + 1, 2 * lockoutBase},
+		{userLockoutThreshold + 3, 8 * lockoutBase},
+		{userLockoutThreshold + 30, lockoutMax},
+	}
+
+	for _, tt := range tests {
+		if d := lockoutDuration(tt.failures, userLockoutThreshold); d != tt.expected {
+			t.Errorf("Expected %d failures to lock for %v. Got %v", tt.failures, tt.expected, d)
+		}
+	}
+}
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	monday, _ := parseBookingTime("2021-01-25 10:00:00+08")
+	lastOfMonth, _ := parseBookingTime("2021-01-31 10:00:00+08")
+
+	tests := []struct {
+		name     string
+		start    time.Time
+		rule     recurrence
+		expected []string
+	}{
+		{"daily", monday, recurrence{Frequency: "DAILY", Count: 3}, []string{"2021-01-25", "2021-01-26", "2021-01-27"}},
+		{"every other day", monday, recurrence{Frequency: "DAILY", Interval: 2, Count: 3}, []string{"2021-01-25", "2021-01-27", "2021-01-29"}},
+		{"weekly", monday, recurrence{Frequency: "WEEKLY", Count: 3}, []string{"2021-01-25", "2021-02-01", "2021-02-08"}},
+		{"weekly by weekday", monday, recurrence{Frequency: "WEEKLY", ByWeekday: []string{"FR", "MO", "WE"}, Count: 4}, []string{"2021-01-25", "2021-01-27", "2021-01-29", "2021-02-01"}},
+		{"weekly until", monday, recurrence{Frequency: "weekly", ByWeekday: []string{"TU"}, Until: "2021-02-09"}, []string{"2021-01-26", "2021-02-02", "2021-02-09"}},
+		{"monthly skips short months", lastOfMonth, recurrence{Frequency: "MONTHLY", Count: 3}, []string{"2021-01-31", "2021-03-31", "2021-05-31"}},
+		{"no end", monday, recurrence{Frequency: "DAILY"}, nil},
+		{"too many", monday, recurrence{Frequency: "DAILY", Until: "2022-01-01"}, nil},
+		{"unknown frequency", monday, recurrence{Frequency: "YEARLY", Count: 2}, nil},
+		{"unknown weekday", monday, recurrence{Frequency: "WEEKLY", ByWeekday: []string{"XX"}, Count: 2}, nil},
+	}
+
+	for _, tt := range tests {
+		times, err := tt.rule.occurrences(tt.start)
+		if tt.expected == nil {
+			if _, ok := err.(*ruleViolation); !ok {
+				t.Errorf("%s: expected a rule violation. Got %v", tt.name, err)
+			}
+			continue
+		}
+
+		var dates []string
+		for _, d := range times {
+			dates = append(dates, d.Format("2006-01-02"))
+		}
+
+		if strings.Join(dates, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("%s: expected %v. Got %v", tt.name, tt.expected, dates)
+		}
+	}
+}
+
+func TestMoveWallClock(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	zone := facilityZone
+	facilityZone = newYork
+	defer func() { facilityZone = zone }()
+
+	// moved from 10:00 to 12:00 the week before daylight saving time starts
+	oldStart := time.Date(2021, 3, 8, 10, 0, 0, 0, newYork)
+	newStart := time.Date(2021, 3, 8, 12, 0, 0, 0, newYork)
+	offset := wallClock(newStart).Sub(wallClock(oldStart))
+
+	moved := moveWallClock(time.Date(2021, 3, 15, 10, 0, 0, 0, newYork), offset)
+	if moved.Format("2006-01-02 15:04 -0700") != "2021-03-15 12:00 -0400" {
+		t.Errorf("Expected the occurrence after the change to stay at 12:00. Got %v", moved)
+	}
+}
+
+func TestBookingSeries(t *testing.T) {
+	clearBookingTable()
+	addBooking("someoneElse", 1, "2021-02-08 10:00:00+08", "2021-02-08 11:00:00+08")
+
+	var jsonStr = []byte(`{"facility_id": 1, "purpose": "weekly", "start_dt": "2021-01-25 10:00:00+08", "end_dt": "2021-01-25 11:00:00+08", "recurrence": {"frequency": "WEEKLY", "count": 4}}`)
+	req, _ := http.NewRequest("POST", "/bookingSeries", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	req, _ = http.NewRequest("POST", "/bookingSeries", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var result bookingSeriesResult
+	json.Unmarshal(response.Body.Bytes(), &result)
+
+	if len(result.Bookings) != 3 {
+		t.Fatalf("Expected 3 bookings. Got %d", len(result.Bookings))
+	}
+
+	if len(result.Conflicts) != 1 || result.Conflicts[0].StartTime != "2021-02-08T10:00:00+08:00" {
+		t.Errorf("Expected the 2021-02-08 occurrence to conflict. Got %v", result.Conflicts)
+	}
+
+	for _, b := range result.Bookings {
+		if b.UserID != "testUser" || b.SeriesID != result.Series.ID {
+			t.Errorf("Expected bookings of testUser in series %d. Got %v", result.Series.ID, b)
+		}
+	}
+
+	first := strconv.Itoa(result.Bookings[0].ID)
+	second := strconv.Itoa(result.Bookings[1].ID)
+	series := strconv.Itoa(result.Series.ID)
+
+	jsonStr = []byte(`{"facility_id": 1, "purpose": "moved", "start_dt": "2021-02-01 12:00:00+08", "end_dt": "2021-02-01 13:00:00+08"}`)
+	req, _ = http.NewRequest("PUT", "/booking/"+second+"?scope=following", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var moved []booking
+	json.Unmarshal(response.Body.Bytes(), &moved)
+	if len(moved) != 2 {
+		t.Errorf("Expected 2 bookings to move. Got %d", len(moved))
+	}
+
+	req, _ = http.NewRequest("GET", "/booking/"+first, nil)
+	response = executeRequest(req)
+	var b booking
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Purpose != "weekly" {
+		t.Errorf("Expected the first occurrence to be unchanged. Got '%v'", b.Purpose)
+	}
+
+	req, _ = http.NewRequest("GET", "/bookingSeries/"+series, nil)
+	response = executeRequest(req)
+	var updated bookingSeriesResult
+	json.Unmarshal(response.Body.Bytes(), &updated)
+	start, _ := parseBookingTime(updated.Series.StartTime)
+	if updated.Series.Purpose != "moved" || start.In(facilityZone).Format("15:04") != "12:00" {
+		t.Errorf("Expected the series to be moved with its occurrences. Got %v", updated.Series)
+	}
+
+	jsonStr = []byte(`{"facility_id": 1, "purpose": "clash", "start_dt": "2021-02-08 10:00:00+08", "end_dt": "2021-02-08 11:00:00+08"}`)
+	req, _ = http.NewRequest("PUT", "/booking/"+first+"?scope=all", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("GET", "/booking/"+first, nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Purpose != "weekly" {
+		t.Errorf("Expected a conflicting series update to change nothing. Got '%v'", b.Purpose)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/booking/"+second+"?scope=following", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var cancelled map[string]string
+	json.Unmarshal(response.Body.Bytes(), &cancelled)
+	if !strings.Contains(cancelled["ics"], "METHOD:CANCEL") || strings.Count(cancelled["ics"], "BEGIN:VEVENT") != 2 {
+		t.Errorf("Expected a cancel invite for the 2 cancelled occurrences. Got %v", cancelled["ics"])
+	}
+
+	req, _ = http.NewRequest("GET", "/bookingSeries/"+series, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &result)
+	confirmed := 0
+	for _, b := range result.Bookings {
+		if b.Status == "confirmed" {
+			confirmed++
+		}
+	}
+	if len(result.Bookings) != 3 || confirmed != 1 {
+		t.Errorf("Expected 1 of 3 bookings left confirmed in the series. Got %v", result.Bookings)
+	}
+}
+
+func TestFreeIntervals(t *testing.T) {
+	at := func(s string) time.Time {
+		t, _ := parseBookingTime("2021-01-24 " + s + "+08")
+		return t
+	}
+
+	window := interval{at("09:00:00"), at("18:00:00")}
+	busy := []interval{
+		{at("13:00:00"), at("14:00:00")},
+		{at("10:10:00"), at("11:00:00")},
+		{at("10:30:00"), at("12:00:00")},
+		{at("17:30:00"), at("19:00:00")},
+	}
+
+	gaps := freeIntervals(window, busy, time.Hour, 15*time.Minute)
+
+	expected := []interval{
+		{at("09:00:00"), at("10:00:00")},
+		{at("12:00:00"), at("13:00:00")},
+		{at("14:00:00"), at("17:30:00")},
+	}
+
+	if len(gaps) != len(expected) {
+		t.Fatalf("Expected %d free intervals. Got %v", len(expected), gaps)
+	}
+
+	for i := range expected {
+		if !gaps[i].Start.Equal(expected[i].Start) || !gaps[i].End.Equal(expected[i].End) {
+			t.Errorf("Expected free interval %v. Got %v", expected[i], gaps[i])
+		}
+	}
+}
+
+func TestAvailability(t *testing.T) {
+	clearBookingTable()
+	a.DB.Exec("INSERT INTO booking.facility_detail(name, level, description, status, transaction_dt) VALUES($1, $2, $3, $4, $5)", "Meeting Room L3-01", 3, "Meeting Room", "MAINTENANCE", "2021-01-24 10:00:00+08")
+	addBooking("someoneElse", 1, "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08")
+
+	req, _ := http.NewRequest("GET", "/availability?from=2021-01-24T09:00:00%2B08:00&to=2021-01-24T12:00:00%2B08:00&duration=60", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var results []facilityAvailability
+	json.Unmarshal(response.Body.Bytes(), &results)
+
+	if len(results) != 2 || results[0].FacilityID != 1 || results[1].FacilityID != 2 {
+		t.Fatalf("Expected slots for the open facilities 1 and 2. Got %v", results)
+	}
+
+	expected := []timeSlot{
+		{"2021-01-24T09:00:00+08:00", "2021-01-24T10:00:00+08:00"},
+		{"2021-01-24T11:00:00+08:00", "2021-01-24T12:00:00+08:00"},
+	}
+	if len(results[0].Slots) != 2 || results[0].Slots[0] != expected[0] || results[0].Slots[1] != expected[1] {
+		t.Errorf("Expected slots %v around the booking. Got %v", expected, results[0].Slots)
+	}
+
+	req, _ = http.NewRequest("GET", "/availability?from=2021-01-24T09:00:00%2B08:00&to=2021-01-24T12:00:00%2B08:00&duration=120", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &results)
+	if len(results) != 1 || results[0].FacilityID != 2 {
+		t.Errorf("Expected only facility 2 to have 2 free hours. Got %v", results)
+	}
+
+	req, _ = http.NewRequest("GET", "/availability?from=2021-01-24T09:00:00%2B08:00&to=2021-01-24T12:00:00%2B08:00&level=2", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &results)
+	if len(results) != 1 || results[0].FacilityID != 2 {
+		t.Errorf("Expected only the level 2 facility. Got %v", results)
+	}
+
+	req, _ = http.NewRequest("GET", "/availability?from=2021-01-24T09:00:00%2B08:00&to=2021-01-24T12:00:00%2B08:00&duration=180", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("GET", "/availability?from=2021-01-24T12:00:00%2B08:00&to=2021-01-24T09:00:00%2B08:00", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestOpeningHoursCover(t *testing.T) {
+	hours := openingHours{
+		{"MO", "09:00", "12:00"},
+		{"MO", "13:00", "18:00"},
+		{"TU", "00:00", "24:00"},
+		{"WE", "00:00", "12:00"},
+	}
+
+	tests := []struct {
+		name   string
+		start  string
+		end    string
+		covers bool
+	}{
+		{"inside", "2021-01-25 09:00:00+08", "2021-01-25 12:00:00+08", true},
+		{"before opening", "2021-01-25 08:30:00+08", "2021-01-25 09:30:00+08", false},
+		{"over lunch", "2021-01-25 11:00:00+08", "2021-01-25 14:00:00+08", false},
+		{"closed day", "2021-01-24 10:00:00+08", "2021-01-24 11:00:00+08", false},
+		{"across midnight", "2021-01-26 23:00:00+08", "2021-01-27 01:00:00+08", true},
+		{"into closed day", "2021-01-27 11:00:00+08", "2021-01-28 01:00:00+08", false},
+		{"other offset", "2021-01-25 10:00:00+00", "2021-01-25 11:00:00+00", false},
+	}
+
+	zone := facilityZone
+	facilityZone = time.FixedZone("SGT", 8*60*60)
+	defer func() { facilityZone = zone }()
+
+	for _, tt := range tests {
+		start, _ := parseBookingTime(tt.start)
+		end, _ := parseBookingTime(tt.end)
+		if covers, err := hours.covers(start, end); covers != tt.covers || err != nil {
+			t.Errorf("%s: expected covers to be %v. Got %v, %v", tt.name, tt.covers, covers, err)
+		}
+	}
+
+	monday, _ := parseBookingTime("2021-01-25 10:00:00+08")
+	// stored hours that cannot be read make the check fail rather than close the facility
+	if _, err := (openingHours{{"MO", "0000-01-01T09:00:00Z", "18:00"}}).covers(monday, monday.Add(time.Hour)); err == nil {
+		t.Errorf("Expected an unreadable opening time to be reported")
+	}
+
+	if err := (openingHours{{"XX", "09:00", "18:00"}}).validate(); err == nil {
+		t.Errorf("Expected an invalid weekday to be rejected")
+	}
+
+	if err := (openingHours{{"MO", "18:00", "09:00"}}).validate(); err == nil {
+		t.Errorf("Expected close_time before open_time to be rejected")
+	}
+}
+
+func TestOpeningHoursAndBlackouts(t *testing.T) {
+	clearBookingTable()
+
+	var jsonStr = []byte(`[{"weekday": "MO", "open_time": "09:00", "close_time": "18:00"}, {"weekday": "TU", "open_time": "09:00", "close_time": "18:00"}]`)
+	req, _ := http.NewRequest("PUT", "/facilityDetail/1/openingHours", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/facilityDetail/1/openingHours", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/facilityDetail/1/openingHours", nil)
+	response = executeRequest(req)
+	var hours openingHours
+	json.Unmarshal(response.Body.Bytes(), &hours)
+	if len(hours) != 2 || hours[0].Weekday != "MO" || hours[1].Weekday != "TU" || hours[0].OpenTime != "09:00:00" || hours[0].CloseTime != "18:00:00" {
+		t.Errorf("Expected Monday and Tuesday opening hours. Got %v", hours)
+	}
+
+	jsonStr = []byte(`{"facility_id": 1, "purpose": "sunday", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["rule"] != "opening_hours" {
+		t.Errorf("Expected rule 'opening_hours'. Got '%v'", m["rule"])
+	}
+
+	jsonStr = []byte(`{"facility_id": 1, "purpose": "late", "start_dt": "2021-01-25 17:00:00+08", "end_dt": "2021-01-25 19:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "purpose": "monday", "start_dt": "2021-01-25 10:00:00+08", "end_dt": "2021-01-25 11:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	jsonStr = []byte(`{"reason": "Public holiday", "start_dt": "2021-01-26 00:00:00+08", "end_dt": "2021-01-27 00:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/blackout", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/blackout", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "purpose": "holiday", "start_dt": "2021-01-26 10:00:00+08", "end_dt": "2021-01-26 11:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["rule"] != "blackout" {
+		t.Errorf("Expected rule 'blackout'. Got '%v'", m["rule"])
+	}
+
+	req, _ = http.NewRequest("GET", "/blackouts?facility_id=1", nil)
+	response = executeRequest(req)
+	var blackouts []blackout
+	json.Unmarshal(response.Body.Bytes(), &blackouts)
+	if len(blackouts) != 1 || blackouts[0].FacilityID != 0 {
+		t.Errorf("Expected the global blackout to apply to facility 1. Got %v", blackouts)
+	}
+
+	req, _ = http.NewRequest("GET", "/availability?from=2021-01-24T00:00:00%2B08:00&to=2021-01-27T00:00:00%2B08:00&duration=120&level=1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var results []facilityAvailability
+	json.Unmarshal(response.Body.Bytes(), &results)
+	expected := []timeSlot{
+		{"2021-01-25T11:00:00+08:00", "2021-01-25T18:00:00+08:00"},
+	}
+	if len(results) != 1 || len(results[0].Slots) != 1 || results[0].Slots[0] != expected[0] {
+		t.Errorf("Expected slots %v within opening hours. Got %v", expected, results)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/blackout/1", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	clearBookingTable()
+	addBooking("first", 1, "2021-01-25 10:00:00+08", "2021-01-25 11:00:00+08")
+	addBooking("second", 1, "2021-01-25 13:00:00+08", "2021-01-25 14:00:00+08")
+	addBooking("third", 1, "2021-01-26 10:00:00+08", "2021-01-26 11:00:00+08")
+	buf, restore := captureMail()
+	defer restore()
+
+	var jsonStr = []byte(`{"facility_id": 1, "reason": "Aircon repair", "start_dt": "2021-01-25 09:00:00+08", "end_dt": "2021-01-25 12:00:00+08"}`)
+	req, _ := http.NewRequest("POST", "/maintenanceWindow", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/maintenanceWindow", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var result maintenanceResult
+	json.Unmarshal(response.Body.Bytes(), &result)
+	if len(result.Conflicts) != 1 || result.Conflicts[0].UserID != "first" || result.Cancelled {
+		t.Errorf("Expected the booking of 'first' to be listed but not cancelled. Got %v", result)
+	}
+
+	if result.Window.CreatedBy != "testAdmin" {
+		t.Errorf("Expected created_by to be 'testAdmin'. Got '%v'", result.Window.CreatedBy)
+	}
+
+	if !strings.Contains(buf.String(), "To: first@email") || strings.Contains(buf.String(), "To: second@email") {
+		t.Errorf("Expected only 'first' to be notified. Got '%s'", buf.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/booking/1", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "purpose": "blocked", "start_dt": "2021-01-25 11:00:00+08", "end_dt": "2021-01-25 12:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["rule"] != "maintenance" {
+		t.Errorf("Expected rule 'maintenance'. Got '%v'", m["rule"])
+	}
+
+	buf.Reset()
+	jsonStr = []byte(`{"facility_id": 1, "reason": "Aircon repair", "start_dt": "2021-01-25 09:00:00+08", "end_dt": "2021-01-25 15:00:00+08", "cancel_conflicts": true}`)
+	req, _ = http.NewRequest("PUT", "/maintenanceWindow/1", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &result)
+	if len(result.Conflicts) != 2 || !result.Cancelled {
+		t.Errorf("Expected 2 bookings to be cancelled. Got %v", result)
+	}
+
+	if !strings.Contains(buf.String(), "To: second@email") {
+		t.Errorf("Expected 'second' to be notified. Got '%s'", buf.String())
+	}
+
+	for id, status := range map[string]string{"1": "cancelled", "2": "cancelled", "3": "confirmed"} {
+		req, _ = http.NewRequest("GET", "/booking/"+id, nil)
+		response = executeRequest(req)
+		var b booking
+		json.Unmarshal(response.Body.Bytes(), &b)
+		if b.Status != status {
+			t.Errorf("Expected booking %s to be %s. Got '%v'", id, status, b.Status)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/maintenanceWindows?facility_id=1", nil)
+	response = executeRequest(req)
+	var windows []maintenanceWindow
+	json.Unmarshal(response.Body.Bytes(), &windows)
+	if len(windows) != 1 || windows[0].Reason != "Aircon repair" {
+		t.Errorf("Expected 1 maintenance window. Got %v", windows)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/maintenanceWindow/1", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "purpose": "unblocked", "start_dt": "2021-01-25 11:00:00+08", "end_dt": "2021-01-25 12:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+}
+
+func TestBookingStatus(t *testing.T) {
+	clearBookingTable()
+
+	var jsonStr = []byte(`{"facility_id": 1, "purpose": "status", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08"}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var b booking
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "confirmed" {
+		t.Errorf("Expected a new booking to be confirmed. Got '%v'", b.Status)
+	}
+
+	// a status sent on create is ignored, so a booking cannot be created outside the overlap check
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer([]byte(`{"facility_id": 1, "purpose": "status", "status": "cancelled", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08"}`)))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	if _, err := a.DB.Exec("UPDATE booking.booking SET status='bogus' WHERE id=1"); err == nil {
+		t.Errorf("Expected an unknown status to be rejected by the database")
+	}
+
+	req, _ = http.NewRequest("PUT", "/booking/1/status", bytes.NewBuffer([]byte(`{"status": "completed"}`)))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/booking/1/status", bytes.NewBuffer([]byte(`{"status": "cancelled", "reason": "Moved online"}`)))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/booking/1/status", bytes.NewBuffer([]byte(`{"status": "confirmed"}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/booking/1", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	// the cancelled booking no longer holds its slot
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/booking/2/status", bytes.NewBuffer([]byte(`{"status": "completed"}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	for status, count := range map[string]int{"cancelled": 1, "completed": 1, "confirmed": 0} {
+		req, _ = http.NewRequest("GET", "/bookings?status="+status, nil)
+		response = executeRequest(req)
+		var bookings []booking
+		json.Unmarshal(response.Body.Bytes(), &bookings)
+		if len(bookings) != count {
+			t.Errorf("Expected %d %s bookings. Got %d", count, status, len(bookings))
+		}
+
+		req, _ = http.NewRequest("GET", "/bookingsCount?status="+status, nil)
+		response = executeRequest(req)
+		if body := response.Body.String(); body != strconv.Itoa(count) {
+			t.Errorf("Expected a count of %d %s bookings. Got %s", count, status, body)
+		}
+	}
+
+	// an edit of a booking read before it was cancelled does not bring it back
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer([]byte(`{"facility_id": 1, "purpose": "race", "start_dt": "2021-01-24 12:00:00+08", "end_dt": "2021-01-24 13:00:00+08"}`)))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var stale booking
+	json.Unmarshal(response.Body.Bytes(), &stale)
+	a.DB.Exec("UPDATE booking.booking SET status='cancelled' WHERE id=$1", stale.ID)
+
+	stale.Purpose = "edited"
+	err := stale.updateBooking(a.DB)
+	if v, ok := err.(*ruleViolation); !ok || v.Rule != "invalid_status" {
+		t.Errorf("Expected the stale edit to be rejected. Got %v", err)
+	}
+
+	var status string
+	a.DB.QueryRow("SELECT status FROM booking.booking WHERE id=$1", stale.ID).Scan(&status)
+	if status != "cancelled" {
+		t.Errorf("Expected the booking to stay cancelled. Got '%v'", status)
+	}
+}
+
+func TestBookingTransitions(t *testing.T) {
+	tests := []struct {
+		from    string
+		to      string
+		allowed bool
+	}{
+		{"pending", "confirmed", true},
+		{"pending", "cancelled", true},
+		{"pending", "completed", false},
+		{"confirmed", "cancelled", true},
+		{"confirmed", "completed", true},
+		{"confirmed", "no_show", true},
+		{"confirmed", "pending", false},
+		{"cancelled", "confirmed", false},
+		{"completed", "cancelled", false},
+		{"no_show", "completed", false},
+	}
+
+	for _, tt := range tests {
+		if allowed := canTransition(tt.from, tt.to); allowed != tt.allowed {
+			t.Errorf("%s -> %s: expected %v. Got %v", tt.from, tt.to, tt.allowed, allowed)
+		}
+	}
+}
+
+func TestBookingApproval(t *testing.T) {
+	clearBookingTable()
+	a.DB.Exec("UPDATE booking.facility_detail SET requires_approval=true WHERE id=2")
+	buf, restore := captureMail()
+	defer restore()
+
+	var jsonStr = []byte(`{"facility_id": 2, "email": "requester@email", "purpose": "board meeting", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08"}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var b booking
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "pending" {
+		t.Errorf("Expected a booking of a restricted facility to be pending. Got '%v'", b.Status)
+	}
+
+	// a pending booking holds its slot
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("POST", "/booking/1/approve", bytes.NewBuffer([]byte(`{"comment": "ok"}`)))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/booking/1/approve", bytes.NewBuffer([]byte(`{"comment": "Enjoy"}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "confirmed" || b.DecidedBy != "testAdmin" || b.DecisionComment != "Enjoy" {
+		t.Errorf("Expected the booking to be approved by testAdmin. Got %v", b)
+	}
+
+	if !strings.Contains(buf.String(), "approved") || !strings.Contains(buf.String(), "To: requester@email") {
+		t.Errorf("Expected the requester to be notified of the approval. Got '%s'", buf.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/booking/1/reject", bytes.NewBuffer([]byte(`{}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 2, "email": "requester@email", "purpose": "offsite", "start_dt": "2021-01-24 12:00:00+08", "end_dt": "2021-01-24 13:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	buf.Reset()
+	req, _ = http.NewRequest("POST", "/booking/2/reject", bytes.NewBuffer([]byte(`{"comment": "Room reserved for the board"}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "cancelled" || b.DecisionComment != "Room reserved for the board" {
+		t.Errorf("Expected the booking to be rejected with a comment. Got %v", b)
+	}
+
+	if !strings.Contains(buf.String(), "rejected") || !strings.Contains(buf.String(), "Room reserved for the board") {
+		t.Errorf("Expected the requester to be notified of the rejection. Got '%s'", buf.String())
+	}
+
+	addBookingConfig("approval_timeout_hr", "1")
+	defer removeBookingConfig("approval_timeout_hr")
+
+	future := time.Now().AddDate(0, 0, 7)
+	jsonStr = []byte(`{"facility_id": 2, "email": "requester@email", "purpose": "later", "start_dt": "` + future.Format(time.RFC3339) + `", "end_dt": "` + future.Add(time.Hour).Format(time.RFC3339) + `"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	a.runJobs(time.Now())
+	req, _ = http.NewRequest("GET", "/booking/3", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "pending" {
+		t.Errorf("Expected the booking to stay pending within the timeout. Got '%v'", b.Status)
+	}
+
+	buf.Reset()
+	a.runJobs(time.Now().Add(2 * time.Hour))
+	req, _ = http.NewRequest("GET", "/booking/3", nil)
+	response = executeRequest(req)
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "cancelled" {
+		t.Errorf("Expected the booking to expire after the timeout. Got '%v'", b.Status)
+	}
+
+	if !strings.Contains(buf.String(), "expired") {
+		t.Errorf("Expected the requester to be notified of the expiry. Got '%s'", buf.String())
+	}
+
+	// a client cannot skip approval by sending a status
+	jsonStr = []byte(`{"facility_id": 2, "email": "requester@email", "purpose": "sneaky", "status": "confirmed", "start_dt": "2021-01-24 18:00:00+08", "end_dt": "2021-01-24 19:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "pending" {
+		t.Errorf("Expected the booking to need approval despite its status. Got '%v'", b.Status)
+	}
+
+	// moving a confirmed booking onto a facility that requires approval needs approval again
+	jsonStr = []byte(`{"facility_id": 1, "email": "requester@email", "purpose": "move", "start_dt": "2021-01-24 14:00:00+08", "end_dt": "2021-01-24 15:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "confirmed" {
+		t.Fatalf("Expected a booking of an open facility to be confirmed. Got '%v'", b.Status)
+	}
+
+	jsonStr = []byte(`{"facility_id": 2, "email": "requester@email", "purpose": "move", "start_dt": "2021-01-24 14:00:00+08", "end_dt": "2021-01-24 15:00:00+08"}`)
+	req, _ = http.NewRequest("PUT", "/booking/"+strconv.Itoa(b.ID), bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "pending" {
+		t.Errorf("Expected the moved booking to need approval. Got '%v'", b.Status)
+	}
+
+	// so does rescheduling an approved booking, while other edits keep the approval
+	jsonStr = []byte(`{"facility_id": 2, "email": "requester@email", "purpose": "board meeting, agenda attached", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08"}`)
+	req, _ = http.NewRequest("PUT", "/booking/1", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "confirmed" || b.DecidedBy != "testAdmin" {
+		t.Errorf("Expected the approval to survive an edit in place. Got %v", b)
+	}
+
+	jsonStr = []byte(`{"facility_id": 2, "email": "requester@email", "purpose": "board meeting", "start_dt": "2021-01-24 16:00:00+08", "end_dt": "2021-01-24 17:00:00+08"}`)
+	req, _ = http.NewRequest("PUT", "/booking/1", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Status != "pending" || len(b.DecidedBy) > 0 {
+		t.Errorf("Expected the rescheduled booking to need approval again. Got %v", b)
+	}
+}
+
+func TestWaitlist(t *testing.T) {
+	clearBookingTable()
+	buf, restore := captureMail()
+	defer restore()
+
+	future := time.Now().AddDate(0, 0, 7).Truncate(time.Hour)
+	slot := func(from time.Time) string {
+		return `"start_dt": "` + from.Format(time.RFC3339) + `", "end_dt": "` + from.Add(time.Hour).Format(time.RFC3339) + `"`
+	}
+
+	jsonStr := []byte(`{"facility_id": 1, "email": "admin@email", "purpose": "townhall", ` + slot(future) + `}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "email": "waiting@email", "purpose": "standup", ` + slot(future.Add(2*time.Hour)) + `}`)
+	req, _ = http.NewRequest("POST", "/waitlist", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "email": "waiting@email", "purpose": "standup", ` + slot(future) + `}`)
+	req, _ = http.NewRequest("POST", "/waitlist", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var e waitlistEntry
+	json.Unmarshal(response.Body.Bytes(), &e)
+	if e.Status != "waiting" || e.UserID != "testUser" {
+		t.Errorf("Expected testUser to be waiting. Got %v", e)
+	}
+
+	// without waitlist_claim_min the freed slot is booked for the first in line
+	req, _ = http.NewRequest("DELETE", "/booking/1", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var b booking
+	req, _ = http.NewRequest("GET", "/booking/2", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.UserID != "testUser" || b.Status != "confirmed" {
+		t.Errorf("Expected the waitlisted booking to be made for testUser. Got %v", b)
+	}
+
+	if !strings.Contains(buf.String(), "To: waiting@email") || !strings.Contains(buf.String(), "booked for you") {
+		t.Errorf("Expected the waiting user to be notified of the booking. Got '%s'", buf.String())
+	}
+
+	addBookingConfig("waitlist_claim_min", "30")
+	defer removeBookingConfig("waitlist_claim_min")
+
+	jsonStr = []byte(`{"facility_id": 1, "email": "admin@email", "purpose": "review", ` + slot(future.Add(4*time.Hour)) + `}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "email": "waiting@email", "purpose": "retro", ` + slot(future.Add(4*time.Hour)) + `}`)
+	req, _ = http.NewRequest("POST", "/waitlist", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	jsonStr = []byte(`{"user_id": "testAdmin", "facility_id": 1, "email": "admin@email", "purpose": "retro", ` + slot(future.Add(4*time.Hour)) + `}`)
+	req, _ = http.NewRequest("POST", "/waitlist", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	buf.Reset()
+	req, _ = http.NewRequest("PUT", "/booking/3/status", bytes.NewBuffer([]byte(`{"status": "cancelled"}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if !strings.Contains(buf.String(), "To: waiting@email") || !strings.Contains(buf.String(), "Claim it through waitlist entry 2") {
+		t.Errorf("Expected the first in line to be offered the slot. Got '%s'", buf.String())
+	}
+
+	// the offered slot is held for the first in line while the offer is open
+	jsonStr = []byte(`{"facility_id": 1, "email": "admin@email", "purpose": "grab", ` + slot(future.Add(4*time.Hour)) + `}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	// an unclaimed offer expires and moves on to the next in line
+	buf.Reset()
+	a.runJobs(time.Now().Add(time.Hour))
+
+	req, _ = http.NewRequest("POST", "/waitlist/2/claim", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	if !strings.Contains(buf.String(), "To: admin@email") || !strings.Contains(buf.String(), "Claim it through waitlist entry 3") {
+		t.Errorf("Expected the offer to pass to the next in line. Got '%s'", buf.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/waitlist/3/claim", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/waitlist/3/claim", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.UserID != "testAdmin" || b.Purpose != "retro" {
+		t.Errorf("Expected the claimed slot to be booked for testAdmin. Got %v", b)
+	}
+
+	req, _ = http.NewRequest("GET", "/waitlist", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var entries []waitlistEntry
+	json.Unmarshal(response.Body.Bytes(), &entries)
+	if len(entries) != 2 || entries[0].Status != "promoted" || entries[1].Status != "expired" {
+		t.Errorf("Expected testUser to see their promoted and expired entries. Got %v", entries)
+	}
+
+	// an entry read while still waiting cannot be withdrawn once it has moved on
+	stale := entries[1]
+	stale.Status = waitlistWaiting
+	if err := stale.withdraw(a.DB); err != errWaitlistChanged {
+		t.Errorf("Expected withdrawing a stale entry to fail with errWaitlistChanged. Got %v", err)
+	}
+}
+
+func TestCheckIn(t *testing.T) {
+	clearBookingTable()
+	addBookingConfig("check_in_grace_min", "15")
+	defer removeBookingConfig("check_in_grace_min")
+	buf, restore := captureMail()
+	defer restore()
+
+	now := time.Now().Truncate(time.Minute)
+	for i, start := range []time.Time{now.Add(-5 * time.Minute), now.Add(-30 * time.Minute), now.Add(2 * time.Hour)} {
+		jsonStr := []byte(`{"facility_id": ` + strconv.Itoa(1+i%2) + `, "email": "user@email", "purpose": "sync", "start_dt": "` + start.Format(time.RFC3339) + `", "end_dt": "` + start.Add(time.Hour).Format(time.RFC3339) + `"}`)
+		req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+		response := executeRequestAs(req, userToken)
+		checkResponseCode(t, http.StatusCreated, response.Code)
+	}
+
+	req, _ := http.NewRequest("POST", "/booking/1/checkIn", nil)
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var b booking
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.CheckedInAt == nil {
+		t.Errorf("Expected the booking to be checked in. Got %v", b)
+	}
+
+	req, _ = http.NewRequest("POST", "/booking/1/checkIn", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("POST", "/booking/3/checkIn", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	a.runJobs(time.Now())
+
+	for id, expected := range map[string]string{"1": "confirmed", "2": "no_show", "3": "confirmed"} {
+		req, _ = http.NewRequest("GET", "/booking/"+id, nil)
+		response = executeRequest(req)
+		json.Unmarshal(response.Body.Bytes(), &b)
+		if b.Status != expected {
+			t.Errorf("Expected booking %v to be %v. Got '%v'", id, expected, b.Status)
+		}
+	}
+
+	if !strings.Contains(buf.String(), "released") {
+		t.Errorf("Expected the owner to be notified of the no-show. Got '%s'", buf.String())
+	}
+
+	// the rest of a no-show's slot can be booked again
+	jsonStr := []byte(`{"facility_id": 2, "email": "other@email", "purpose": "walk-in", "start_dt": "` + now.Add(5*time.Minute).Format(time.RFC3339) + `", "end_dt": "` + now.Add(25*time.Minute).Format(time.RFC3339) + `"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/noShowCounts", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("GET", "/noShowCounts", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var counts []noShowCount
+	json.Unmarshal(response.Body.Bytes(), &counts)
+	if len(counts) != 1 || counts[0].UserID != "testUser" || counts[0].NoShows != 1 {
+		t.Errorf("Expected testUser to have one no-show. Got %v", counts)
+	}
+}
+
+func TestBookingQuota(t *testing.T) {
+	clearBookingTable()
+	a.DB.Exec("DELETE FROM booking.booking_quota")
+	defer a.DB.Exec("DELETE FROM booking.booking_quota")
+
+	req, _ := http.NewRequest("POST", "/bookingQuota", bytes.NewBuffer([]byte(`{"role": "user", "max_active_bookings": 2}`)))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/bookingQuota", bytes.NewBuffer([]byte(`{"role": "user", "user_id": "testUser"}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("POST", "/bookingQuota", bytes.NewBuffer([]byte(`{"role": "user", "max_active_bookings": 2, "max_hr_per_day": 3}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/bookingQuota", bytes.NewBuffer([]byte(`{"role": "user", "max_active_bookings": 1}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	if !strings.Contains(response.Body.String(), "duplicate_quota") {
+		t.Errorf("Expected a second quota for the user role to be rejected. Got '%s'", response.Body.String())
+	}
+
+	week := time.Now().AddDate(0, 0, 7)
+	future := time.Date(week.Year(), week.Month(), week.Day(), 8, 0, 0, 0, time.Local)
+	book := func(from time.Time, hours int) *httptest.ResponseRecorder {
+		jsonStr := []byte(`{"facility_id": 1, "email": "user@email", "purpose": "quota", "start_dt": "` + from.Format(time.RFC3339) + `", "end_dt": "` + from.Add(time.Duration(hours)*time.Hour).Format(time.RFC3339) + `"}`)
+		req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+		return executeRequestAs(req, userToken)
+	}
+
+	checkResponseCode(t, http.StatusCreated, book(future, 2).Code)
+
+	response = book(future.Add(3*time.Hour), 2)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	if !strings.Contains(response.Body.String(), "max_hr_per_day") {
+		t.Errorf("Expected the daily hour quota to be exceeded. Got '%s'", response.Body.String())
+	}
+
+	checkResponseCode(t, http.StatusCreated, book(future.Add(3*time.Hour), 1).Code)
+
+	response = book(future.AddDate(0, 0, 1), 1)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	if !strings.Contains(response.Body.String(), "max_active_bookings") {
+		t.Errorf("Expected the active booking quota to be exceeded. Got '%s'", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/me/quota", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var usage quotaUsage
+	json.Unmarshal(response.Body.Bytes(), &usage)
+	if usage.ActiveBookings != 2 || usage.Quota.MaxActiveBookings != 2 || usage.BookingsPerFacility[1] != 2 {
+		t.Errorf("Expected testUser to use 2 of 2 active bookings. Got %v", usage)
+	}
+
+	// a user's own quota replaces the quota of their role
+	req, _ = http.NewRequest("POST", "/bookingQuota", bytes.NewBuffer([]byte(`{"user_id": "testUser", "max_active_bookings": 5}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var own bookingQuota
+	json.Unmarshal(response.Body.Bytes(), &own)
+	req, _ = http.NewRequest("PUT", "/bookingQuota/"+strconv.Itoa(own.ID), bytes.NewBuffer([]byte(`{"role": "user", "max_active_bookings": 5}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	if !strings.Contains(response.Body.String(), "duplicate_quota") {
+		t.Errorf("Expected moving a quota onto the user role to be rejected. Got '%s'", response.Body.String())
+	}
+
+	checkResponseCode(t, http.StatusCreated, book(future.AddDate(0, 0, 1), 1).Code)
+
+	// concurrent bookings cannot all slip under the quota
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(day int) {
+			defer wg.Done()
+			if book(future.AddDate(0, 0, day), 1).Code == http.StatusCreated {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}(2 + i)
+	}
+	wg.Wait()
+
+	if created != 2 {
+		t.Errorf("Expected only 2 more bookings to fit the quota of 5. Got %v", created)
+	}
+}
+
+func TestCapacityAndAttendees(t *testing.T) {
+	clearBookingTable()
+	a.DB.Exec("UPDATE booking.facility_detail SET capacity=4 WHERE id=1")
+
+	jsonStr := []byte(`{"facility_id": 1, "email": "owner@email", "purpose": "offsite", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08", "headcount": 5}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+	if !strings.Contains(response.Body.String(), "capacity") {
+		t.Errorf("Expected the booking to exceed the capacity. Got '%s'", response.Body.String())
+	}
+
+	jsonStr = []byte(`{"facility_id": 1, "email": "owner@email", "purpose": "offsite", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08", "attendees": [{"user_id": "nobody"}]}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	// emails end up in mail headers and calendar lines, so anything but a bare address is rejected
+	jsonStr = []byte(`{"facility_id": 1, "email": "owner@email", "purpose": "offsite", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08", "attendees": [{"email": "guest@example.com\r\nATTENDEE:mailto:eve@email"}]}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "email": "Owner <owner@email>", "purpose": "offsite", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	jsonStr = []byte(`{"facility_id": 1, "email": "owner@email", "purpose": "offsite", "start_dt": "2021-01-24 10:00:00+08", "end_dt": "2021-01-24 11:00:00+08", "attendees": [{"user_id": "testAdmin"}, {"email": "guest@example.com", "name": "Guest"}]}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var b booking
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if b.Headcount != 3 {
+		t.Errorf("Expected the headcount to default to the owner and attendees. Got '%v'", b.Headcount)
+	}
+
+	for _, attendee := range []string{"testAdmin", "guest@example.com"} {
+		req, _ = http.NewRequest("GET", "/bookings?attendee="+attendee, nil)
+		response = executeRequestAs(req, adminToken)
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var bookings []booking
+		json.Unmarshal(response.Body.Bytes(), &bookings)
+		if len(bookings) != 1 || len(bookings[0].Attendees) != 2 || bookings[0].Attendees[1].Name != "Guest" {
+			t.Errorf("Expected %v to see the booking they were invited to. Got %v", attendee, bookings)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/bookings?attendee=testUser", nil)
+	response = executeRequestAs(req, userToken)
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected no bookings testUser was invited to. Got %s", body)
+	}
+
+	// only admins list the bookings of other attendees, and guests' details stay out of the public listing
+	req, _ = http.NewRequest("GET", "/bookings?attendee=testAdmin", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	req, _ = http.NewRequest("GET", "/bookings?attendee=testAdmin", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("GET", "/bookings", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if body := response.Body.String(); strings.Contains(body, "guest@example.com") || strings.Contains(body, "Guest") {
+		t.Errorf("Expected the guest's details to be hidden from the public. Got %s", body)
+	}
+
+	from := time.Now().AddDate(0, 0, 7).UTC().Truncate(time.Hour)
+	req, _ = http.NewRequest("GET", "/availability?from="+from.Format(time.RFC3339)+"&to="+from.Add(3*time.Hour).Format(time.RFC3339)+"&capacity=10", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var results []facilityAvailability
+	json.Unmarshal(response.Body.Bytes(), &results)
+	if len(results) != 1 || results[0].FacilityID != 2 {
+		t.Errorf("Expected only facility 2 to seat 10 people. Got %v", results)
+	}
+}
+
+func TestICSCalendar(t *testing.T) {
+	p := booking{ID: 7, Email: "owner@email", Purpose: "Plan; review, and\nsign-off " + strings.Repeat("x", 80), FacilityID: 2,
+		StartTime: "2021-01-24 10:00:00+08", EndTime: "2021-01-24 11:00:00+08", Status: "confirmed", Sequence: 3}
+
+	invite := bookingInvite(&p, time.Date(2021, 1, 20, 0, 0, 0, 0, time.UTC))
+	for _, line := range []string{"METHOD:REQUEST\r\n", "UID:booking-7@bookingbackend\r\n", "SEQUENCE:3\r\n",
+		"DTSTART:20210124T020000Z\r\n", "DTEND:20210124T030000Z\r\n", "STATUS:CONFIRMED\r\n", "SUMMARY:Plan\\; review\\, and\\nsign-off"} {
+		if !strings.Contains(invite, line) {
+			t.Errorf("Expected the invite to contain %q. Got %q", line, invite)
+		}
+	}
+
+	for _, line := range strings.Split(invite, "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("Expected lines to be folded at 75 octets. Got %q", line)
+		}
+	}
+
+	p.Status = "cancelled"
+	if invite = bookingInvite(&p, time.Now()); !strings.Contains(invite, "METHOD:CANCEL\r\n") || !strings.Contains(invite, "STATUS:CANCELLED\r\n") {
+		t.Errorf("Expected a cancelled booking to cancel the event. Got %q", invite)
+	}
+
+	// line breaks in stored emails and names cannot add lines to the invite
+	p.Status = "confirmed"
+	p.Email = "owner@email\r\nATTENDEE:mailto:eve@email"
+	p.Attendees = []attendee{{Email: "guest@email\nX-INJECTED:1", Name: "Guest \"G\";ROLE=CHAIR\r\nX-INJECTED:2"}}
+	invite = bookingInvite(&p, time.Now())
+	if strings.Contains(invite, "\r\nATTENDEE:mailto:eve") || strings.Contains(invite, "\r\nX-INJECTED") {
+		t.Errorf("Expected line breaks to be stripped. Got %q", invite)
+	}
+	if !strings.Contains(invite, `ATTENDEE;CN="Guest 'G';ROLE=CHAIRX-INJECTED:2":mailto:guest@email`) {
+		t.Errorf("Expected the attendee name to be quoted. Got %q", invite)
+	}
+
+	for _, email := range []string{"user@email", "first.last@example.com"} {
+		if !validEmail(email) {
+			t.Errorf("Expected %q to be a valid email", email)
+		}
+	}
+	for _, email := range []string{"", "user", "Eve <eve@email>", "eve@email\r\nBcc: x@email"} {
+		if validEmail(email) {
+			t.Errorf("Expected %q to be an invalid email", email)
+		}
+	}
+}
+
+func TestCalendarFeeds(t *testing.T) {
+	clearBookingTable()
+
+	future := time.Now().AddDate(0, 0, 7).Truncate(time.Hour)
+	jsonStr := []byte(`{"facility_id": 1, "email": "user@email", "purpose": "planning", "start_dt": "` + future.Format(time.RFC3339) + `", "end_dt": "` + future.Add(time.Hour).Format(time.RFC3339) + `"}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var b booking
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if !strings.Contains(b.Invite, "UID:booking-1@bookingbackend") || !strings.Contains(b.Invite, "SEQUENCE:0") {
+		t.Errorf("Expected the booking to come with an invite. Got %q", b.Invite)
+	}
+
+	req, _ = http.NewRequest("PUT", "/booking/1", bytes.NewBuffer([]byte(strings.Replace(string(jsonStr), "planning", "retro", 1))))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &b)
+	if !strings.Contains(b.Invite, "UID:booking-1@bookingbackend") || !strings.Contains(b.Invite, "SEQUENCE:1") {
+		t.Errorf("Expected the update to replace the event. Got %q", b.Invite)
+	}
+
+	req, _ = http.NewRequest("GET", "/bookings.ics?token=nope", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	req, _ = http.NewRequest("POST", "/me/feedToken", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var token feedToken
+	json.Unmarshal(response.Body.Bytes(), &token)
+
+	req, _ = http.NewRequest("GET", "/bookings.ics?token="+token.Token, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if !strings.HasPrefix(response.Header().Get("Content-Type"), "text/calendar") || !strings.Contains(response.Body.String(), "SUMMARY:retro") {
+		t.Errorf("Expected testUser's feed to list their booking. Got '%s'", response.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/bookings.ics?user_id=testAdmin&token="+token.Token, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("GET", "/facilityDetail/1/calendar.ics?token="+token.Token, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if !strings.Contains(response.Body.String(), "UID:booking-1@bookingbackend") || !strings.Contains(response.Body.String(), "ORGANIZER:mailto:user@email") {
+		t.Errorf("Expected the facility feed to list the booking. Got '%s'", response.Body.String())
+	}
+
+	// other users' bookings are listed without their owner and guests
+	jsonStr = []byte(`{"facility_id": 1, "email": "admin@email", "purpose": "board", "start_dt": "` + future.Add(2*time.Hour).Format(time.RFC3339) + `", "end_dt": "` + future.Add(3*time.Hour).Format(time.RFC3339) + `", "attendees": [{"email": "guest@example.com", "name": "Guest"}]}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/facilityDetail/1/calendar.ics?token="+token.Token, nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if body := response.Body.String(); !strings.Contains(body, "SUMMARY:board") || strings.Contains(body, "admin@email") || strings.Contains(body, "guest@example.com") {
+		t.Errorf("Expected the admin's booking without its owner and guests. Got '%s'", body)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/booking/1", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if !strings.Contains(response.Body.String(), "METHOD:CANCEL") || !strings.Contains(response.Body.String(), "SEQUENCE:2") {
+		t.Errorf("Expected the cancellation to cancel the event. Got '%s'", response.Body.String())
+	}
+}
+
+func TestParseICSEvents(t *testing.T) {
+	data := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:weekly\r\nSUMMARY:Stand\\, up\r\n" +
+		"DTSTART;TZID=Asia/Singapore:20210125T090000\r\nDURATION:PT30M\r\nRRULE:FREQ=WEEKLY;BYDAY=MO,WE;CO\r\n UNT=4\r\n" +
+		"EXDATE;TZID=Asia/Singapore:20210127T090000\r\nBEGIN:VALARM\r\nTRIGGER:-PT15M\r\nEND:VALARM\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:cancelled\r\nSTATUS:CANCELLED\r\nDTSTART:20210125T010000Z\r\nDTEND:20210125T020000Z\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:broken\r\nDTSTART;TZID=Nowhere/City:20210125T090000\r\nDTEND:20210125T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	events, err := parseICSEvents(data)
+	if err != nil || len(events) != 3 {
+		t.Fatalf("Expected 3 events. Got %v, %v", events, err)
+	}
+
+	e := events[0]
+	if e.Err != nil || e.Summary != "Stand, up" || e.End.Sub(e.Start) != 30*time.Minute || e.Recurrence == nil || e.Recurrence.Count != 4 {
+		t.Errorf("Expected a weekly 30 minute event. Got %+v", e)
+	}
+
+	starts, err := e.occurrences()
+	if err != nil || len(starts) != 3 || starts[0].UTC().Format(time.RFC3339) != "2021-01-25T01:00:00Z" || starts[1].Weekday() != time.Monday {
+		t.Errorf("Expected 3 occurrences with the Wednesday left out. Got %v, %v", starts, err)
+	}
+
+	if !events[1].Cancelled {
+		t.Errorf("Expected the second event to be cancelled")
+	}
+
+	if events[2].Err == nil {
+		t.Errorf("Expected an unknown TZID to make the event invalid")
+	}
+
+	if _, err := parseICSEvents("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:open\r\n"); err == nil {
+		t.Errorf("Expected an unterminated VEVENT to be rejected")
+	}
+
+	// floating times are taken in the facilities' zone, not the server's
+	zone := facilityZone
+	facilityZone = time.FixedZone("SGT", 8*60*60)
+	defer func() { facilityZone = zone }()
+	for _, value := range []string{"20210125T090000", "20210125"} {
+		start, _, err := parseICSTime(value, map[string]string{})
+		if _, offset := start.Zone(); err != nil || offset != 8*60*60 {
+			t.Errorf("Expected %v to be read in the facility zone. Got %v, %v", value, start, err)
+		}
+	}
+
+	if _, err := parseRRule("FREQ=MONTHLY;BYMONTHDAY=-1"); err == nil {
+		t.Errorf("Expected an unsupported RRULE part to be rejected")
+	}
+
+	// BYDAY only picks the weekdays of a weekly rule
+	for _, rule := range []string{"FREQ=MONTHLY;BYDAY=TU;COUNT=3", "FREQ=WEEKLY;BYDAY=2TU;COUNT=3", "FREQ=DAILY;BYDAY=MO,FR;COUNT=3"} {
+		if _, err := parseRRule(rule); err == nil {
+			t.Errorf("Expected %q to be rejected", rule)
+		}
+	}
+
+	_, err = parseRRule("FREQ=DAILY")
+	if v, ok := err.(*ruleViolation); !ok || v.Rule != "open_ended_recurrence" {
+		t.Errorf("Expected an RRULE without COUNT or UNTIL to be reported as open ended. Got %v", err)
+	}
+
+	if r, err := parseRRule("FREQ=WEEKLY;BYDAY=tu,TH;UNTIL=20210228"); err != nil || len(r.ByWeekday) != 2 || r.Until != "2021-02-28" {
+		t.Errorf("Expected a weekly rule on Tuesdays and Thursdays. Got %+v, %v", r, err)
+	}
+}
+
+func TestImportFacilityCalendar(t *testing.T) {
+	clearBookingTable()
+
+	day := time.Now().UTC().AddDate(0, 0, 7).Truncate(24 * time.Hour).Add(10 * time.Hour)
+	addBooking("testUser", 1, day.Add(2*24*time.Hour).Format(time.RFC3339), day.Add(2*24*time.Hour+time.Hour).Format(time.RFC3339))
+
+	data := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n" +
+		"BEGIN:VEVENT\r\nUID:daily\r\nSUMMARY:standup\r\nORGANIZER:mailto:testUser@mail.com\r\nDTSTART:" + icsTime(day) + "\r\nDURATION:PT1H\r\nRRULE:FREQ=DAILY;COUNT=3\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:single\r\nSUMMARY:review\r\nDTSTART:" + icsTime(day.Add(3*time.Hour)) + "\r\nDTEND:" + icsTime(day.Add(4*time.Hour)) + "\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:bad\r\nDTSTART:" + icsTime(day) + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	req, _ := http.NewRequest("POST", "/facilityDetail/1/import", bytes.NewBufferString(data))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/facilityDetail/99/import", bytes.NewBufferString(data))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("POST", "/facilityDetail/1/import?dry_run=true", bytes.NewBufferString(data))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var report importReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+	if !report.DryRun || report.Created != 3 || report.Conflicts != 1 || report.Invalid != 1 || len(report.Results) != 5 {
+		t.Errorf("Expected 3 bookings, 1 conflict and 1 invalid event. Got %+v", report)
+	}
+
+	var count int
+	a.DB.QueryRow("SELECT COUNT (id) FROM booking.booking").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected a dry run to book nothing. Got %v bookings", count)
+	}
+
+	req, _ = http.NewRequest("POST", "/facilityDetail/1/import", bytes.NewBufferString(data))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	report = importReport{}
+	json.Unmarshal(response.Body.Bytes(), &report)
+	if report.DryRun || report.Created != 3 || report.Conflicts != 1 {
+		t.Errorf("Expected 3 bookings and 1 conflict. Got %+v", report)
+	}
+
+	if r := report.Results[2]; r.Status != "conflict" || r.UID != "daily" {
+		t.Errorf("Expected the third standup to overlap testUser's booking. Got %+v", r)
+	}
+
+	if r := report.Results[0]; r.Status != "created" || r.SeriesID == 0 || r.BookingID == 0 {
+		t.Errorf("Expected the standups to be booked as a series. Got %+v", r)
+	}
+
+	var owner string
+	a.DB.QueryRow("SELECT user_id FROM booking.booking WHERE id=$1", report.Results[0].BookingID).Scan(&owner)
+	if owner != "testUser" {
+		t.Errorf("Expected the organizer to own the imported booking. Got %q", owner)
+	}
+
+	a.DB.QueryRow("SELECT user_id FROM booking.booking WHERE id=$1", report.Results[3].BookingID).Scan(&owner)
+	if owner != "testAdmin" {
+		t.Errorf("Expected an event without an organizer to be booked for the importer. Got %q", owner)
+	}
+}
+
+func TestWebhookSigningAndBackoff(t *testing.T) {
+	payload := []byte(`{"event":"booking.created"}`)
+	if webhookSignature("secret", "1611453600", payload) == webhookSignature("secret", "1611453601", payload) {
+		t.Errorf("Expected the timestamp to be signed")
+	}
+	if webhookSignature("secret", "1611453600", payload) == webhookSignature("other", "1611453600", payload) {
+		t.Errorf("Expected the signature to depend on the secret")
+	}
+
+	for attempt, expected := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 30: webhookRetryMax} {
+		if got := webhookBackoff(attempt); got != expected {
+			t.Errorf("Expected attempt %v to back off %v. Got %v", attempt, expected, got)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	clearBookingTable()
+	clearWebhookTables()
+	defer clearWebhookTables()
+
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received, bodies = append(received, r), append(bodies, body)
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	jsonStr := []byte(`{"url": "` + server.URL + `", "events": ["booking.created", "booking.cancelled"]}`)
+	req, _ := http.NewRequest("POST", "/webhook", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/webhook", bytes.NewBuffer([]byte(`{"url": "ftp://example.com", "events": ["booking.created"]}`)))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	req, _ = http.NewRequest("POST", "/webhook", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var hook webhook
+	json.Unmarshal(response.Body.Bytes(), &hook)
+	if len(hook.Secret) == 0 || !hook.Active {
+		t.Fatalf("Expected an active webhook with a generated secret. Got %+v", hook)
+	}
+
+	req, _ = http.NewRequest("GET", "/webhook/1", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.Contains(response.Body.String(), hook.Secret) {
+		t.Errorf("Expected the secret to be hidden once created. Got '%s'", response.Body.String())
+	}
+
+	future := time.Now().AddDate(0, 0, 7).Truncate(time.Hour)
+	jsonStr = []byte(`{"facility_id": 1, "email": "user@email", "purpose": "sync", "start_dt": "` + future.Format(time.RFC3339) + `", "end_dt": "` + future.Add(time.Hour).Format(time.RFC3339) + `"}`)
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	a.dispatchOutbox(time.Now())
+	now := time.Now()
+	a.deliverWebhooks(now)
+
+	mu.Lock()
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 delivery. Got %v", len(received))
+	}
+	r := received[0]
+	if r.Header.Get("X-Webhook-Event") != "booking.created" ||
+		r.Header.Get("X-Webhook-Signature") != "sha256="+webhookSignature(hook.Secret, r.Header.Get("X-Webhook-Timestamp"), bodies[0]) {
+		t.Errorf("Expected a signed booking.created delivery. Got %v", r.Header)
+	}
+	var payload webhookPayload
+	json.Unmarshal(bodies[0], &payload)
+	if payload.Event != "booking.created" || payload.Data.(map[string]interface{})["purpose"] != "sync" {
+		t.Errorf("Expected the payload to carry the booking. Got '%s'", bodies[0])
+	}
+	failing = true
+	mu.Unlock()
+
+	req, _ = http.NewRequest("DELETE", "/booking/1", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	a.dispatchOutbox(time.Now())
+	now = time.Now()
+	a.deliverWebhooks(now)
+	a.deliverWebhooks(now)
+
+	req, _ = http.NewRequest("GET", "/webhook/1/deliveries?status=pending", nil)
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var deliveries []webhookDelivery
+	json.Unmarshal(response.Body.Bytes(), &deliveries)
+	if len(deliveries) != 1 || deliveries[0].Event != "booking.cancelled" || deliveries[0].Attempts != 1 || deliveries[0].ResponseCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the failed cancellation to wait for its retry. Got %+v", deliveries)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+
+	a.deliverWebhooks(now.Add(webhookBackoff(1)))
+
+	req, _ = http.NewRequest("GET", "/webhook/1/deliveries", nil)
+	response = executeRequestAs(req, adminToken)
+	deliveries = nil
+	json.Unmarshal(response.Body.Bytes(), &deliveries)
+	if len(deliveries) != 2 || deliveries[0].Status != "delivered" || deliveries[0].Attempts != 2 || deliveries[1].Status != "delivered" {
+		t.Errorf("Expected both deliveries to be delivered after the retry. Got %+v", deliveries)
+	}
+
+	mu.Lock()
+	if len(received) != 3 {
+		t.Errorf("Expected 3 attempts in all. Got %v", len(received))
+	}
+	// the retry ran with a tick time 30 seconds ahead, yet is signed with the time it was sent
+	if len(received) == 3 {
+		sent, _ := strconv.ParseInt(received[2].Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if d := time.Since(time.Unix(sent, 0)); d < -5*time.Second || d > 5*time.Second {
+			t.Errorf("Expected the retry to be signed with the current time. Got %v", received[2].Header.Get("X-Webhook-Timestamp"))
+		}
+	}
+	mu.Unlock()
+
+	if webhookLease < webhookBatchSize*webhookTimeout {
+		t.Errorf("Expected the lease to outlast a batch of timed out deliveries. Got %v", webhookLease)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	clearBookingTable()
+
+	sinks := a.Sinks
+	defer func() { a.Sinks = sinks }()
+
+	// an unbuffered channel nobody reads from refuses every event
+	events := make(chan outboxEvent)
+	a.Sinks = []eventSink{&channelSink{events}}
+
+	future := time.Now().AddDate(0, 0, 7).Truncate(time.Hour)
+	jsonStr := []byte(`{"facility_id": 1, "email": "user@email", "purpose": "sync", "start_dt": "` + future.Format(time.RFC3339) + `", "end_dt": "` + future.Add(time.Hour).Format(time.RFC3339) + `"}`)
+	req, _ := http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("POST", "/booking", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	jsonStr = []byte(`{"name":"Meeting Room L1-01", "level": "1", "description": "Meeting Room", "status": "CLOSED"}`)
+	req, _ = http.NewRequest("PUT", "/facilityDetail/1", bytes.NewBuffer(jsonStr))
+	response = executeRequestAs(req, adminToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if n, err := dispatchOutbox(a.DB, a.Sinks, time.Now()); n != 0 || err != nil {
+		t.Errorf("Expected a full sink to hold up dispatching. Got %v, %v", n, err)
+	}
+
+	var attempts int
+	var lastError string
+	a.DB.QueryRow("SELECT attempts, last_error FROM booking.outbox ORDER BY id LIMIT 1").Scan(&attempts, &lastError)
+	if attempts != 1 || lastError != errSinkFull.Error() {
+		t.Errorf("Expected the failed attempt to be recorded. Got %v, %q", attempts, lastError)
+	}
+
+	events = make(chan outboxEvent, 10)
+	a.Sinks = []eventSink{&channelSink{events}}
+	if n, err := dispatchOutbox(a.DB, a.Sinks, time.Now()); n != 3 || err != nil {
+		t.Fatalf("Expected 3 events to be dispatched. Got %v, %v", n, err)
+	}
+
+	var got []string
+	for len(events) > 0 {
+		e := <-events
+		got = append(got, e.Event)
+	}
+	if strings.Join(got, ",") != "booking.created,facility.updated,facility.status_changed" {
+		t.Errorf("Expected the rejected booking to record no event. Got %v", got)
+	}
+
+	if n, _ := dispatchOutbox(a.DB, a.Sinks, time.Now()); n != 0 {
+		t.Errorf("Expected dispatched events not to be dispatched again. Got %v", n)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/booking/1", nil)
+	response = executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	dispatchOutbox(a.DB, a.Sinks, time.Now())
+	e := <-events
+	var payload webhookPayload
+	json.Unmarshal(e.Payload, &payload)
+	if e.Event != "booking.cancelled" || payload.Data.(map[string]interface{})["status"] != "cancelled" {
+		t.Errorf("Expected the cancellation to carry the cancelled booking. Got '%s'", e.Payload)
+	}
+
+	// an event no sink takes is given up after maxOutboxAttempts and stops holding up the rest
+	writeOutbox(a.DB, "booking.poison", nil)
+	writeOutbox(a.DB, "booking.updated", nil)
+	a.Sinks = []eventSink{&rejectingSink{"booking.poison"}, &channelSink{events}}
+	for i := 1; i < maxOutboxAttempts; i++ {
+		if n, _ := dispatchOutbox(a.DB, a.Sinks, time.Now()); n != 0 {
+			t.Fatalf("Expected the failing event to hold up dispatching until its last attempt. Got %v", n)
+		}
+	}
+	if n, err := dispatchOutbox(a.DB, a.Sinks, time.Now()); n != 1 || err != nil {
+		t.Fatalf("Expected the event after the failed one to be dispatched. Got %v, %v", n, err)
+	}
+	if e = <-events; e.Event != "booking.updated" {
+		t.Errorf("Expected the event after the failed one. Got %v", e.Event)
+	}
+
+	var failed bool
+	a.DB.QueryRow("SELECT attempts, failed_dt IS NOT NULL FROM booking.outbox WHERE event='booking.poison'").Scan(&attempts, &failed)
+	if attempts != maxOutboxAttempts || !failed {
+		t.Errorf("Expected the event to be marked failed after %v attempts. Got %v, %v", maxOutboxAttempts, attempts, failed)
+	}
+
+	// a sink whose SQL fails does not abort the dispatch, so its failures are counted too
+	writeOutbox(a.DB, "booking.broken", nil)
+	writeOutbox(a.DB, "booking.updated", nil)
+	a.Sinks = []eventSink{&brokenSQLSink{"booking.broken"}, &channelSink{events}}
+	for i := 1; i < maxOutboxAttempts; i++ {
+		if n, err := dispatchOutbox(a.DB, a.Sinks, time.Now()); n != 0 || err != nil {
+			t.Fatalf("Expected the failed SQL to be recorded. Got %v, %v", n, err)
+		}
+	}
+	if n, err := dispatchOutbox(a.DB, a.Sinks, time.Now()); n != 1 || err != nil {
+		t.Fatalf("Expected the event after the broken one to be dispatched. Got %v, %v", n, err)
+	}
+
+	a.DB.QueryRow("SELECT attempts, failed_dt IS NOT NULL FROM booking.outbox WHERE event='booking.broken'").Scan(&attempts, &failed)
+	if attempts != maxOutboxAttempts || !failed {
+		t.Errorf("Expected the broken event to be marked failed after %v attempts. Got %v, %v", maxOutboxAttempts, attempts, failed)
+	}
+}
+
+// brokenSQLSink runs a failing statement for every event named event, which aborts the transaction
+// it runs in
+type brokenSQLSink struct {
+	event string
+}
+
+func (s *brokenSQLSink) publish(tx dbtx, e *outboxEvent, now time.Time) error {
+	if e.Event != s.event {
+		return nil
+	}
+	_, err := tx.Exec("SELECT id FROM booking.no_such_table")
+	return err
+}
+
+// rejectingSink refuses every event named event
+type rejectingSink struct {
+	event string
+}
+
+func (s *rejectingSink) publish(tx dbtx, e *outboxEvent, now time.Time) error {
+	if e.Event == s.event {
+		return errors.New("Rejected " + e.Event)
+	}
+	return nil
+}
+
+func TestBookingMailTemplates(t *testing.T) {
+	m, err := confirmationTemplate.render("user@email", bookingMailData{
+		Title:    "Your booking is confirmed",
+		Facility: "Meeting Room L1-01",
+		Bookings: []booking{{Purpose: "<sync>", StartTime: "2021-01-24T10:00:00+08:00", EndTime: "2021-01-24T11:00:00+08:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.To != "user@email" || m.Subject != "Your booking is confirmed" {
+		t.Errorf("Expected the confirmation to be addressed to the owner. Got %v, %q", m.To, m.Subject)
+	}
+
+	if !strings.Contains(m.Body, "Meeting Room L1-01, Sun 24 Jan 2021 10:00 to 11:00 +0800: <sync>") {
+		t.Errorf("Expected the text body to list the booking. Got %q", m.Body)
+	}
+
+	if !strings.Contains(m.HTML, "&lt;sync&gt;") || strings.Contains(m.HTML, "<sync>") {
+		t.Errorf("Expected the HTML body to escape the purpose. Got %q", m.HTML)
+	}
+
+	msg, err := m.message("noreply@email")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boundary := regexp.MustCompile(`multipart/alternative; boundary=(\S+)`).FindSubmatch(msg)
+	body := bytes.SplitN(msg, []byte("\r\n\r\n"), 2)
+	if boundary == nil || len(body) != 2 {
+		t.Fatalf("Expected a multipart message. Got %q", msg)
+	}
+
+	parts := multipart.NewReader(bytes.NewReader(body[1]), string(boundary[1]))
+	for _, expected := range []struct{ contentType, body string }{{"text/plain; charset=UTF-8", m.Body}, {"text/html; charset=UTF-8", m.HTML}} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// line breaks go out as CRLF
+		content, _ := ioutil.ReadAll(part)
+		if part.Header.Get("Content-Type") != expected.contentType || strings.ReplaceAll(string(content), "\r\n", "\n") != expected.body {
+			t.Errorf("Expected a %v part. Got %v %q", expected.contentType, part.Header.Get("Content-Type"), content)
+		}
+	}
+}
+
+func TestBookingConfirmationsAndReminders(t *testing.T) {
+	clearBookingTable()
+	addBookingConfig("reminder_min", "60")
+	defer removeBookingConfig("reminder_min")
+
+	mailer := &memoryMailer{}
+	previous := a.Mailer
+	a.Mailer = mailer
+	defer func() { a.Mailer = previous }()
+
+	now := time.Now().Truncate(time.Minute)
+	book := func(method, url string, start time.Time) {
+		jsonStr := []byte(`{"facility_id": 1, "email": "user@email", "purpose": "sync", "start_dt": "` + start.Format(time.RFC3339) + `", "end_dt": "` + start.Add(time.Hour).Format(time.RFC3339) + `"}`)
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(jsonStr))
+		response := executeRequestAs(req, userToken)
+		if response.Code != http.StatusCreated && response.Code != http.StatusOK {
+			t.Fatalf("Expected %v %v to succeed. Got %v %s", method, url, response.Code, response.Body.String())
+		}
+	}
+
+	book("POST", "/booking", now.Add(30*time.Minute))
+	book("POST", "/booking", now.Add(5*time.Hour))
+	book("PUT", "/booking/2", now.Add(3*time.Hour))
+
+	// confirmations go out as the outbox is dispatched
+	if sent := mailer.messages(); len(sent) != 0 {
+		t.Errorf("Expected no confirmation before the outbox is dispatched. Got %v", sent)
+	}
+	a.dispatchOutbox(time.Now())
+
+	sent := mailer.messages()
+	if len(sent) != 3 || sent[0].Subject != "Your booking is confirmed" || sent[2].Subject != "Your booking has been updated" {
+		t.Fatalf("Expected confirmations of both bookings and the update. Got %v", sent)
+	}
+
+	if sent[0].To != "user@email" || !strings.Contains(sent[0].HTML, "Meeting Room L") {
+		t.Errorf("Expected the confirmation to name the facility. Got %q", sent[0].HTML)
+	}
+
+	// instances racing for the same reminders send each of them once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendReminders(a.DB, mailer, time.Now())
+		}()
+	}
+	wg.Wait()
+	a.runJobs(time.Now())
+
+	reminders := func() int {
+		n := 0
+		for _, m := range mailer.messages() {
+			if m.Subject == "Your booking starts soon" {
+				n++
+			}
+		}
+		return n
+	}
+
+	if reminders() != 1 {
+		t.Errorf("Expected one reminder for the booking starting within the hour. Got %v", reminders())
+	}
+
+	// a reminder that could not be sent is retried, moving a booking lets it be reminded again
+	mailer.Err = errors.New("mail server is down")
+	book("PUT", "/booking/1", now.Add(40*time.Minute))
+	book("PUT", "/booking/2", now.Add(50*time.Minute))
+
+	if n, err := sendReminders(a.DB, mailer, time.Now()); n != 0 || err == nil {
+		t.Errorf("Expected the failed reminder to be reported. Got %v, %v", n, err)
+	}
+
+	// both reminders were tried, a failed mail does not stop the rest of the run
+	var attempts int
+	var reminderError string
+	a.DB.QueryRow("SELECT reminder_attempts, reminder_error FROM booking.booking WHERE id=2").Scan(&attempts, &reminderError)
+	if attempts != 1 || reminderError != "mail server is down" {
+		t.Errorf("Expected the failed attempt to be recorded on the booking. Got %v, %q", attempts, reminderError)
+	}
+
+	mailer.Err = nil
+	if n, err := sendReminders(a.DB, mailer, time.Now()); n != 2 || err != nil {
+		t.Errorf("Expected both rescheduled bookings to be reminded. Got %v, %v", n, err)
+	}
+
+	// a reminder that keeps failing is given up after maxReminderAttempts
+	mailer.Err = errors.New("mailbox unavailable")
+	book("PUT", "/booking/1", now.Add(45*time.Minute))
+	for i := 0; i < maxReminderAttempts; i++ {
+		sendReminders(a.DB, mailer, time.Now())
+	}
+
+	mailer.Err = nil
+	if n, err := sendReminders(a.DB, mailer, time.Now()); n != 0 || err != nil {
+		t.Errorf("Expected the reminder to be given up. Got %v, %v", n, err)
+	}
+
+	req, _ := http.NewRequest("DELETE", "/booking/2?reason=Cancelled+by+owner", nil)
+	response := executeRequestAs(req, userToken)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	a.dispatchOutbox(time.Now())
+	sent = mailer.messages()
+	last := sent[len(sent)-1]
+	if last.Subject != "Your booking has been cancelled" || !strings.Contains(last.Body, "Reason: Cancelled by owner") {
+		t.Errorf("Expected a cancellation with its reason. Got %q %q", last.Subject, last.Body)
+	}
+
+	// changes that come with a notice of their own get no confirmation
+	checkedIn := "2021-01-24T10:00:00+08:00"
+	for _, tt := range []struct {
+		event    string
+		b        booking
+		expected bool
+	}{
+		{eventBookingCreated, booking{Email: "user@email", Status: bookingStatusConfirmed}, true},
+		{eventBookingUpdated, booking{Email: "user@email", Status: bookingStatusConfirmed, CheckedInAt: &checkedIn}, false},
+		{eventBookingCancelled, booking{Email: "user@email", Status: bookingStatusNoShow}, false},
+		{eventBookingCancelled, booking{Email: "user@email", Status: bookingStatusCancelled, CancelReason: approvalExpiredReason}, false},
+		{eventBookingCancelled, booking{Email: "user@email", Status: bookingStatusCancelled, CancelReason: maintenanceReasonPrefix + "Aircon"}, false},
+		{eventBookingCancelled, booking{Status: bookingStatusCancelled}, false},
+	} {
+		if got := needsConfirmation(tt.event, &tt.b); got != tt.expected {
+			t.Errorf("Expected a confirmation of %v %+v to be %v. Got %v", tt.event, tt.b, tt.expected, got)
+		}
+	}
+}
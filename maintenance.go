@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// maintenanceWindow blocks bookings of a facility between start_dt and end_dt
+type maintenanceWindow struct {
+	ID              int    `json:"id"`
+	FacilityID      int    `json:"facility_id"`
+	Reason          string `json:"reason"`
+	StartTime       string `json:"start_dt"`
+	EndTime         string `json:"end_dt"`
+	CreatedBy       string `json:"created_by"`
+	TransactionTime string `json:"transaction_dt"`
+}
+
+// maintenanceRequest is the payload for scheduling a maintenance window, with cancel_conflicts
+// the bookings it conflicts with are cancelled instead of only being listed
+type maintenanceRequest struct {
+	maintenanceWindow
+	CancelConflicts bool `json:"cancel_conflicts"`
+}
+
+type maintenanceResult struct {
+	Window    maintenanceWindow `json:"maintenance_window"`
+	Conflicts []booking         `json:"conflicts"`
+	Cancelled bool              `json:"cancelled"`
+}
+
+func (p *maintenanceWindow) validate() error {
+	start, err := parseBookingTime(p.StartTime)
+	if err != nil {
+		return &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	end, err := parseBookingTime(p.EndTime)
+	if err != nil {
+		return &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	if !start.Before(end) {
+		return &ruleViolation{"invalid_interval", "start_dt must be before end_dt"}
+	}
+
+	return nil
+}
+
+func (p *maintenanceWindow) getMaintenanceWindow(db dbtx) error {
+	return db.QueryRow("SELECT facility_id, reason, start_dt, end_dt, created_by, transaction_dt FROM booking.maintenance_window WHERE id=$1",
+		p.ID).Scan(&p.FacilityID, &p.Reason, &p.StartTime, &p.EndTime, &p.CreatedBy, &p.TransactionTime)
+}
+
+func (p *maintenanceWindow) createMaintenanceWindow(db dbtx) error {
+	currentTime := time.Now()
+	return db.QueryRow(
+		"INSERT INTO booking.maintenance_window(facility_id, reason, start_dt, end_dt, created_by, transaction_dt) VALUES($1, $2, $3, $4, $5, $6) RETURNING id",
+		p.FacilityID, p.Reason, p.StartTime, p.EndTime, p.CreatedBy, currentTime).Scan(&p.ID)
+}
+
+func (p *maintenanceWindow) updateMaintenanceWindow(db dbtx) error {
+	currentTime := time.Now()
+	_, err :=
+		db.Exec("UPDATE booking.maintenance_window SET facility_id=$1, reason=$2, start_dt=$3, end_dt=$4, transaction_dt=$5 WHERE id=$6",
+			p.FacilityID, p.Reason, p.StartTime, p.EndTime, currentTime, p.ID)
+
+	return err
+}
+
+func (p *maintenanceWindow) deleteMaintenanceWindow(db dbtx) error {
+	_, err := db.Exec("DELETE FROM booking.maintenance_window WHERE id=$1", p.ID)
+
+	return err
+}
+
+// getConflictingBookings returns the pending and confirmed bookings of the facility that fall inside the window
+func (p *maintenanceWindow) getConflictingBookings(db dbtx) ([]booking, error) {
+	rows, err := db.Query(
+		"SELECT "+bookingColumns+" FROM booking.booking WHERE facility_id=$1 AND start_dt < $3::timestamptz AND end_dt > $2::timestamptz AND status IN ($4, $5) ORDER BY start_dt",
+		p.FacilityID, p.StartTime, p.EndTime, bookingStatusPending, bookingStatusConfirmed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	bookings := []booking{}
+
+	for rows.Next() {
+		var b booking
+		if err := rows.Scan(b.scanTargets()...); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, b)
+	}
+
+	return bookings, rows.Err()
+}
+
+// maintenanceReasonPrefix starts the cancel reason of the bookings cancelled for maintenance, their
+// owners are told by maintenanceNotice
+const maintenanceReasonPrefix = "Maintenance: "
+
+// saveMaintenanceWindow creates p, or updates it when it has an ID, and returns the bookings it
+// conflicts with, which are cancelled in the same transaction when cancelConflicts is set
+func (p *maintenanceWindow) saveMaintenanceWindow(db *sql.DB, cancelConflicts bool) ([]booking, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+
+	var conflicts []booking
+	err := withTx(db, func(tx *sql.Tx) error {
+		var err error
+		if p.ID == 0 {
+			err = p.createMaintenanceWindow(tx)
+		} else {
+			err = p.updateMaintenanceWindow(tx)
+		}
+		if err != nil {
+			return err
+		}
+
+		if conflicts, err = p.getConflictingBookings(tx); err != nil {
+			return err
+		}
+
+		if cancelConflicts {
+			for i := range conflicts {
+				if err := conflicts[i].cancelBooking(tx, maintenanceReasonPrefix+p.Reason, p.CreatedBy); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return conflicts, err
+}
+
+func getMaintenanceWindows(db dbtx, start, count, facilityID int) ([]maintenanceWindow, error) {
+	rows, err := db.Query(
+		"SELECT id, facility_id, reason, start_dt, end_dt, created_by, transaction_dt FROM booking.maintenance_window WHERE ($1 = 0 OR facility_id = $1) ORDER BY start_dt, id LIMIT $2 OFFSET $3",
+		facilityID, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	windows := []maintenanceWindow{}
+
+	for rows.Next() {
+		var p maintenanceWindow
+		if err := rows.Scan(&p.ID, &p.FacilityID, &p.Reason, &p.StartTime, &p.EndTime, &p.CreatedBy, &p.TransactionTime); err != nil {
+			return nil, err
+		}
+		windows = append(windows, p)
+	}
+
+	return windows, rows.Err()
+}
+
+// getMaintenanceIntervals returns the maintenance windows of facilityID that intersect w
+func getMaintenanceIntervals(db dbtx, facilityID int, w interval) ([]interval, error) {
+	rows, err := db.Query(
+		"SELECT start_dt, end_dt FROM booking.maintenance_window WHERE facility_id=$1 AND start_dt < $3 AND end_dt > $2",
+		facilityID, w.Start, w.End)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	closed := []interval{}
+
+	for rows.Next() {
+		var m interval
+		if err := rows.Scan(&m.Start, &m.End); err != nil {
+			return nil, err
+		}
+		closed = append(closed, m)
+	}
+
+	return closed, rows.Err()
+}
+
+// maintenanceNotice tells the owner of b about maintenance window p
+func maintenanceNotice(p *maintenanceWindow, b *booking, cancelled bool) mail {
+	action := "Please move it to another time or facility."
+	if cancelled {
+		action = "Your booking has been cancelled."
+	}
+
+	return mail{
+		To:      b.Email,
+		Subject: "Scheduled maintenance affects your booking",
+		Body: fmt.Sprintf("Facility %v is under maintenance from %v to %v (%v).\n\nYour booking from %v to %v falls in this window. %v\n",
+			p.FacilityID, p.StartTime, p.EndTime, p.Reason, b.StartTime, b.EndTime, action),
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	outboxBatchSize = 100
+	// maxOutboxAttempts is how many times an event is dispatched before it is given up as failed,
+	// so that an event no sink takes cannot hold up the events after it
+	maxOutboxAttempts = 5
+	// outboxRetention is how long dispatched events are kept for inspection before they are deleted
+	outboxRetention = 7 * 24 * time.Hour
+	// outboxLockKey is the advisory lock held by the instance that is dispatching the outbox
+	outboxLockKey = 7260401
+)
+
+// errSinkFull is returned by a channelSink whose buffer is full, the event is retried later
+var errSinkFull = errors.New("Event sink is full")
+
+// outboxEvent is a change recorded in the same transaction as the change itself, its payload is
+// the JSON body that webhooks receive
+type outboxEvent struct {
+	ID        int             `json:"id"`
+	Event     string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	CreatedAt string          `json:"created_dt"`
+}
+
+// eventSink receives the events read from the outbox. An event may be handed over more than once
+// if dispatching fails part way, so sinks must tolerate duplicates. tx is the dispatcher's
+// transaction, a sink that writes to the database should use it so its writes commit with the dispatch.
+// now is the time of the dispatch.
+type eventSink interface {
+	publish(tx dbtx, e *outboxEvent, now time.Time) error
+}
+
+// webhookSink queues a delivery of each event for the webhooks subscribed to it
+type webhookSink struct{}
+
+func (s *webhookSink) publish(tx dbtx, e *outboxEvent, now time.Time) error {
+	return queueWebhookDeliveries(tx, e.Event, e.Payload, now)
+}
+
+// logSink writes each event to a logger
+type logSink struct {
+	Logger *log.Logger
+}
+
+func (s *logSink) publish(tx dbtx, e *outboxEvent, now time.Time) error {
+	s.Logger.Printf("%v %v %s", e.ID, e.Event, e.Payload)
+	return nil
+}
+
+// channelSink hands events to in-process consumers, it never blocks the dispatcher
+type channelSink struct {
+	C chan outboxEvent
+}
+
+func (s *channelSink) publish(tx dbtx, e *outboxEvent, now time.Time) error {
+	select {
+	case s.C <- *e:
+		return nil
+	default:
+		return errSinkFull
+	}
+}
+
+// withinTx runs fn in db when it is already a transaction, otherwise in a new transaction, so that
+// a change and its outbox event always commit together
+func withinTx(db dbtx, fn func(tx dbtx) error) error {
+	if sqlDB, ok := db.(*sql.DB); ok {
+		return withTx(sqlDB, func(tx *sql.Tx) error {
+			return fn(tx)
+		})
+	}
+
+	return fn(db)
+}
+
+// writeOutbox records event with data, the booking or facility after the change. It must run in
+// the transaction that makes the change.
+func writeOutbox(tx dbtx, event string, data interface{}) error {
+	now := time.Now()
+	payload, err := json.Marshal(webhookPayload{event, now.Format(time.RFC3339Nano), data})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO booking.outbox(event, payload, created_dt) VALUES($1, $2, $3)", event, string(payload), now)
+	return err
+}
+
+// writeBookingEvents records event for each of bookings, or the event matching each booking's
+// status when event is empty
+func writeBookingEvents(tx dbtx, event string, bookings ...booking) error {
+	for i := range bookings {
+		e := event
+		if len(e) == 0 {
+			e = bookingEvent(&bookings[i])
+		}
+		if err := writeOutbox(tx, e, bookings[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishEvent hands e to every sink, stopping at the first that fails
+func publishEvent(tx dbtx, sinks []eventSink, e *outboxEvent, now time.Time) error {
+	for _, s := range sinks {
+		if err := s.publish(tx, e, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dispatchOutbox hands the undispatched events to every sink in the order they were written and
+// returns how many were dispatched. Only one instance dispatches at a time. An event is marked
+// dispatched once all sinks took it, a sink failure leaves it and the events after it for the next
+// run, so sinks that already took it get it again. After maxOutboxAttempts the event is marked
+// failed instead and the events after it are dispatched. Each event is published under a savepoint,
+// so a sink whose SQL fails only rolls back its own event and the failure can still be recorded.
+func dispatchOutbox(db *sql.DB, sinks []eventSink, now time.Time) (int, error) {
+	dispatched := 0
+
+	err := withTx(db, func(tx *sql.Tx) error {
+		var locked bool
+		if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", outboxLockKey).Scan(&locked); err != nil || !locked {
+			return err
+		}
+
+		rows, err := tx.Query("SELECT id, event, payload, attempts, created_dt FROM booking.outbox WHERE dispatched_dt IS NULL AND failed_dt IS NULL ORDER BY id LIMIT $1", outboxBatchSize)
+		if err != nil {
+			return err
+		}
+
+		events := []outboxEvent{}
+		for rows.Next() {
+			var e outboxEvent
+			var payload string
+			if err := rows.Scan(&e.ID, &e.Event, &payload, &e.Attempts, &e.CreatedAt); err != nil {
+				rows.Close()
+				return err
+			}
+			e.Payload = json.RawMessage(payload)
+			events = append(events, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i := range events {
+			if _, err := tx.Exec("SAVEPOINT outbox_event"); err != nil {
+				return err
+			}
+
+			if err := publishEvent(tx, sinks, &events[i], now); err != nil {
+				log.Printf("Failed to dispatch event %v: %v", events[i].ID, err)
+				if _, err := tx.Exec("ROLLBACK TO SAVEPOINT outbox_event"); err != nil {
+					return err
+				}
+
+				var failedAt interface{}
+				if events[i].Attempts+1 >= maxOutboxAttempts {
+					failedAt = now
+				}
+				if _, err := tx.Exec("UPDATE booking.outbox SET attempts=attempts+1, last_error=$1, failed_dt=$2 WHERE id=$3", err.Error(), failedAt, events[i].ID); err != nil {
+					return err
+				}
+
+				if failedAt == nil {
+					break
+				}
+				continue
+			}
+
+			if _, err := tx.Exec("RELEASE SAVEPOINT outbox_event"); err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec("UPDATE booking.outbox SET attempts=attempts+1, last_error='', dispatched_dt=$1 WHERE id=$2", now, events[i].ID); err != nil {
+				return err
+			}
+			dispatched++
+		}
+
+		_, err = tx.Exec("DELETE FROM booking.outbox WHERE dispatched_dt < $1 OR failed_dt < $1", now.Add(-outboxRetention))
+		return err
+	})
+
+	return dispatched, err
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// quota roles, a booking's owner has the admin role when their account is an admin
+const (
+	quotaRoleAdmin = "admin"
+	quotaRoleUser  = "user"
+)
+
+// bookingQuota limits the bookings of everyone with a role or of a single user, a zero limit is
+// unlimited. A user's own quota replaces the quota of their role.
+type bookingQuota struct {
+	ID                     int     `json:"id"`
+	Role                   string  `json:"role"`
+	UserID                 string  `json:"user_id"`
+	MaxActiveBookings      int     `json:"max_active_bookings"`
+	MaxHrPerDay            float64 `json:"max_hr_per_day"`
+	MaxHrPerWeek           float64 `json:"max_hr_per_week"`
+	MaxBookingsPerFacility int     `json:"max_bookings_per_facility"`
+}
+
+// quotaUsage is a user's current usage against their quota, days and weeks are those of now
+type quotaUsage struct {
+	Quota               bookingQuota `json:"quota"`
+	ActiveBookings      int          `json:"active_bookings"`
+	HrToday             float64      `json:"hr_today"`
+	HrThisWeek          float64      `json:"hr_this_week"`
+	BookingsPerFacility map[int]int  `json:"bookings_per_facility"`
+}
+
+const bookingQuotaColumns = "id, COALESCE(role, ''), COALESCE(user_id, ''), max_active_bookings, max_hr_per_day, max_hr_per_week, max_bookings_per_facility"
+
+func (p *bookingQuota) scanTargets() []interface{} {
+	return []interface{}{&p.ID, &p.Role, &p.UserID, &p.MaxActiveBookings, &p.MaxHrPerDay, &p.MaxHrPerWeek, &p.MaxBookingsPerFacility}
+}
+
+func (p *bookingQuota) validate() error {
+	if (len(p.Role) == 0) == (len(p.UserID) == 0) {
+		return &ruleViolation{"invalid_quota", "A quota needs either a role or a user_id"}
+	}
+
+	if len(p.Role) > 0 && p.Role != quotaRoleAdmin && p.Role != quotaRoleUser {
+		return &ruleViolation{"invalid_quota", fmt.Sprintf("Invalid role %q", p.Role)}
+	}
+
+	if p.MaxActiveBookings < 0 || p.MaxHrPerDay < 0 || p.MaxHrPerWeek < 0 || p.MaxBookingsPerFacility < 0 {
+		return &ruleViolation{"invalid_quota", "Quota limits cannot be negative"}
+	}
+
+	return nil
+}
+
+func (p *bookingQuota) getBookingQuota(db dbtx) error {
+	return db.QueryRow("SELECT "+bookingQuotaColumns+" FROM booking.booking_quota WHERE id=$1", p.ID).Scan(p.scanTargets()...)
+}
+
+func (p *bookingQuota) createBookingQuota(db dbtx) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	err := db.QueryRow(
+		"INSERT INTO booking.booking_quota(role, user_id, max_active_bookings, max_hr_per_day, max_hr_per_week, max_bookings_per_facility) VALUES(NULLIF($1, ''), NULLIF($2, ''), $3, $4, $5, $6) RETURNING id",
+		p.Role, p.UserID, p.MaxActiveBookings, p.MaxHrPerDay, p.MaxHrPerWeek, p.MaxBookingsPerFacility).Scan(&p.ID)
+
+	return quotaError(err)
+}
+
+func (p *bookingQuota) updateBookingQuota(db dbtx) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	_, err :=
+		db.Exec("UPDATE booking.booking_quota SET role=NULLIF($1, ''), user_id=NULLIF($2, ''), max_active_bookings=$3, max_hr_per_day=$4, max_hr_per_week=$5, max_bookings_per_facility=$6 WHERE id=$7",
+			p.Role, p.UserID, p.MaxActiveBookings, p.MaxHrPerDay, p.MaxHrPerWeek, p.MaxBookingsPerFacility, p.ID)
+
+	return quotaError(err)
+}
+
+// quotaError maps a violation of the unique role or user_id of booking_quota to a rule violation
+func quotaError(err error) error {
+	if e, ok := err.(*pq.Error); ok && e.Code == "23505" {
+		return &ruleViolation{"duplicate_quota", "A quota already exists for this role or user"}
+	}
+
+	return err
+}
+
+func (p *bookingQuota) deleteBookingQuota(db dbtx) error {
+	_, err := db.Exec("DELETE FROM booking.booking_quota WHERE id=$1", p.ID)
+
+	return err
+}
+
+func getBookingQuotas(db dbtx, start, count int) ([]bookingQuota, error) {
+	rows, err := db.Query(
+		"SELECT "+bookingQuotaColumns+" FROM booking.booking_quota ORDER BY id LIMIT $1 OFFSET $2",
+		count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	quotas := []bookingQuota{}
+
+	for rows.Next() {
+		var p bookingQuota
+		if err := rows.Scan(p.scanTargets()...); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, p)
+	}
+
+	return quotas, rows.Err()
+}
+
+// getUserQuota returns the quota that applies to userID, without one every limit is zero
+func getUserQuota(db dbtx, userID string) (bookingQuota, error) {
+	var p bookingQuota
+	err := db.QueryRow(
+		"SELECT "+bookingQuotaColumns+" FROM booking.booking_quota WHERE user_id=$1 OR role=COALESCE((SELECT CASE WHEN admin THEN $2 ELSE $3 END FROM booking.account WHERE user_id=$1), $3) ORDER BY user_id IS NULL LIMIT 1",
+		userID, quotaRoleAdmin, quotaRoleUser).Scan(p.scanTargets()...)
+
+	if err == sql.ErrNoRows {
+		return bookingQuota{}, nil
+	}
+
+	return p, err
+}
+
+// countActiveBookings counts the pending and confirmed bookings of userID that have not ended,
+// on facilityID only when it is given, the booking excludeID is left out
+func countActiveBookings(db dbtx, userID string, facilityID, excludeID int, now time.Time) (int, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT (id) FROM booking.booking WHERE user_id=$1 AND ($2 = 0 OR facility_id=$2) AND id <> $3 AND end_dt > $4 AND status IN ($5, $6)",
+		userID, facilityID, excludeID, now, bookingStatusPending, bookingStatusConfirmed).Scan(&count)
+
+	return count, err
+}
+
+// bookedHours sums the hours of userID's active bookings that fall inside w, the booking excludeID is left out
+func bookedHours(db dbtx, userID string, excludeID int, w interval) (float64, error) {
+	var seconds float64
+	err := db.QueryRow(
+		"SELECT COALESCE(SUM(EXTRACT(EPOCH FROM LEAST(end_dt, $4) - GREATEST(start_dt, $3))), 0) FROM booking.booking WHERE user_id=$1 AND id <> $2 AND start_dt < $4 AND end_dt > $3 AND status IN "+activeBookingStatuses,
+		userID, excludeID, w.Start, w.End).Scan(&seconds)
+
+	return seconds / 3600, err
+}
+
+// dayOf and weekOf return the calendar day and the Monday to Sunday week containing t, in facilityZone
+// so that the offset a booking is sent with cannot move its hours to another day
+func dayOf(t time.Time) interval {
+	t = t.In(facilityZone)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, facilityZone)
+	return interval{day, day.AddDate(0, 0, 1)}
+}
+
+func weekOf(t time.Time) interval {
+	day := dayOf(t).Start
+	monday := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	return interval{monday, monday.AddDate(0, 0, 7)}
+}
+
+// checkHourQuota rejects p if it takes userID over max hours in any of the periods it touches
+func checkHourQuota(db dbtx, p *booking, start, end time.Time, max float64, period func(time.Time) interval, rule, name string) error {
+	for w := period(start); w.Start.Before(end); w = period(w.End) {
+		used, err := bookedHours(db, p.UserID, p.ID, w)
+		if err != nil {
+			return err
+		}
+
+		from, to := start, end
+		if from.Before(w.Start) {
+			from = w.Start
+		}
+		if to.After(w.End) {
+			to = w.End
+		}
+
+		if used+to.Sub(from).Hours() > max {
+			return &ruleViolation{rule, fmt.Sprintf("Booking exceeds the quota of %v hours per %v", formatFloat(max), name)}
+		}
+	}
+
+	return nil
+}
+
+// checkQuota rejects p if it takes its owner over the quota that applies to them. The owner's
+// account is locked until the transaction ends so that concurrent bookings are counted one at a time.
+func checkQuota(db dbtx, p *booking, now time.Time) error {
+	quota, err := getUserQuota(db, p.UserID)
+	if err != nil {
+		return err
+	}
+
+	if quota.MaxActiveBookings > 0 || quota.MaxBookingsPerFacility > 0 || quota.MaxHrPerDay > 0 || quota.MaxHrPerWeek > 0 {
+		if _, err := db.Exec("SELECT id FROM booking.account WHERE user_id=$1 FOR UPDATE", p.UserID); err != nil {
+			return err
+		}
+	}
+
+	start, end, err := p.interval()
+	if err != nil {
+		return &ruleViolation{"invalid_time", "Invalid start_dt or end_dt"}
+	}
+
+	// bookings that already ended do not use up the active booking quotas
+	if end.After(now) {
+		if quota.MaxActiveBookings > 0 {
+			count, err := countActiveBookings(db, p.UserID, 0, p.ID, now)
+			if err != nil {
+				return err
+			}
+			if count >= quota.MaxActiveBookings {
+				return &ruleViolation{"max_active_bookings",
+					fmt.Sprintf("Cannot have more than %v active bookings", quota.MaxActiveBookings)}
+			}
+		}
+
+		if quota.MaxBookingsPerFacility > 0 {
+			count, err := countActiveBookings(db, p.UserID, p.FacilityID, p.ID, now)
+			if err != nil {
+				return err
+			}
+			if count >= quota.MaxBookingsPerFacility {
+				return &ruleViolation{"max_bookings_per_facility",
+					fmt.Sprintf("Cannot have more than %v active bookings of one facility", quota.MaxBookingsPerFacility)}
+			}
+		}
+	}
+
+	if quota.MaxHrPerDay > 0 {
+		if err := checkHourQuota(db, p, start, end, quota.MaxHrPerDay, dayOf, "max_hr_per_day", "day"); err != nil {
+			return err
+		}
+	}
+
+	if quota.MaxHrPerWeek > 0 {
+		return checkHourQuota(db, p, start, end, quota.MaxHrPerWeek, weekOf, "max_hr_per_week", "week")
+	}
+
+	return nil
+}
+
+// getQuotaUsage returns the quota of userID together with what they currently use of it
+func getQuotaUsage(db dbtx, userID string, now time.Time) (quotaUsage, error) {
+	usage := quotaUsage{BookingsPerFacility: map[int]int{}}
+
+	var err error
+	if usage.Quota, err = getUserQuota(db, userID); err != nil {
+		return usage, err
+	}
+
+	if usage.ActiveBookings, err = countActiveBookings(db, userID, 0, 0, now); err != nil {
+		return usage, err
+	}
+
+	if usage.HrToday, err = bookedHours(db, userID, 0, dayOf(now)); err != nil {
+		return usage, err
+	}
+
+	if usage.HrThisWeek, err = bookedHours(db, userID, 0, weekOf(now)); err != nil {
+		return usage, err
+	}
+
+	rows, err := db.Query(
+		"SELECT facility_id, COUNT (id) FROM booking.booking WHERE user_id=$1 AND end_dt > $2 AND status IN ($3, $4) GROUP BY facility_id",
+		userID, now, bookingStatusPending, bookingStatusConfirmed)
+
+	if err != nil {
+		return usage, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var facilityID, count int
+		if err := rows.Scan(&facilityID, &count); err != nil {
+			return usage, err
+		}
+		usage.BookingsPerFacility[facilityID] = count
+	}
+
+	return usage, rows.Err()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const accessTokenTTL = time.Hour
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+type contextKey string
+
+const accountContextKey contextKey = "account"
+
+// session is returned by /login and /refresh, only the hashes of the tokens are stored
+type session struct {
+	account
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    string `json:"expires_dt"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func createSession(db dbtx, acc account) (session, error) {
+	s := session{account: acc}
+
+	var err error
+	if s.AccessToken, err = newToken(); err != nil {
+		return s, err
+	}
+	if s.RefreshToken, err = newToken(); err != nil {
+		return s, err
+	}
+
+	currentTime := time.Now()
+	expiresAt := currentTime.Add(accessTokenTTL)
+	s.ExpiresAt = expiresAt.Format(time.RFC3339)
+
+	_, err = db.Exec(
+		"INSERT INTO booking.session(user_id, access_token_hash, refresh_token_hash, expires_dt, refresh_expires_dt, transaction_dt) VALUES($1, $2, $3, $4, $5, $6)",
+		acc.UserID, hashToken(s.AccessToken), hashToken(s.RefreshToken), expiresAt, currentTime.Add(refreshTokenTTL), currentTime)
+
+	return s, err
+}
+
+// refreshSession revokes the session holding refreshToken and issues a new one,
+// sql.ErrNoRows is returned for an unknown, revoked or expired refresh token
+func refreshSession(db *sql.DB, refreshToken string) (session, error) {
+	var s session
+
+	err := withTx(db, func(tx *sql.Tx) error {
+		var id int
+		var acc account
+		err := tx.QueryRow(
+			"SELECT s.id, a.id, a.user_id, a.admin, a.email, a.email_verified, a.active FROM booking.session s JOIN booking.account a ON a.user_id = s.user_id WHERE s.refresh_token_hash=$1 AND s.revoked_dt IS NULL AND s.refresh_expires_dt > now() AND a.active FOR UPDATE OF s",
+			hashToken(refreshToken)).Scan(&id, &acc.ID, &acc.UserID, &acc.Admin, &acc.Email, &acc.EmailVerified, &acc.Active)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE booking.session SET revoked_dt=$1 WHERE id=$2", time.Now(), id); err != nil {
+			return err
+		}
+
+		s, err = createSession(tx, acc)
+		return err
+	})
+
+	return s, err
+}
+
+func revokeSession(db dbtx, accessToken string) error {
+	_, err := db.Exec("UPDATE booking.session SET revoked_dt=$1 WHERE access_token_hash=$2 AND revoked_dt IS NULL",
+		time.Now(), hashToken(accessToken))
+
+	return err
+}
+
+func getSessionAccount(db dbtx, accessToken string) (account, error) {
+	var acc account
+	err := db.QueryRow(
+		"SELECT a.id, a.user_id, a.admin, a.email, a.email_verified, a.active FROM booking.session s JOIN booking.account a ON a.user_id = s.user_id WHERE s.access_token_hash=$1 AND s.revoked_dt IS NULL AND s.expires_dt > now() AND a.active",
+		hashToken(accessToken)).Scan(&acc.ID, &acc.UserID, &acc.Admin, &acc.Email, &acc.EmailVerified, &acc.Active)
+
+	return acc, err
+}
+
+// bearerToken returns the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return ""
+}
+
+// accountFromContext returns the caller resolved by App.authenticateRequest
+func accountFromContext(ctx context.Context) (account, bool) {
+	acc, ok := ctx.Value(accountContextKey).(account)
+	return acc, ok
+}
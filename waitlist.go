@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// waitlist entry statuses, an entry waits until its slot frees up and is then either
+// promoted straight to a booking or offered to its owner to claim
+const (
+	waitlistWaiting   = "waiting"
+	waitlistOffered   = "offered"
+	waitlistPromoted  = "promoted"
+	waitlistClaimed   = "claimed"
+	waitlistExpired   = "expired"
+	waitlistWithdrawn = "withdrawn"
+)
+
+// errWaitlistChanged is returned when a waitlist entry no longer has the status it was read with
+var errWaitlistChanged = errors.New("Waitlist entry has changed, reload and retry")
+
+const waitlistColumns = "id, user_id, email, purpose, facility_id, start_dt, end_dt, status, offer_expires_dt, COALESCE(booking_id, 0), transaction_dt"
+
+type waitlistEntry struct {
+	ID              int     `json:"id"`
+	UserID          string  `json:"user_id"`
+	Email           string  `json:"email"`
+	Purpose         string  `json:"purpose"`
+	FacilityID      int     `json:"facility_id"`
+	StartTime       string  `json:"start_dt"`
+	EndTime         string  `json:"end_dt"`
+	Status          string  `json:"status"`
+	OfferExpiresAt  *string `json:"offer_expires_dt"`
+	BookingID       int     `json:"booking_id"`
+	TransactionTime string  `json:"transaction_dt"`
+}
+
+func (p *waitlistEntry) scanTargets() []interface{} {
+	return []interface{}{&p.ID, &p.UserID, &p.Email, &p.Purpose, &p.FacilityID, &p.StartTime, &p.EndTime,
+		&p.Status, &p.OfferExpiresAt, &p.BookingID, &p.TransactionTime}
+}
+
+// booking returns the booking p is waiting for
+func (p *waitlistEntry) booking() booking {
+	return booking{
+		UserID:     p.UserID,
+		Email:      p.Email,
+		Purpose:    p.Purpose,
+		FacilityID: p.FacilityID,
+		StartTime:  p.StartTime,
+		EndTime:    p.EndTime,
+	}
+}
+
+func (p *waitlistEntry) getWaitlistEntry(db dbtx) error {
+	return db.QueryRow("SELECT "+waitlistColumns+" FROM booking.waitlist WHERE id=$1", p.ID).Scan(p.scanTargets()...)
+}
+
+// joinWaitlist adds p to the waitlist, only a slot that passes the booking rules but is
+// currently taken can be waited for
+func (p *waitlistEntry) joinWaitlist(db *sql.DB) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		b := p.booking()
+		if err := validateBooking(tx, &b, time.Now()); err != nil {
+			return err
+		}
+
+		switch err := b.checkOverlap(tx); err {
+		case errBookingOverlap:
+		case nil:
+			return &ruleViolation{"slot_available", "The slot is available, book it instead"}
+		default:
+			return err
+		}
+
+		p.Status = waitlistWaiting
+		return tx.QueryRow(
+			"INSERT INTO booking.waitlist(user_id, email, purpose, facility_id, start_dt, end_dt, status, transaction_dt) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING "+waitlistColumns,
+			p.UserID, p.Email, p.Purpose, p.FacilityID, p.StartTime, p.EndTime, p.Status, time.Now()).Scan(p.scanTargets()...)
+	})
+}
+
+// setWaitlistStatus moves p from the status it was read with to status, it returns
+// errWaitlistChanged if the entry has moved on since
+func (p *waitlistEntry) setWaitlistStatus(db dbtx, status string) error {
+	currentTime := time.Now()
+	res, err := db.Exec("UPDATE booking.waitlist SET status=$1, transaction_dt=$2 WHERE id=$3 AND status=$4", status, currentTime, p.ID, p.Status)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errWaitlistChanged
+	}
+
+	p.Status = status
+
+	return nil
+}
+
+// withdraw removes p from the waitlist unless it has already been booked
+func (p *waitlistEntry) withdraw(db dbtx) error {
+	if p.Status != waitlistWaiting && p.Status != waitlistOffered {
+		return &ruleViolation{"invalid_status", fmt.Sprintf("Cannot withdraw a %v waitlist entry", p.Status)}
+	}
+
+	return p.setWaitlistStatus(db, waitlistWithdrawn)
+}
+
+// claim books the slot offered to p
+func (p *waitlistEntry) claim(db *sql.DB, now time.Time) (booking, error) {
+	var b booking
+
+	err := withTx(db, func(tx *sql.Tx) error {
+		var open bool
+		err := tx.QueryRow("SELECT "+waitlistColumns+", COALESCE(offer_expires_dt > $2, false) FROM booking.waitlist WHERE id=$1 FOR UPDATE",
+			p.ID, now).Scan(append(p.scanTargets(), &open)...)
+		if err != nil {
+			return err
+		}
+
+		if p.Status != waitlistOffered || !open {
+			return &ruleViolation{"invalid_status", "There is no open offer for this waitlist entry"}
+		}
+
+		b = p.booking()
+		if err := validateBooking(tx, &b, now); err != nil {
+			return err
+		}
+		if err := b.checkOverlap(tx); err != nil {
+			return err
+		}
+		if err := b.createBooking(tx); err != nil {
+			return err
+		}
+
+		p.BookingID = b.ID
+		if _, err := tx.Exec("UPDATE booking.waitlist SET booking_id=$1 WHERE id=$2", b.ID, p.ID); err != nil {
+			return err
+		}
+
+		return p.setWaitlistStatus(tx, waitlistClaimed)
+	})
+
+	return b, err
+}
+
+// getWaitlist lists waitlist entries, only those of userid when it is given
+func getWaitlist(db dbtx, start, count int, userid string) ([]waitlistEntry, error) {
+	rows, err := db.Query(
+		"SELECT "+waitlistColumns+" FROM booking.waitlist WHERE ($1 = '' OR user_id = $1) ORDER BY id LIMIT $2 OFFSET $3",
+		userid, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []waitlistEntry{}
+
+	for rows.Next() {
+		var p waitlistEntry
+		if err := rows.Scan(p.scanTargets()...); err != nil {
+			return nil, err
+		}
+		entries = append(entries, p)
+	}
+
+	return entries, rows.Err()
+}
+
+// promoteWaitlist hands the free slots of facilityID to the waiting entries in the order they
+// joined. Without waitlist_claim_min the slot is booked for them straight away, with it they are
+// offered the slot for that long and no other entry is offered an overlapping slot meanwhile.
+// The entries that were promoted or offered are returned.
+func promoteWaitlist(db *sql.DB, facilityID int, now time.Time) ([]waitlistEntry, error) {
+	changed := []waitlistEntry{}
+
+	err := withTx(db, func(tx *sql.Tx) error {
+		rules, err := getBookingRules(tx)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(
+			"SELECT "+waitlistColumns+" FROM booking.waitlist WHERE facility_id=$1 AND status=$2 AND start_dt > $3 ORDER BY id FOR UPDATE",
+			facilityID, waitlistWaiting, now)
+		if err != nil {
+			return err
+		}
+
+		var waiting []waitlistEntry
+		for rows.Next() {
+			var e waitlistEntry
+			if err := rows.Scan(e.scanTargets()...); err != nil {
+				rows.Close()
+				return err
+			}
+			waiting = append(waiting, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, e := range waiting {
+			b := e.booking()
+			err := validateBooking(tx, &b, now)
+			if err == nil {
+				err = b.checkOverlap(tx)
+			}
+			if _, ok := err.(*ruleViolation); ok || err == errBookingOverlap {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if rules.WaitlistClaim == 0 {
+				if err := b.createBooking(tx); err != nil {
+					return err
+				}
+
+				e.BookingID = b.ID
+				if _, err := tx.Exec("UPDATE booking.waitlist SET booking_id=$1 WHERE id=$2", b.ID, e.ID); err != nil {
+					return err
+				}
+				if err := e.setWaitlistStatus(tx, waitlistPromoted); err != nil {
+					return err
+				}
+
+				changed = append(changed, e)
+				continue
+			}
+
+			var offered int
+			err = tx.QueryRow(
+				"SELECT COUNT (id) FROM booking.waitlist WHERE facility_id=$1 AND status=$2 AND offer_expires_dt > $3 AND start_dt < $5::timestamptz AND end_dt > $4::timestamptz",
+				facilityID, waitlistOffered, now, e.StartTime, e.EndTime).Scan(&offered)
+			if err != nil {
+				return err
+			}
+			if offered > 0 {
+				continue
+			}
+
+			expires := now.Add(rules.WaitlistClaim)
+			if _, err := tx.Exec("UPDATE booking.waitlist SET status=$1, offer_expires_dt=$2, transaction_dt=$3 WHERE id=$4",
+				waitlistOffered, expires, now, e.ID); err != nil {
+				return err
+			}
+
+			offer := expires.Format(time.RFC3339Nano)
+			e.Status, e.OfferExpiresAt = waitlistOffered, &offer
+			changed = append(changed, e)
+		}
+
+		return nil
+	})
+
+	return changed, err
+}
+
+// expireWaitlist expires the offers that were not claimed in time and the entries whose slot has
+// started, it returns the facilities that had an offer expire
+func expireWaitlist(db dbtx, now time.Time) ([]int, error) {
+	if _, err := db.Exec("UPDATE booking.waitlist SET status=$1, transaction_dt=$2 WHERE status=$3 AND start_dt <= $2",
+		waitlistExpired, now, waitlistWaiting); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		"UPDATE booking.waitlist SET status=$1, transaction_dt=$2 WHERE status=$3 AND offer_expires_dt <= $2 RETURNING facility_id",
+		waitlistExpired, now, waitlistOffered)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	seen := map[int]bool{}
+	facilities := []int{}
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			facilities = append(facilities, id)
+		}
+	}
+
+	return facilities, rows.Err()
+}
+
+// waitlistNotice tells the owner of p that the slot they waited for was booked or can be claimed
+func waitlistNotice(p *waitlistEntry) mail {
+	if p.Status == waitlistPromoted {
+		return mail{
+			To:      p.Email,
+			Subject: "Your waitlisted booking has been made",
+			Body: fmt.Sprintf("The slot you were waiting for on facility %v from %v to %v has freed up and has been booked for you.\n",
+				p.FacilityID, p.StartTime, p.EndTime),
+		}
+	}
+
+	return mail{
+		To:      p.Email,
+		Subject: "A slot you are waiting for is available",
+		Body: fmt.Sprintf("The slot you were waiting for on facility %v from %v to %v has freed up.\n\nClaim it through waitlist entry %v before %v.\n",
+			p.FacilityID, p.StartTime, p.EndTime, p.ID, *p.OfferExpiresAt),
+	}
+}
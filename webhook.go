@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// events a webhook can subscribe to, they are written to the outbox by the change they describe
+const (
+	eventBookingCreated        = "booking.created"
+	eventBookingUpdated        = "booking.updated"
+	eventBookingCancelled      = "booking.cancelled"
+	eventFacilityCreated       = "facility.created"
+	eventFacilityUpdated       = "facility.updated"
+	eventFacilityStatusChanged = "facility.status_changed"
+)
+
+var webhookEvents = []string{eventBookingCreated, eventBookingUpdated, eventBookingCancelled,
+	eventFacilityCreated, eventFacilityUpdated, eventFacilityStatusChanged}
+
+// delivery statuses, a pending delivery is retried until it succeeds or runs out of attempts
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+const (
+	// maxWebhookAttempts is how many times a delivery is tried before it is given up as failed
+	maxWebhookAttempts = 8
+	// the first retry waits webhookRetryBase, each one after waits twice as long up to webhookRetryMax
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = 6 * time.Hour
+	webhookTimeout   = 10 * time.Second
+	webhookBatchSize = 50
+	// webhookLease is how long a claimed delivery is held before another instance may retry it, it
+	// outlasts a batch in which every delivery runs into webhookTimeout so a slow batch is not sent twice
+	webhookLease = webhookBatchSize*webhookTimeout + time.Minute
+)
+
+// webhook subscribes url to events, deliveries are signed with secret which is only shown when it is set
+type webhook struct {
+	ID              int      `json:"id"`
+	URL             string   `json:"url"`
+	Secret          string   `json:"secret,omitempty"`
+	Events          []string `json:"events"`
+	Active          bool     `json:"active"`
+	TransactionTime string   `json:"transaction_dt"`
+}
+
+// webhookPayload is the JSON body of a delivery, data is the booking or facility after the change
+type webhookPayload struct {
+	Event      string      `json:"event"`
+	OccurredAt string      `json:"occurred_at"`
+	Data       interface{} `json:"data"`
+}
+
+// webhookDelivery is one event queued for one webhook, with the outcome of its latest attempt
+type webhookDelivery struct {
+	ID            int             `json:"id"`
+	WebhookID     int             `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *string         `json:"next_attempt_dt"`
+	ResponseCode  int             `json:"response_code"`
+	LastError     string          `json:"last_error"`
+	CreatedAt     string          `json:"created_dt"`
+	DeliveredAt   *string         `json:"delivered_dt"`
+
+	url    string
+	secret string
+}
+
+const webhookColumns = "id, url, events, active, transaction_dt"
+
+func (p *webhook) scan(row interface{ Scan(...interface{}) error }) error {
+	var events string
+	if err := row.Scan(&p.ID, &p.URL, &events, &p.Active, &p.TransactionTime); err != nil {
+		return err
+	}
+
+	p.Events = strings.Split(events, ",")
+	return nil
+}
+
+func (p *webhook) validate() error {
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return &ruleViolation{"invalid_webhook", "url must be an absolute http or https URL"}
+	}
+
+	if len(p.Events) == 0 {
+		return &ruleViolation{"invalid_webhook", "A webhook needs at least one event"}
+	}
+
+	for _, e := range p.Events {
+		known := false
+		for _, k := range webhookEvents {
+			known = known || e == k
+		}
+		if !known {
+			return &ruleViolation{"invalid_webhook", fmt.Sprintf("Unknown event %q", e)}
+		}
+	}
+
+	return nil
+}
+
+func (p *webhook) getWebhook(db dbtx) error {
+	return p.scan(db.QueryRow("SELECT "+webhookColumns+" FROM booking.webhook WHERE id=$1", p.ID))
+}
+
+// createWebhook saves p, a secret is generated when none is given
+func (p *webhook) createWebhook(db dbtx) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	if len(p.Secret) == 0 {
+		secret, err := newToken()
+		if err != nil {
+			return err
+		}
+		p.Secret = secret
+	}
+
+	p.TransactionTime = time.Now().Format(time.RFC3339)
+	return db.QueryRow(
+		"INSERT INTO booking.webhook(url, secret, events, active, transaction_dt) VALUES($1, $2, $3, $4, $5) RETURNING id",
+		p.URL, p.Secret, strings.Join(p.Events, ","), p.Active, p.TransactionTime).Scan(&p.ID)
+}
+
+// updateWebhook saves p, the secret is only replaced when a new one is given
+func (p *webhook) updateWebhook(db dbtx) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	p.TransactionTime = time.Now().Format(time.RFC3339)
+	res, err := db.Exec("UPDATE booking.webhook SET url=$1, secret=COALESCE(NULLIF($2, ''), secret), events=$3, active=$4, transaction_dt=$5 WHERE id=$6",
+		p.URL, p.Secret, strings.Join(p.Events, ","), p.Active, p.TransactionTime, p.ID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// deleteWebhook removes p along with its delivery log
+func (p *webhook) deleteWebhook(db *sql.DB) error {
+	return withTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM booking.webhook_delivery WHERE webhook_id=$1", p.ID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec("DELETE FROM booking.webhook WHERE id=$1", p.ID)
+		return err
+	})
+}
+
+func getWebhooks(db dbtx, start, count int) ([]webhook, error) {
+	rows, err := db.Query("SELECT "+webhookColumns+" FROM booking.webhook ORDER BY id LIMIT $1 OFFSET $2", count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	webhooks := []webhook{}
+
+	for rows.Next() {
+		var p webhook
+		if err := p.scan(rows); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, p)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// queueWebhookDeliveries queues a delivery of payload to every active webhook subscribed to event
+func queueWebhookDeliveries(db dbtx, event string, payload []byte, now time.Time) error {
+	_, err := db.Exec(
+		"INSERT INTO booking.webhook_delivery(webhook_id, event, payload, status, next_attempt_dt, created_dt) SELECT id, $1, $2, $3, $4, $4 FROM booking.webhook WHERE active AND $1 = ANY(string_to_array(events, ','))",
+		event, string(payload), deliveryPending, now)
+
+	return err
+}
+
+// webhookSignature is the hex HMAC-SHA256 of timestamp.payload under secret, receivers recompute it
+// to check that a delivery is genuine and reject old timestamps to stop replays
+func webhookSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait after the given failed attempt before trying again
+func webhookBackoff(attempt int) time.Duration {
+	d := webhookRetryBase
+	for i := 1; i < attempt && d < webhookRetryMax; i++ {
+		d *= 2
+	}
+
+	if d > webhookRetryMax {
+		return webhookRetryMax
+	}
+	return d
+}
+
+// claimWebhookDeliveries leases the pending deliveries that are due so that no other instance
+// sends them at the same time, a lease that runs out without an outcome makes the delivery due again
+func claimWebhookDeliveries(db dbtx, now time.Time, limit int) ([]webhookDelivery, error) {
+	rows, err := db.Query(
+		`UPDATE booking.webhook_delivery d SET attempts=d.attempts+1, next_attempt_dt=$1 FROM booking.webhook h
+		WHERE h.id = d.webhook_id AND d.id IN (SELECT q.id FROM booking.webhook_delivery q JOIN booking.webhook w ON w.id = q.webhook_id
+			WHERE q.status=$2 AND w.active AND q.next_attempt_dt <= $3 ORDER BY q.next_attempt_dt, q.id LIMIT $4 FOR UPDATE OF q SKIP LOCKED)
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, h.url, h.secret`,
+		now.Add(webhookLease), deliveryPending, now, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []webhookDelivery{}
+
+	for rows.Next() {
+		var d webhookDelivery
+		var payload string
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Attempts, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// send posts the signed payload of d, any 2xx response counts as delivered. The signature is
+// timestamped when the request is made, sends late in a batch would otherwise look stale to receivers.
+func (d *webhookDelivery) send(client *http.Client) (int, error) {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(d.secret, timestamp, d.Payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("Webhook responded %v", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+// recordWebhookAttempt saves the outcome of an attempt, a failure is retried after webhookBackoff
+// until maxWebhookAttempts have been made
+func recordWebhookAttempt(db dbtx, d *webhookDelivery, code int, sendErr error, now time.Time) error {
+	if sendErr == nil {
+		d.Status = deliveryDelivered
+		_, err := db.Exec("UPDATE booking.webhook_delivery SET status=$1, response_code=$2, last_error='', delivered_dt=$3, next_attempt_dt=NULL WHERE id=$4",
+			d.Status, code, now, d.ID)
+		return err
+	}
+
+	var next interface{}
+	d.Status = deliveryFailed
+	if d.Attempts < maxWebhookAttempts {
+		d.Status = deliveryPending
+		next = now.Add(webhookBackoff(d.Attempts))
+	}
+
+	_, err := db.Exec("UPDATE booking.webhook_delivery SET status=$1, response_code=$2, last_error=$3, next_attempt_dt=$4 WHERE id=$5",
+		d.Status, code, sendErr.Error(), next, d.ID)
+	return err
+}
+
+// deliverWebhooks sends the deliveries that are due and returns how many succeeded
+func deliverWebhooks(db *sql.DB, client *http.Client, now time.Time) (int, error) {
+	deliveries, err := claimWebhookDeliveries(db, now, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for i := range deliveries {
+		code, sendErr := deliveries[i].send(client)
+		if err := recordWebhookAttempt(db, &deliveries[i], code, sendErr, now); err != nil {
+			return delivered, err
+		}
+		if sendErr == nil {
+			delivered++
+		}
+	}
+
+	return delivered, nil
+}
+
+// getWebhookDeliveries lists the deliveries of webhookID newest first, only those with status when it is given
+func getWebhookDeliveries(db dbtx, webhookID, start, count int, status string) ([]webhookDelivery, error) {
+	rows, err := db.Query(
+		"SELECT id, webhook_id, event, payload, status, attempts, next_attempt_dt, response_code, last_error, created_dt, delivered_dt FROM booking.webhook_delivery WHERE webhook_id=$1 AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT $3 OFFSET $4",
+		webhookID, status, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []webhookDelivery{}
+
+	for rows.Next() {
+		var d webhookDelivery
+		var payload string
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.ResponseCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// bookingEvent is the webhook event for a change to p, a change that leaves it inactive cancels it
+func bookingEvent(p *booking) string {
+	if !p.isActive() {
+		return eventBookingCancelled
+	}
+
+	return eventBookingUpdated
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// workerInterval is how often App.Run looks for background work
+const workerInterval = time.Minute
+
+func (a *App) runWorkers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		a.runJobs(now)
+	}
+}
+
+// runJobs runs every background job once, a failed job is logged and retried on the next tick
+func (a *App) runJobs(now time.Time) {
+	a.expirePendingBookings(now)
+	a.markNoShows(now)
+	a.expireWaitlist(now)
+	a.sendReminders(now)
+	a.dispatchOutbox(now)
+	a.deliverWebhooks(now)
+}
+
+func (a *App) expirePendingBookings(now time.Time) {
+	expired, err := expirePendingBookings(a.DB, now)
+	if err != nil {
+		log.Printf("Failed to expire pending bookings: %v", err)
+		return
+	}
+
+	facilities := map[int]bool{}
+	for i := range expired {
+		a.sendMail(approvalNotice(&expired[i]))
+		facilities[expired[i].FacilityID] = true
+	}
+
+	for id := range facilities {
+		a.promoteWaitlist(id)
+	}
+}
+
+// markNoShows releases the bookings nobody checked in to and offers the freed time to the waitlist
+func (a *App) markNoShows(now time.Time) {
+	released, err := markNoShows(a.DB, now)
+	if err != nil {
+		log.Printf("Failed to mark no-shows: %v", err)
+		return
+	}
+
+	facilities := map[int]bool{}
+	for i := range released {
+		a.sendMail(noShowNotice(&released[i]))
+		facilities[released[i].FacilityID] = true
+	}
+
+	for id := range facilities {
+		a.promoteWaitlist(id)
+	}
+}
+
+// expireWaitlist drops stale waitlist entries and passes unclaimed offers on to the next in line
+func (a *App) expireWaitlist(now time.Time) {
+	facilities, err := expireWaitlist(a.DB, now)
+	if err != nil {
+		log.Printf("Failed to expire waitlist: %v", err)
+		return
+	}
+
+	for _, id := range facilities {
+		a.promoteWaitlist(id)
+	}
+}
+
+// promoteWaitlist hands the free slots of facilityID to its waitlist and notifies the users
+// that were booked or offered a slot, failures are logged as the freed slot is still bookable
+func (a *App) promoteWaitlist(facilityID int) {
+	changed, err := promoteWaitlist(a.DB, facilityID, time.Now())
+	if err != nil {
+		log.Printf("Failed to promote waitlist of facility %v: %v", facilityID, err)
+		return
+	}
+
+	for i := range changed {
+		a.sendMail(waitlistNotice(&changed[i]))
+	}
+}
+
+// sendReminders mails the owners of the bookings that start soon
+func (a *App) sendReminders(now time.Time) {
+	if _, err := sendReminders(a.DB, a.Mailer, now); err != nil {
+		log.Printf("Failed to send reminders: %v", err)
+	}
+}
+
+// dispatchOutbox hands the recorded events to a.Sinks, the webhook sink queues them for deliverWebhooks
+func (a *App) dispatchOutbox(now time.Time) {
+	if _, err := dispatchOutbox(a.DB, a.Sinks, now); err != nil {
+		log.Printf("Failed to dispatch outbox: %v", err)
+	}
+}
+
+// deliverWebhooks sends the queued webhook deliveries that are due
+func (a *App) deliverWebhooks(now time.Time) {
+	if _, err := deliverWebhooks(a.DB, a.WebhookClient, now); err != nil {
+		log.Printf("Failed to deliver webhooks: %v", err)
+	}
+}